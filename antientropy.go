@@ -0,0 +1,289 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrNoPeerReady occurs when every peer of an AntiEntropy engine is waiting
+// out its backoff.
+var ErrNoPeerReady = errors.New("No peer is ready to reconcile")
+
+// DefaultAntiEntropyInterval is the time between the sessions of an
+// AntiEntropy engine whose Interval is zero.
+const DefaultAntiEntropyInterval = 10 * time.Second
+
+// BackoffPolicy determines how long an AntiEntropy engine waits before trying
+// a peer again after sessions with it fail.
+type BackoffPolicy struct {
+	Initial    time.Duration // Delay after the first failure
+	Max        time.Duration // Longest delay, or zero for no limit
+	Multiplier int           // Factor the delay is multiplied by on each failure; 2 if less than 1
+}
+
+// DefaultBackoffPolicy waits one second after a failure, doubling the delay on
+// each further failure up to five minutes.
+var DefaultBackoffPolicy = BackoffPolicy{
+	Initial:    time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+}
+
+// Delay returns the time to wait after `failures` consecutive failures. With
+// no limit, the delay saturates at the longest time.Duration.
+func (p BackoffPolicy) Delay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	multiplier := time.Duration(p.Multiplier)
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := p.Initial
+	for i := 1; i < failures && multiplier > 1; i++ {
+		if p.Max > 0 && delay >= p.Max {
+			break
+		}
+		if delay > math.MaxInt64/multiplier {
+			delay = math.MaxInt64
+			break
+		}
+		delay *= multiplier
+	}
+	if p.Max > 0 && delay > p.Max {
+		delay = p.Max
+	}
+	return delay
+}
+
+// PeerState tracks the sessions of an AntiEntropy engine with one peer.
+type PeerState struct {
+	LastAttempt time.Time // Start of the last session initiated with the peer
+	LastSuccess time.Time // End of the last session with the peer that succeeded
+	NextAttempt time.Time // Earliest time the peer is tried again
+	Failures    int       // Number of consecutive failed sessions initiated with the peer
+	Difference  int       // Size of the difference found by the last session
+	Err         error     // Reason the last failed session initiated with the peer failed
+}
+
+// Converged returns true if a session with the peer has succeeded, and the
+// last one found no difference.
+func (p PeerState) Converged() bool {
+	return !p.LastSuccess.IsZero() && p.Difference == 0
+}
+
+// AntiEntropy periodically reconciles the local keys with those of its peers,
+// one session at a time. Each step picks the ready peer that was tried least
+// recently, opens a connection to it through the Transport, and runs a Session
+// as the initiator. The difference is applied with the callbacks:
+// FetchMissing is given the keys only the peer holds, and PushMissing the keys
+// only the local set holds. A session that fails, or whose callbacks fail,
+// delays the next attempt with the peer according to the backoff policy.
+//
+// Incoming connections are answered with Serve, which runs a Session as the
+// responder. The difference found by a served session updates the state of the
+// peer, but the callbacks are left to the peer that initiated it.
+type AntiEntropy struct {
+	Transport    Transport
+	Keys         func() [][]byte                        // Returns the current local keys
+	FetchMissing func(peer string, keys [][]byte) error // Obtains the keys only the peer holds
+	PushMissing  func(peer string, keys [][]byte) error // Sends the keys only the local set holds
+	Configure    func(s *Session)                       // Applied to every session if not nil
+	Interval     time.Duration                          // Time between steps of Run
+	Backoff      BackoffPolicy
+	Now          func() time.Time // Clock used for the peer states; time.Now if nil
+
+	mu     sync.Mutex
+	peers  []string
+	states map[string]*PeerState
+}
+
+// NewAntiEntropy creates an engine reconciling the keys returned by `keys`
+// with the given peers through `transport`.
+func NewAntiEntropy(transport Transport, peers []string, keys func() [][]byte) *AntiEntropy {
+	e := &AntiEntropy{Transport: transport, Keys: keys, Backoff: DefaultBackoffPolicy, states: map[string]*PeerState{}}
+	for _, peer := range peers {
+		if _, ok := e.states[peer]; !ok {
+			e.peers = append(e.peers, peer)
+			e.states[peer] = &PeerState{}
+		}
+	}
+	return e
+}
+
+// Peers returns the peers of the engine.
+func (e *AntiEntropy) Peers() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.peers...)
+}
+
+// State returns the state of the sessions with the peer, and false if it is
+// not a peer of the engine.
+func (e *AntiEntropy) State(peer string) (PeerState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state, ok := e.states[peer]
+	if !ok {
+		return PeerState{}, false
+	}
+	return *state, true
+}
+
+// Converged returns true if the last session with every peer found no
+// difference.
+func (e *AntiEntropy) Converged() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, state := range e.states {
+		if !state.Converged() {
+			return false
+		}
+	}
+	return true
+}
+
+// Run performs a step every Interval until the context is done, and returns
+// the context's error. Failed sessions are recorded in the peer states.
+func (e *AntiEntropy) Run(ctx context.Context) error {
+	interval := e.Interval
+	if interval <= 0 {
+		interval = DefaultAntiEntropyInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.Step()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Step reconciles with the ready peer that was tried least recently, and
+// returns the peer along with the reason the session failed, if it did. It
+// returns ErrNoPeerReady if every peer is waiting out its backoff.
+func (e *AntiEntropy) Step() (string, error) {
+	now := e.now()
+	peer, ok := e.next(now)
+	if !ok {
+		return "", ErrNoPeerReady
+	}
+
+	result, err := e.initiate(peer)
+	if err == nil && e.FetchMissing != nil && len(result.Remote) > 0 {
+		err = e.FetchMissing(peer, result.Remote)
+	}
+	if err == nil && e.PushMissing != nil && len(result.Local) > 0 {
+		err = e.PushMissing(peer, result.Local)
+	}
+	e.record(peer, result, err)
+	return peer, err
+}
+
+// Serve answers a session initiated by the peer over the connection. A served
+// session does not reset the backoff of the peer, which only a session
+// initiated by Step does.
+func (e *AntiEntropy) Serve(peer string, conn io.ReadWriter) error {
+	result, err := e.newSession(conn, Responder).Run()
+	if err == nil {
+		e.recordServed(peer, result)
+	}
+	return err
+}
+
+// initiate runs a session with the peer as the initiator.
+func (e *AntiEntropy) initiate(peer string) (*Result, error) {
+	conn, err := e.Transport.Dial(peer)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return e.newSession(conn, Initiator).Run()
+}
+
+// newSession creates a session of the local keys over the connection.
+func (e *AntiEntropy) newSession(conn io.ReadWriter, role Role) *Session {
+	s := NewSession(conn, role, e.Keys())
+	if e.Configure != nil {
+		e.Configure(s)
+	}
+	return s
+}
+
+// next returns the ready peer that was tried least recently, marking it as
+// tried at `now`.
+func (e *AntiEntropy) next(now time.Time) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var next string
+	var nextState *PeerState
+	for _, peer := range e.peers {
+		state := e.states[peer]
+		if state.NextAttempt.After(now) {
+			continue
+		}
+		if nextState == nil || state.LastAttempt.Before(nextState.LastAttempt) {
+			next, nextState = peer, state
+		}
+	}
+	if nextState == nil {
+		return "", false
+	}
+	nextState.LastAttempt = now
+	return next, true
+}
+
+// record updates the state of the peer with the outcome of a session.
+func (e *AntiEntropy) record(peer string, result *Result, err error) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	state, ok := e.states[peer]
+	if !ok {
+		// Sessions served to unknown peers are not tracked
+		return
+	}
+	if err != nil {
+		state.Failures++
+		state.Err = err
+		state.NextAttempt = now.Add(e.Backoff.Delay(state.Failures))
+		return
+	}
+	state.Failures = 0
+	state.Err = nil
+	state.NextAttempt = time.Time{}
+	state.LastSuccess = now
+	state.Difference = len(result.Local) + len(result.Remote)
+}
+
+// recordServed updates the state of the peer with the outcome of a successful
+// session it initiated, leaving its backoff unchanged.
+func (e *AntiEntropy) recordServed(peer string, result *Result) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if state, ok := e.states[peer]; ok {
+		state.LastSuccess = now
+		state.Difference = len(result.Local) + len(result.Remote)
+	}
+}
+
+// now returns the current time of the engine's clock.
+func (e *AntiEntropy) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,168 @@
+package reconcile
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// memoryStore is the key set of one peer of an anti-entropy test.
+type memoryStore map[string]bool
+
+func (s memoryStore) keys() [][]byte {
+	keys := make([][]byte, 0, len(s))
+	for key := range s {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+func TestAntiEntropy(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+	shared, _ := NewTestSets(32, 200, 0, 0)
+	unique, _ := NewTestSets(32, 40, 0, 0)
+
+	// Every peer holds the shared keys and ten keys of its own
+	network := NewMemoryNetwork()
+	stores := map[string]memoryStore{}
+	engines := map[string]*AntiEntropy{}
+	clock := time.Unix(0, 0)
+	for i, name := range names {
+		store := memoryStore{}
+		for _, key := range append(shared, unique[10*i:10*(i+1)]...) {
+			store[string(key)] = true
+		}
+		stores[name] = store
+
+		var peers []string
+		for _, peer := range names {
+			if peer != name {
+				peers = append(peers, peer)
+			}
+		}
+		e := NewAntiEntropy(network.Transport(name), peers, store.keys)
+		e.Now = func() time.Time { return clock }
+		e.FetchMissing = func(peer string, keys [][]byte) error {
+			for _, key := range keys {
+				if !stores[peer][string(key)] {
+					t.Errorf("Peer %s fetched a key %s does not hold", name, peer)
+				}
+				store[string(key)] = true
+			}
+			return nil
+		}
+		e.PushMissing = func(peer string, keys [][]byte) error {
+			for _, key := range keys {
+				stores[peer][string(key)] = true
+			}
+			return nil
+		}
+		engines[name] = e
+		network.Register(name, e)
+	}
+
+	// Each round every peer takes a step
+	rounds := 0
+	for ; rounds < 10; rounds++ {
+		converged := true
+		for _, name := range names {
+			converged = converged && engines[name].Converged()
+		}
+		if converged {
+			break
+		}
+		for _, name := range names {
+			if _, err := engines[name].Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clock = clock.Add(time.Second)
+	}
+	if rounds == 10 {
+		t.Fatal("The peers did not converge")
+	}
+	for _, name := range names {
+		if len(stores[name]) != len(shared)+len(unique) {
+			t.Errorf("Peer %s holds %d keys, expected %d", name, len(stores[name]), len(shared)+len(unique))
+		}
+	}
+	t.Logf("Converged after %d rounds", rounds)
+}
+
+func TestAntiEntropyBackoff(t *testing.T) {
+	network := NewMemoryNetwork()
+	keys, _ := NewTestSets(16, 50, 0, 0)
+	local := NewAntiEntropy(network.Transport("local"), []string{"remote"}, func() [][]byte { return keys })
+	remote := NewAntiEntropy(network.Transport("remote"), []string{"local"}, func() [][]byte { return keys })
+	network.Register("local", local)
+	network.Register("remote", remote)
+
+	clock := time.Unix(0, 0)
+	local.Now = func() time.Time { return clock }
+	local.Backoff = BackoffPolicy{time.Second, 4 * time.Second, 2}
+
+	// Each failure doubles the delay up to the maximum
+	network.SetDown("remote", true)
+	for _, delay := range []time.Duration{1, 2, 4, 4} {
+		if _, err := local.Step(); err != ErrPeerUnreachable {
+			t.Fatalf("Expected %v, got %v", ErrPeerUnreachable, err)
+		}
+		if _, err := local.Step(); err != ErrNoPeerReady {
+			t.Fatalf("Expected %v while backing off, got %v", ErrNoPeerReady, err)
+		}
+		state, _ := local.State("remote")
+		if state.NextAttempt != clock.Add(delay*time.Second) {
+			t.Errorf("Expected a delay of %ds, got %v", delay, state.NextAttempt.Sub(clock))
+		}
+		clock = state.NextAttempt
+	}
+
+	// A session initiated by the peer leaves the backoff in place
+	if _, err := local.Step(); err != ErrPeerUnreachable {
+		t.Fatalf("Expected %v, got %v", ErrPeerUnreachable, err)
+	}
+	network.SetDown("remote", false)
+	before, _ := local.State("remote")
+	if _, err := remote.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := local.State("remote"); state.Failures != before.Failures || state.NextAttempt != before.NextAttempt {
+		t.Error("The served session reset the backoff")
+	}
+	if _, err := local.Step(); err != ErrNoPeerReady {
+		t.Errorf("Expected %v while backing off, got %v", ErrNoPeerReady, err)
+	}
+	clock = before.NextAttempt
+
+	// Once reachable, the peer is tried again and the failures reset
+	if peer, err := local.Step(); err != nil || peer != "remote" {
+		t.Fatalf("Expected a session with the remote peer, got %q and %v", peer, err)
+	}
+	state, _ := local.State("remote")
+	if state.Failures != 0 || state.Err != nil || !local.Converged() {
+		t.Error("The identical peers did not converge")
+	}
+	if !remote.Converged() {
+		t.Error("The served session was not recorded")
+	}
+}
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy   BackoffPolicy
+		failures int
+		delay    time.Duration
+	}{
+		{BackoffPolicy{time.Second, 0, 2}, 3, 4 * time.Second},
+		{BackoffPolicy{time.Second, 0, 0}, 3, 4 * time.Second},
+		{BackoffPolicy{time.Second, 0, 1}, 3, time.Second},
+		{BackoffPolicy{time.Second, 0, 3}, 3, 9 * time.Second},
+		{BackoffPolicy{time.Second, 0, 2}, 100, math.MaxInt64},
+		{BackoffPolicy{time.Second, time.Minute, 2}, 100, time.Minute},
+	}
+	for _, test := range tests {
+		if delay := test.policy.Delay(test.failures); delay != test.delay {
+			t.Errorf("For %+v after %d failures expected %v, got %v", test.policy, test.failures, test.delay, delay)
+		}
+	}
+}
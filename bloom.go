@@ -0,0 +1,220 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+)
+
+// bloomSalt is mixed into the seed of the Bloom filter hash, so that it is
+// independent of the hashes placing keys in the cells of an IBF.
+const bloomSalt = 0x85ebca6b
+
+// maxBloomHashCount bounds the number of bits set for each key.
+const maxBloomHashCount = 32
+
+// bloomMagic begins the binary encoding of a BloomFilter.
+const bloomMagic = "BF"
+
+// BloomFilter is a set membership structure that never reports a key it holds
+// as missing, but reports a key it does not hold as present with a chosen
+// false positive rate. Each key sets `Hashcount` bits of the filter, at
+// positions given by double hashing.
+//
+// A filter of zero bits holds every key.
+//
+// B. H. Bloom. Space/time trade-offs in hash coding with allowable errors.
+// Communications of the ACM, 13(7):422–426, 1970.
+type BloomFilter struct {
+	Size      int // Number of bits
+	Hashcount int
+	Bitset    []byte
+	Hasher    Hasher // Hash function placing keys; Murmur3 if nil
+	Seed      uint32 // Seed of the hash function
+}
+
+// BloomSerialization is the JSON encoding of a BloomFilter.
+type BloomSerialization struct {
+	Size      int        `json:"size"`
+	Hashcount int        `json:"hashcount"`
+	Data      string     `json:"data"`
+	Hash      HashScheme `json:"hash,omitempty"`
+	Seed      uint32     `json:"seed,omitempty"`
+}
+
+// NewBloomFilter creates an empty filter of `size` bits, setting `hashcount`
+// bits for each key. The hash function and its seed may be selected with the
+// WithHasher and WithSeed options.
+func NewBloomFilter(size, hashcount int, opts ...Option) *BloomFilter {
+	size = max(size, 0)
+	hashcount = min(max(hashcount, 1), maxBloomHashCount)
+	o := applyOptions(opts)
+	return &BloomFilter{size, hashcount, make([]byte, (size+7)/8), o.hasher, o.seed}
+}
+
+// NewBloomFilterRate creates an empty filter of the optimal size for holding
+// `count` keys with the false positive rate `fpr`. A rate of 1 or more gives a
+// filter of zero bits.
+func NewBloomFilterRate(count int, fpr float64, opts ...Option) *BloomFilter {
+	size, hashcount := bloomParameters(count, fpr)
+	return NewBloomFilter(size, hashcount, opts...)
+}
+
+// bloomParameters returns the optimal size and hash count of a filter holding
+// `count` keys with the false positive rate `fpr`: -count ln(fpr) / ln(2)^2
+// bits, and ln(2) bits per key set for each key. The filter has at least 8
+// bits unless every key is to be reported present.
+func bloomParameters(count int, fpr float64) (size, hashcount int) {
+	if fpr >= 1 {
+		return 0, 1
+	}
+	bits := -float64(count) * math.Log(fpr) / (math.Ln2 * math.Ln2)
+	size = max(int(math.Ceil(bits)), 8)
+	hashcount = 1
+	if count > 0 {
+		hashcount = int(math.Round(float64(size) / float64(count) * math.Ln2))
+	}
+	return size, min(max(hashcount, 1), maxBloomHashCount)
+}
+
+// positions calls `fn` with each bit position of the key.
+func (b *BloomFilter) positions(key []byte, fn func(position int)) {
+	h := defaultHasher(b.Hasher).Sum128(key, b.Seed^bloomSalt)
+	first := uint64(h[0])<<32 | uint64(h[1])
+	second := uint64(h[2])<<32 | uint64(h[3]) | 1
+	for i := 0; i < b.Hashcount; i++ {
+		fn(int((first + uint64(i)*second) % uint64(b.Size)))
+	}
+}
+
+// Add sets the bits of the key.
+func (b *BloomFilter) Add(key []byte) {
+	if b.Size == 0 {
+		return
+	}
+	b.positions(key, func(position int) {
+		b.Bitset[position/8] |= 1 << (position % 8)
+	})
+}
+
+// Contains returns true if every bit of the key is set, which is always the
+// case if the key was added.
+func (b *BloomFilter) Contains(key []byte) bool {
+	if b.Size == 0 {
+		return true
+	}
+	contains := true
+	b.positions(key, func(position int) {
+		if b.Bitset[position/8]&(1<<(position%8)) == 0 {
+			contains = false
+		}
+	})
+	return contains
+}
+
+// FalsePositiveRate returns the expected rate at which keys not added are
+// reported present, if `count` keys were added.
+func (b *BloomFilter) FalsePositiveRate(count int) float64 {
+	if b.Size == 0 {
+		return 1
+	}
+	k := float64(b.Hashcount)
+	return math.Pow(1-math.Exp(-k*float64(count)/float64(b.Size)), k)
+}
+
+// scheme returns the identifier of the hash function of the filter.
+func (b *BloomFilter) scheme() HashScheme {
+	return defaultHasher(b.Hasher).Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (b *BloomFilter) flags() (flags byte) {
+	if b.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// MarshalJSON encodes the filter as documented by the BloomSerialization type.
+func (b *BloomFilter) MarshalJSON() ([]byte, error) {
+	var scheme HashScheme
+	if b.scheme() != HashMurmur3 {
+		scheme = b.scheme()
+	}
+	return json.Marshal(&BloomSerialization{b.Size, b.Hashcount, hex.EncodeToString(b.Bitset), scheme, b.Seed})
+}
+
+// UnmarshalJSON decodes the filter from the format produced by MarshalJSON.
+func (b *BloomFilter) UnmarshalJSON(data []byte) error {
+	serialization := &BloomSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	bitset, err := hex.DecodeString(serialization.Data)
+	if err != nil {
+		return err
+	}
+	decoded := BloomFilter{serialization.Size, serialization.Hashcount, bitset, hasher, serialization.Seed}
+	if !decoded.valid() {
+		return ErrMalformed
+	}
+	*b = decoded
+	return nil
+}
+
+// MarshalBinary encodes the filter in a compact binary format. The header
+// holds the magic bytes "BF", a version byte, the hash scheme, a flags byte,
+// and the size in bits and hash count as unsigned varints, followed by the
+// seed in 4 little-endian bytes if it is not zero. The bits then follow, the
+// first in the lowest bit of the first byte.
+func (b *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 16+len(b.Bitset))
+	data = append(data, bloomMagic...)
+	data = append(data, binaryVersion, byte(b.scheme()), b.flags())
+	data = binary.AppendUvarint(data, uint64(b.Size))
+	data = binary.AppendUvarint(data, uint64(b.Hashcount))
+	if b.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, b.Seed)
+	}
+	return append(data, b.Bitset...), nil
+}
+
+// UnmarshalBinary decodes the filter from the format produced by
+// MarshalBinary.
+func (b *BloomFilter) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(bloomMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^flagSeeded != 0 {
+		d.fail(ErrMalformed)
+	}
+	size := d.length()
+	hashcount := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	bitset := d.bytes((size + 7) / 8)
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	decoded := BloomFilter{size, hashcount, append([]byte{}, bitset...), hasher, seed}
+	if !decoded.valid() {
+		return ErrMalformed
+	}
+	*b = decoded
+	return nil
+}
+
+// valid returns true if the decoded parameters are consistent.
+func (b *BloomFilter) valid() bool {
+	return b.Size >= 0 && b.Hashcount >= 1 && b.Hashcount <= maxBloomHashCount &&
+		len(b.Bitset) == (b.Size+7)/8
+}
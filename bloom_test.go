@@ -0,0 +1,82 @@
+package reconcile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	keys := makeRandomElements(1000, 16)
+	others := makeRandomElements(20000, 16)
+
+	for _, fpr := range []float64{0.1, 0.01, 0.001} {
+		bloom := NewBloomFilterRate(len(keys), fpr, WithSeed(3))
+		for _, key := range keys {
+			bloom.Add(key)
+		}
+		for _, key := range keys {
+			if !bloom.Contains(key) {
+				t.Fatal("A key added to the filter is missing")
+			}
+		}
+
+		positives := 0
+		for _, key := range others {
+			if bloom.Contains(key) {
+				positives++
+			}
+		}
+		rate := float64(positives) / float64(len(others))
+		if rate > 2*fpr+0.001 {
+			t.Errorf("False positive rate %f is far above %f", rate, fpr)
+		}
+		if expected := bloom.FalsePositiveRate(len(keys)); expected > 1.2*fpr {
+			t.Errorf("Expected false positive rate %f is above %f", expected, fpr)
+		}
+	}
+
+	// A filter of zero bits holds every key
+	if bloom := NewBloomFilterRate(100, 1); bloom.Size != 0 || !bloom.Contains(others[0]) {
+		t.Error("A filter with a false positive rate of 1 does not hold every key")
+	}
+	if bloom := NewBloomFilterRate(0, 0.01); bloom.Contains(others[0]) {
+		t.Error("An empty filter holds a key")
+	}
+}
+
+func TestBloomFilterSerialization(t *testing.T) {
+	bloom := NewBloomFilterRate(200, 0.02, WithSeed(8))
+	for _, key := range makeRandomElements(200, 16) {
+		bloom.Add(key)
+	}
+
+	data, err := bloom.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &BloomFilter{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bloom, decoded) {
+		t.Error("Binary decoded filter does not match the original")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+		t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+	}
+
+	data, err = bloom.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &BloomFilter{}
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bloom, decoded) {
+		t.Error("JSON decoded filter does not match the original")
+	}
+	if err := decoded.UnmarshalJSON([]byte(`{"size":16,"hashcount":2,"data":"00"}`)); err != ErrMalformed {
+		t.Errorf("Expected %v for a short bitset, got %v", ErrMalformed, err)
+	}
+}
@@ -0,0 +1,251 @@
+package reconcile
+
+import (
+	"errors"
+	"slices"
+)
+
+// ErrNoPeers occurs when planning transfers before any sketch has been added
+// to a Coordinator.
+var ErrNoPeers = errors.New("No peer sketches to reconcile")
+
+// Coordinator reconciles the sets of several peers at once, from one IBF
+// sketch of each, in place of a session between every pair of peers. Every
+// peer produces its sketch with Reconcile.GetIBFSignature using the same size,
+// keysize, hash function and seed, which should be large enough for the
+// difference between the first peer and any other.
+//
+// The first peer added is the root. Each other peer's sketch is subtracted
+// from the root's, and the decoded difference gives the keys of the root that
+// the peer lacks and the keys of the peer that the root lacks. When a peer's
+// difference from the root does not decode, its difference from a peer already
+// resolved is decoded instead, and the two are chained. The union of the sets
+// and the keys each peer lacks then follow.
+type Coordinator struct {
+	Format Format // Encoding of the sketches; binary by default
+
+	peers    []string
+	sketches map[string]*IBF
+}
+
+// Transfer is a batch of keys to send from one peer to another.
+type Transfer struct {
+	From string
+	To   string
+	Keys [][]byte
+}
+
+// TransferPlan is the result of reconciling the peers of a Coordinator.
+type TransferPlan struct {
+	Missing    map[string][][]byte // Keys of the union each peer lacks
+	Transfers  []Transfer          // Batches delivering the missing keys
+	Bytes      int                 // Total size of the keys transferred
+	Unresolved []string            // Peers whose differences did not decode
+}
+
+// peerDifference is the difference between a peer's set and the root's.
+type peerDifference struct {
+	lacks  map[string]bool // Keys of the root the peer lacks
+	extras map[string]bool // Keys of the peer the root lacks
+}
+
+// NewCoordinator creates a coordinator with no peers.
+func NewCoordinator() *Coordinator {
+	return &Coordinator{sketches: map[string]*IBF{}}
+}
+
+// AddSketch adds the sketch of a peer, or replaces it if the peer was added
+// before. It returns an error if the sketch cannot be decoded, or if it cannot
+// be subtracted from the sketches already added.
+func (c *Coordinator) AddSketch(peer string, signature []byte) error {
+	ibf := &IBF{}
+	var err error
+	if c.Format == FormatJSON {
+		err = ibf.UnmarshalJSON(signature)
+	} else {
+		err = ibf.UnmarshalBinary(signature)
+	}
+	if err != nil {
+		return err
+	}
+	return c.AddIBF(peer, ibf)
+}
+
+// AddIBF adds the sketch of a peer as a filter, like AddSketch. The filter is
+// not modified.
+func (c *Coordinator) AddIBF(peer string, ibf *IBF) error {
+	if len(c.peers) > 0 {
+		root := c.sketches[c.peers[0]]
+		if ibf.Size != root.Size || ibf.Keysize != root.Keysize || ibf.Variable != root.Variable {
+			return ErrIBFMismatch
+		}
+		if ibf.scheme() != root.scheme() {
+			return ErrHasherMismatch
+		}
+		if ibf.Seed != root.Seed {
+			return ErrSeedMismatch
+		}
+	}
+	if _, ok := c.sketches[peer]; !ok {
+		c.peers = append(c.peers, peer)
+	}
+	c.sketches[peer] = ibf
+	return nil
+}
+
+// Peers returns the peers in the order they were added, the root first.
+func (c *Coordinator) Peers() []string {
+	return slices.Clone(c.peers)
+}
+
+// Plan decodes the difference of every peer and returns the transfers that
+// bring each resolved peer to the union of the resolved peers' sets. Each key
+// is sent once to each peer lacking it, which is the least possible, and is
+// sent by whichever peer holding it has sent the fewest bytes so far.
+//
+// Peers whose difference from every resolved peer fails to decode are listed
+// in Unresolved and take no part in the plan, which may be retried with larger
+// sketches. It returns ErrNoPeers if no sketch has been added.
+func (c *Coordinator) Plan() (*TransferPlan, error) {
+	if len(c.peers) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	root := c.peers[0]
+	resolved := []string{root}
+	differences := map[string]peerDifference{root: {map[string]bool{}, map[string]bool{}}}
+	pending := slices.Clone(c.peers[1:])
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		for i := 0; i < len(pending); i++ {
+			peer := pending[i]
+			if difference, ok := c.resolve(peer, resolved, differences); ok {
+				differences[peer] = difference
+				resolved = append(resolved, peer)
+				pending = slices.Delete(pending, i, i+1)
+				i--
+				progress = true
+			}
+		}
+	}
+
+	plan := &TransferPlan{Missing: map[string][][]byte{}, Unresolved: pending}
+
+	// The keys outside the root's set held by any peer
+	extras := map[string]bool{}
+	for _, peer := range resolved {
+		for key := range differences[peer].extras {
+			extras[key] = true
+		}
+	}
+	union := sortedKeys(extras)
+
+	// Each missing key is sent by the holder that has sent the least
+	sent := map[string]int{}
+	batches := map[[2]string][][]byte{}
+	for _, peer := range resolved {
+		difference := differences[peer]
+		missing := sortedKeys(difference.lacks)
+		lacked := len(missing)
+		for _, key := range union {
+			if !difference.extras[key] {
+				missing = append(missing, key)
+			}
+		}
+
+		for i, key := range missing {
+			source := ""
+			for _, holder := range resolved {
+				if differences[holder].holds(key, i < lacked) && (source == "" || sent[holder] < sent[source]) {
+					source = holder
+				}
+			}
+			sent[source] += len(key)
+			batches[[2]string{source, peer}] = append(batches[[2]string{source, peer}], []byte(key))
+			plan.Missing[peer] = append(plan.Missing[peer], []byte(key))
+			plan.Bytes += len(key)
+		}
+	}
+
+	for _, from := range resolved {
+		for _, to := range resolved {
+			if keys := batches[[2]string{from, to}]; len(keys) > 0 {
+				plan.Transfers = append(plan.Transfers, Transfer{from, to, keys})
+			}
+		}
+	}
+	return plan, nil
+}
+
+// resolve decodes the difference between the peer and a resolved peer, trying
+// the root first, and chains it with that peer's difference from the root. It
+// returns false if no difference decodes.
+func (c *Coordinator) resolve(peer string, resolved []string, differences map[string]peerDifference) (peerDifference, bool) {
+	for _, other := range resolved {
+		difference, err := Difference(c.sketches[other], c.sketches[peer])
+		if err != nil {
+			continue
+		}
+		otherOnly, peerOnly, ok := difference.Decode()
+		if !ok {
+			continue
+		}
+
+		// A key of the root is lacked by the peer if the other peer lacks it
+		// and the peer does not hold it, or if only the other peer holds it,
+		// and likewise for the keys the root lacks
+		known := differences[other]
+		otherKeys, peerKeys := keySet(otherOnly), keySet(peerOnly)
+		result := peerDifference{map[string]bool{}, map[string]bool{}}
+		for key := range known.lacks {
+			if !peerKeys[key] {
+				result.lacks[key] = true
+			}
+		}
+		for key := range otherKeys {
+			if !known.extras[key] {
+				result.lacks[key] = true
+			}
+		}
+		for key := range known.extras {
+			if !otherKeys[key] {
+				result.extras[key] = true
+			}
+		}
+		for key := range peerKeys {
+			if !known.lacks[key] {
+				result.extras[key] = true
+			}
+		}
+		return result, true
+	}
+	return peerDifference{}, false
+}
+
+// holds returns true if the peer holds the key, which is one of the root's
+// keys if `rootKey` is set, and otherwise one the root lacks.
+func (d peerDifference) holds(key string, rootKey bool) bool {
+	if rootKey {
+		return !d.lacks[key]
+	}
+	return d.extras[key]
+}
+
+// keySet returns the keys as a set.
+func keySet(keys [][]byte) map[string]bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[string(key)] = true
+	}
+	return set
+}
+
+// sortedKeys returns the keys of the set in ascending order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
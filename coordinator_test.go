@@ -0,0 +1,134 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// coordinatorKeys returns `n` fixed keys of 32 bytes beginning with `prefix`,
+// so that the sketches decode the same way on every run.
+func coordinatorKeys(prefix byte, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		key := make([]byte, 24, 32)
+		key[0] = prefix
+		keys[i] = binary.BigEndian.AppendUint64(key, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	return keys
+}
+
+// coordinatorSketch returns the sketch of the keys with `size` cells.
+func coordinatorSketch(t *testing.T, keys [][]byte, size int, format Format) []byte {
+	r := NewReconcile(keys, len(keys), WithSeed(5))
+	r.Format = format
+	signature, err := r.GetIBFSignature(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestCoordinator(t *testing.T) {
+	base := coordinatorKeys(0, 500)
+	extra := coordinatorKeys(1, 3)
+
+	// Each peer lacks ten more of the root's keys than the one before, so the
+	// later peers are only resolved by chaining through the earlier ones
+	sets := map[string][][]byte{
+		"root": base,
+		"p1":   append(append([][]byte{}, base[10:]...), extra[:2]...),
+		"p2":   base[20:],
+		"p3":   append(append([][]byte{}, base[30:]...), extra[2]),
+		"p4":   base[40:],
+	}
+	peers := []string{"root", "p1", "p2", "p3", "p4"}
+	size := 24
+
+	c := NewCoordinator()
+	for _, peer := range peers {
+		if err := c.AddSketch(peer, coordinatorSketch(t, sets[peer], size, FormatBinary)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(c.Peers(), peers) {
+		t.Errorf("Expected peers %v, got %v", peers, c.Peers())
+	}
+	if _, _, ok := NewReconcile(base, len(base), WithSeed(5)).GetDifference(size, coordinatorSketch(t, sets["p4"], size, FormatBinary)); ok {
+		t.Fatal("The last peer's difference from the root decoded, so no chaining is tested")
+	}
+
+	plan, err := c.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Unresolved) != 0 {
+		t.Fatalf("Peers %v were not resolved", plan.Unresolved)
+	}
+
+	// Carrying out the transfers brings every peer to the union
+	held := map[string]map[string]bool{}
+	for _, peer := range peers {
+		held[peer] = keySet(sets[peer])
+	}
+	bytes := 0
+	for _, transfer := range plan.Transfers {
+		for _, key := range transfer.Keys {
+			if !held[transfer.From][string(key)] {
+				t.Fatalf("Peer %s sends a key it does not hold", transfer.From)
+			}
+			if held[transfer.To][string(key)] {
+				t.Fatalf("Peer %s is sent a key it holds", transfer.To)
+			}
+			held[transfer.To][string(key)] = true
+			bytes += len(key)
+		}
+	}
+	union := keySet(append(append([][]byte{}, base...), extra...))
+	for _, peer := range peers {
+		if !reflect.DeepEqual(held[peer], union) {
+			t.Errorf("Peer %s does not hold the union after the transfers", peer)
+		}
+		if len(plan.Missing[peer]) != len(union)-len(sets[peer]) {
+			t.Errorf("Peer %s is missing %d keys, expected %d", peer, len(plan.Missing[peer]), len(union)-len(sets[peer]))
+		}
+	}
+	if bytes != plan.Bytes {
+		t.Errorf("The plan moves %d bytes, but its total is %d", bytes, plan.Bytes)
+	}
+}
+
+func TestCoordinatorUnresolved(t *testing.T) {
+	base := coordinatorKeys(0, 200)
+	c := NewCoordinator()
+	c.Format = FormatJSON
+	if _, err := c.Plan(); err != ErrNoPeers {
+		t.Errorf("Expected %v, got %v", ErrNoPeers, err)
+	}
+
+	sets := map[string][][]byte{"root": base, "near": base[3:], "distant": coordinatorKeys(2, 200)}
+	for _, peer := range []string{"root", "near", "distant"} {
+		if err := c.AddSketch(peer, coordinatorSketch(t, sets[peer], 40, FormatJSON)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := c.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Unresolved, []string{"distant"}) {
+		t.Errorf("Expected the distant peer to be unresolved, got %v", plan.Unresolved)
+	}
+	if len(plan.Transfers) != 1 || plan.Transfers[0].From != "root" || plan.Transfers[0].To != "near" ||
+		!sameElements(plan.Transfers[0].Keys, base[:3]) {
+		t.Errorf("Expected the root to send its 3 keys to the near peer, got %v", plan.Transfers)
+	}
+
+	if err := c.AddIBF("other", NewIBF(40, 32)); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+	if err := c.AddIBF("other", NewIBF(41, 32, WithSeed(5))); err != ErrIBFMismatch {
+		t.Errorf("Expected %v, got %v", ErrIBFMismatch, err)
+	}
+}
@@ -0,0 +1,573 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/bits"
+)
+
+// ErrCPIMismatch occurs when characteristic polynomials are evaluated at a
+// different number of points, and so they cannot be compared.
+var ErrCPIMismatch = errors.New("Mismatched characteristic polynomial evaluations")
+
+// cpiPrime is the Mersenne prime 2^61-1, the order of the field in which the
+// characteristic polynomials are evaluated.
+const cpiPrime = 1<<61 - 1
+
+// cpiMaxPoints bounds the number of evaluation points. Interpolation takes
+// cubic time in the number of points, so CPISync is only suited to small
+// differences.
+const cpiMaxPoints = 256
+
+// cpiCheckPoints is the number of evaluations kept aside to verify the
+// interpolated polynomials.
+const cpiCheckPoints = 2
+
+// cpiMagic begins the binary encoding of a CPISync.
+const cpiMagic = "CP"
+
+// CPISync holds the evaluations of the characteristic polynomial of a set,
+// the product of (z - x) over the field element x of each key, at fixed
+// points. For a difference of m keys only about m evaluations need to be
+// exchanged, far fewer than the cells of an IBF or a strata estimator, but
+// decoding takes time cubic in m and fails if the difference is larger than
+// the number of points.
+//
+// The ratio of the evaluations of two sets is a rational function whose
+// numerator and denominator have as roots the elements of the keys only
+// present in either set. These are interpolated from the evaluations, and
+// each party finds the keys of its own set among the roots.
+//
+// Y. Minsky, A. Trachtenberg, and R. Zippel. Set reconciliation with nearly
+// optimal communication complexity. IEEE Transactions on Information Theory,
+// 49(9):2213–2218, 2003.
+type CPISync struct {
+	Evaluations []uint64
+	Setsize     int
+	Hasher      Hasher
+	Seed        uint32
+}
+
+// CPISerialization is the JSON encoding of a CPISync.
+type CPISerialization struct {
+	Evaluations []uint64   `json:"evaluations"`
+	Setsize     int        `json:"setsize"`
+	Hash        HashScheme `json:"hash,omitempty"`
+	Seed        uint32     `json:"seed,omitempty"`
+}
+
+// Polynomial is a polynomial over the field of CPISync, with coefficients from
+// the constant term upward.
+type Polynomial []uint64
+
+// NewCPISync creates the characteristic polynomial of the empty set evaluated
+// at `points` points, at most 256. The hash function and its seed may be
+// selected with the WithHasher and WithSeed options.
+func NewCPISync(points int, opts ...Option) *CPISync {
+	points = min(max(points, 1), cpiMaxPoints)
+	evaluations := make([]uint64, points)
+	for i := range evaluations {
+		evaluations[i] = 1
+	}
+	o := applyOptions(opts)
+	return &CPISync{evaluations, 0, o.hasher, o.seed}
+}
+
+// cpiPoint returns the i-th evaluation point. The points are the top of the
+// field, which no key is mapped to.
+func cpiPoint(i int) uint64 {
+	return cpiPrime - 1 - uint64(i)
+}
+
+// element maps the key to a field element below the evaluation points.
+func (c *CPISync) element(key []byte) uint64 {
+	hashes := defaultHasher(c.Hasher).Sum128(key, c.Seed)
+	x := (uint64(hashes[0])<<32 | uint64(hashes[1])) & cpiPrime
+	if x >= cpiPrime-cpiMaxPoints {
+		x -= cpiMaxPoints
+	}
+	return x
+}
+
+// Add multiplies each evaluation by (z - x) for the element x of the key.
+func (c *CPISync) Add(key []byte) {
+	x := c.element(key)
+	for i := range c.Evaluations {
+		c.Evaluations[i] = cpiMul(c.Evaluations[i], cpiPoint(i)-x)
+	}
+	c.Setsize++
+}
+
+// Remove divides each evaluation by (z - x) for the element x of the key,
+// which must have been added.
+func (c *CPISync) Remove(key []byte) {
+	x := c.element(key)
+	for i := range c.Evaluations {
+		c.Evaluations[i] = cpiMul(c.Evaluations[i], cpiInverse(cpiPoint(i)-x))
+	}
+	c.Setsize--
+}
+
+// Compatible returns an error if the remote evaluations cannot be compared
+// with these.
+func (c *CPISync) Compatible(remote *CPISync) error {
+	if defaultHasher(c.Hasher).Scheme() != defaultHasher(remote.Hasher).Scheme() {
+		return ErrHasherMismatch
+	}
+	if c.Seed != remote.Seed {
+		return ErrSeedMismatch
+	}
+	if len(c.Evaluations) != len(remote.Evaluations) {
+		return ErrCPIMismatch
+	}
+	return nil
+}
+
+// Difference interpolates the polynomials whose roots are the elements of the
+// keys only present locally and of those only present remotely. The rational
+// function is fitted to all but two of the evaluations, and checked against
+// the remaining two. ErrDecodeFailed is returned if no fit is found, which is
+// the case when the difference is larger than the number of points allows.
+func (c *CPISync) Difference(remote *CPISync) (local Polynomial, other Polynomial, err error) {
+	if err := c.Compatible(remote); err != nil {
+		return nil, nil, err
+	}
+
+	// The degrees of the polynomials must sum to the number of evaluations
+	// used, and differ by the difference in set sizes
+	delta := c.Setsize - remote.Setsize
+	points := len(c.Evaluations) - cpiCheckPoints
+	if (points+delta)%2 != 0 {
+		points--
+	}
+	if points < 0 || delta > points || -delta > points {
+		return nil, nil, ErrDecodeFailed
+	}
+	localdegree, otherdegree := (points+delta)/2, (points-delta)/2
+
+	// Each evaluation point z with ratio f gives a linear equation in the
+	// unknown coefficients: P(z) - f Q(z) = 0, with P and Q monic
+	ratios := make([]uint64, len(c.Evaluations))
+	for i := range ratios {
+		ratios[i] = cpiMul(c.Evaluations[i], cpiInverse(remote.Evaluations[i]))
+	}
+	system := make([][]uint64, points)
+	for i := range system {
+		z, f := cpiPoint(i), ratios[i]
+		row := make([]uint64, points+1)
+		power := uint64(1)
+		for j := 0; j < max(localdegree, otherdegree); j++ {
+			if j < localdegree {
+				row[j] = power
+			}
+			if j < otherdegree {
+				row[localdegree+j] = cpiSub(0, cpiMul(f, power))
+			}
+			power = cpiMul(power, z)
+		}
+		row[points] = cpiSub(cpiMul(f, cpiPow(z, uint64(otherdegree))), cpiPow(z, uint64(localdegree)))
+		system[i] = row
+	}
+	solution, ok := cpiSolve(system, points)
+	if !ok {
+		return nil, nil, ErrDecodeFailed
+	}
+
+	local = append(Polynomial{}, solution[:localdegree]...)
+	local = append(local, 1)
+	other = append(Polynomial{}, solution[localdegree:]...)
+	other = append(other, 1)
+
+	// A smaller difference leaves a common factor in both polynomials
+	divisor := local.gcd(other)
+	local, _ = local.divide(divisor)
+	other, _ = other.divide(divisor)
+
+	for i := points; i < len(c.Evaluations); i++ {
+		z := cpiPoint(i)
+		if cpiMul(local.Evaluate(z), remote.Evaluations[i]) != cpiMul(other.Evaluate(z), c.Evaluations[i]) {
+			return nil, nil, ErrDecodeFailed
+		}
+	}
+	return local, other, nil
+}
+
+// MarshalJSON encodes the evaluations as documented by the CPISerialization
+// type.
+func (c *CPISync) MarshalJSON() ([]byte, error) {
+	var scheme HashScheme
+	if c.scheme() != HashMurmur3 {
+		scheme = c.scheme()
+	}
+	return json.Marshal(&CPISerialization{c.Evaluations, c.Setsize, scheme, c.Seed})
+}
+
+// UnmarshalJSON decodes the evaluations from the format produced by
+// MarshalJSON.
+func (c *CPISync) UnmarshalJSON(data []byte) error {
+	serialization := &CPISerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	if !validEvaluations(serialization.Evaluations) || serialization.Setsize < 0 {
+		return ErrMalformed
+	}
+	*c = CPISync{serialization.Evaluations, serialization.Setsize, hasher, serialization.Seed}
+	return nil
+}
+
+// MarshalBinary encodes the evaluations in a compact binary format. The header
+// holds the magic bytes "CP", a version byte, the hash scheme, a flags byte,
+// and the number of evaluations as an unsigned varint, followed by the seed in
+// 4 little-endian bytes if it is not zero. The set size follows as an unsigned
+// varint, and then each evaluation in 8 little-endian bytes.
+func (c *CPISync) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 16+8*len(c.Evaluations))
+	data = append(data, cpiMagic...)
+	data = append(data, binaryVersion, byte(c.scheme()), c.flags())
+	data = binary.AppendUvarint(data, uint64(len(c.Evaluations)))
+	if c.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, c.Seed)
+	}
+	data = binary.AppendUvarint(data, uint64(c.Setsize))
+	for _, evaluation := range c.Evaluations {
+		data = binary.LittleEndian.AppendUint64(data, evaluation)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the evaluations from the format produced by
+// MarshalBinary.
+func (c *CPISync) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(cpiMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^flagSeeded != 0 {
+		d.fail(ErrMalformed)
+	}
+	points := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	setsize := d.length()
+	if d.err != nil {
+		return d.err
+	}
+	if points < 1 || points > cpiMaxPoints {
+		return ErrMalformed
+	}
+
+	evaluations := make([]uint64, points)
+	for i := range evaluations {
+		if b := d.bytes(8); b != nil {
+			evaluations[i] = binary.LittleEndian.Uint64(b)
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if !validEvaluations(evaluations) {
+		return ErrMalformed
+	}
+
+	*c = CPISync{evaluations, setsize, hasher, seed}
+	return nil
+}
+
+// validEvaluations returns true if there is an acceptable number of
+// evaluations, each a nonzero field element. No evaluation of a characteristic
+// polynomial is zero, since no key is mapped to an evaluation point.
+func validEvaluations(evaluations []uint64) bool {
+	if len(evaluations) < 1 || len(evaluations) > cpiMaxPoints {
+		return false
+	}
+	for _, evaluation := range evaluations {
+		if evaluation == 0 || evaluation >= cpiPrime {
+			return false
+		}
+	}
+	return true
+}
+
+// scheme returns the identifier of the hash function.
+func (c *CPISync) scheme() HashScheme {
+	return defaultHasher(c.Hasher).Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (c *CPISync) flags() (flags byte) {
+	if c.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// GetCPISignature encodes the characteristic polynomial of the local keys
+// evaluated at `points` points in the configured format. About one point is
+// needed for each key in the difference, and two more to verify it.
+func (r *Reconcile) GetCPISignature(points int) ([]byte, error) {
+	c := r.localCPISync(points)
+	if r.Format == FormatJSON {
+		return c.MarshalJSON()
+	}
+	return c.MarshalBinary()
+}
+
+// GetCPIDifference decodes the remote CPISync signature. It returns the keys
+// only present locally, and the polynomial whose roots are the keys only
+// present remotely, to be found by the remote party with CPIRoots.
+func (r *Reconcile) GetCPIDifference(remotesignature []byte) (a [][]byte, b Polynomial, err error) {
+	remote := &CPISync{}
+	if r.Format == FormatJSON {
+		err = remote.UnmarshalJSON(remotesignature)
+	} else {
+		err = remote.UnmarshalBinary(remotesignature)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local := r.localCPISync(len(remote.Evaluations))
+	p, b, err := local.Difference(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	if a, err = r.CPIRoots(p); err != nil {
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+// CPIRoots returns the local keys that are roots of the polynomial found by
+// the remote party's GetCPIDifference. ErrDecodeFailed is returned unless a
+// key is found for every root.
+func (r *Reconcile) CPIRoots(p Polynomial) ([][]byte, error) {
+	c := &CPISync{Hasher: r.Hasher, Seed: r.Seed}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	roots := [][]byte{}
+	for key := range r.keys() {
+		if p.Evaluate(c.element(key)) == 0 {
+			roots = append(roots, bytes.Clone(key))
+		}
+	}
+	if len(roots) != p.Degree() {
+		return nil, ErrDecodeFailed
+	}
+	return roots, nil
+}
+
+// localCPISync evaluates the characteristic polynomial of the local keys.
+func (r *Reconcile) localCPISync(points int) *CPISync {
+	c := NewCPISync(points, WithHasher(r.Hasher), WithSeed(r.Seed))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key := range r.keys() {
+		c.Add(key)
+	}
+	return c
+}
+
+// cpiPointsForEstimate returns the number of evaluations to request for an
+// estimated difference, allowing for the estimate to be somewhat low.
+func cpiPointsForEstimate(estimate int) int {
+	return estimate + estimate/2 + 2 + cpiCheckPoints
+}
+
+// Degree returns the degree of the polynomial, or -1 for the zero polynomial.
+func (p Polynomial) Degree() int {
+	return len(p) - 1
+}
+
+// Evaluate returns the value of the polynomial at x.
+func (p Polynomial) Evaluate(x uint64) uint64 {
+	value := uint64(0)
+	for i := len(p) - 1; i >= 0; i-- {
+		value = cpiAdd(cpiMul(value, x), p[i])
+	}
+	return value
+}
+
+// trim removes leading zero coefficients.
+func (p Polynomial) trim() Polynomial {
+	for len(p) > 0 && p[len(p)-1] == 0 {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// divide returns the quotient and remainder of dividing by a nonzero
+// polynomial.
+func (p Polynomial) divide(divisor Polynomial) (quotient, remainder Polynomial) {
+	divisor = divisor.trim()
+	remainder = append(Polynomial{}, p...).trim()
+	if len(remainder) < len(divisor) {
+		return Polynomial{}, remainder
+	}
+
+	inverse := cpiInverse(divisor[len(divisor)-1])
+	quotient = make(Polynomial, len(remainder)-len(divisor)+1)
+	for i := len(quotient) - 1; i >= 0; i-- {
+		factor := cpiMul(remainder[i+len(divisor)-1], inverse)
+		quotient[i] = factor
+		for j, coefficient := range divisor {
+			remainder[i+j] = cpiSub(remainder[i+j], cpiMul(factor, coefficient))
+		}
+	}
+	return quotient, remainder.trim()
+}
+
+// gcd returns the monic greatest common divisor of two polynomials, which
+// must not both be zero.
+func (p Polynomial) gcd(q Polynomial) Polynomial {
+	a, b := p.trim(), q.trim()
+	for len(b) > 0 {
+		_, remainder := a.divide(b)
+		a, b = b, remainder
+	}
+
+	inverse := cpiInverse(a[len(a)-1])
+	monic := make(Polynomial, len(a))
+	for i, coefficient := range a {
+		monic[i] = cpiMul(coefficient, inverse)
+	}
+	return monic
+}
+
+// cpiSolve solves the linear system of `n` unknowns, whose rows hold the
+// coefficients followed by the constant, by Gaussian elimination. Unknowns
+// that are not determined are set to zero. It returns false if the system is
+// inconsistent.
+func cpiSolve(system [][]uint64, n int) ([]uint64, bool) {
+	pivots := make([]int, 0, n)
+	row := 0
+	for column := 0; column < n && row < len(system); column++ {
+		pivot := -1
+		for i := row; i < len(system); i++ {
+			if system[i][column] != 0 {
+				pivot = i
+				break
+			}
+		}
+		if pivot < 0 {
+			continue
+		}
+		system[row], system[pivot] = system[pivot], system[row]
+
+		inverse := cpiInverse(system[row][column])
+		for j := column; j <= n; j++ {
+			system[row][j] = cpiMul(system[row][j], inverse)
+		}
+		for i := range system {
+			if i == row || system[i][column] == 0 {
+				continue
+			}
+			factor := system[i][column]
+			for j := column; j <= n; j++ {
+				system[i][j] = cpiSub(system[i][j], cpiMul(factor, system[row][j]))
+			}
+		}
+		pivots = append(pivots, column)
+		row++
+	}
+
+	// The remaining rows must have been reduced to zero
+	for i := row; i < len(system); i++ {
+		if system[i][n] != 0 {
+			return nil, false
+		}
+	}
+	solution := make([]uint64, n)
+	for i, column := range pivots {
+		solution[column] = system[i][n]
+	}
+	return solution, true
+}
+
+// cpiAdd returns a + b in the field.
+func cpiAdd(a, b uint64) uint64 {
+	sum := a + b
+	if sum >= cpiPrime {
+		sum -= cpiPrime
+	}
+	return sum
+}
+
+// cpiSub returns a - b in the field.
+func cpiSub(a, b uint64) uint64 {
+	if a >= b {
+		return a - b
+	}
+	return a + cpiPrime - b
+}
+
+// cpiMul returns a * b in the field. Since 2^61 = 1 modulo the prime, the
+// high bits of the product are folded onto the low bits.
+func cpiMul(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	sum := (lo & cpiPrime) + (lo >> 61) + (hi << 3)
+	sum = (sum & cpiPrime) + (sum >> 61)
+	if sum >= cpiPrime {
+		sum -= cpiPrime
+	}
+	return sum
+}
+
+// cpiPow returns a^e in the field.
+func cpiPow(a, e uint64) uint64 {
+	result := uint64(1)
+	for ; e > 0; e >>= 1 {
+		if e&1 != 0 {
+			result = cpiMul(result, a)
+		}
+		a = cpiMul(a, a)
+	}
+	return result
+}
+
+// cpiInverse returns the multiplicative inverse of a nonzero element by
+// Fermat's little theorem.
+func cpiInverse(a uint64) uint64 {
+	return cpiPow(a, cpiPrime-2)
+}
+
+// appendPolynomial appends the degree of the polynomial plus one as an
+// unsigned varint to `data`, followed by each coefficient in 8 little-endian
+// bytes.
+func appendPolynomial(data []byte, p Polynomial) []byte {
+	data = binary.AppendUvarint(data, uint64(len(p)))
+	for _, coefficient := range p {
+		data = binary.LittleEndian.AppendUint64(data, coefficient)
+	}
+	return data
+}
+
+// readPolynomial reads a polynomial encoded by appendPolynomial.
+func readPolynomial(d *decoder) Polynomial {
+	count := d.length()
+	if count > cpiMaxPoints+1 {
+		d.fail(ErrMalformed)
+		return nil
+	}
+	p := make(Polynomial, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		b := d.bytes(8)
+		if b == nil {
+			break
+		}
+		coefficient := binary.LittleEndian.Uint64(b)
+		if coefficient >= cpiPrime {
+			d.fail(ErrMalformed)
+		}
+		p = append(p, coefficient)
+	}
+	return p
+}
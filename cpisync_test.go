@@ -0,0 +1,186 @@
+package reconcile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCPIField(t *testing.T) {
+	for _, a := range []uint64{1, 2, 12345, cpiPrime - 1, 1 << 60} {
+		if got := cpiMul(a, cpiInverse(a)); got != 1 {
+			t.Errorf("%d times its inverse is %d", a, got)
+		}
+	}
+	if got := cpiMul(cpiPrime-1, cpiPrime-1); got != 1 {
+		t.Errorf("Expected (-1)^2 = 1, got %d", got)
+	}
+	if got := cpiSub(3, 5); got != cpiPrime-2 {
+		t.Errorf("Expected 3 - 5 = -2, got %d", got)
+	}
+
+	// (z - 2)(z - 3) divided by (z - 3) leaves (z - 2)
+	product := Polynomial{6, cpiPrime - 5, 1}
+	quotient, remainder := product.divide(Polynomial{cpiPrime - 3, 1})
+	if !reflect.DeepEqual(quotient, Polynomial{cpiPrime - 2, 1}) || len(remainder) != 0 {
+		t.Errorf("Unexpected quotient %v and remainder %v", quotient, remainder)
+	}
+	if gcd := product.gcd(Polynomial{cpiPrime - 6, 2}); !reflect.DeepEqual(gcd, Polynomial{cpiPrime - 3, 1}) {
+		t.Errorf("Unexpected gcd %v", gcd)
+	}
+}
+
+func TestCPISync(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title            string
+		uniquea, uniqueb int
+		points           int
+	}{
+		{"Identical sets", 0, 0, 3},
+		{"Single key", 1, 0, 3},
+		{"Small difference", 3, 4, 9},
+		{"Exact number of points", 5, 5, 12},
+		{"More points than needed", 2, 1, 40},
+		{"Only remote keys", 0, 8, 10},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, 200, test.uniquea, test.uniqueb)
+		local := NewReconcile(localset, len(remoteset), WithSeed(5))
+		remote := NewReconcile(remoteset, len(localset), WithSeed(5))
+
+		signature, err := remote.GetCPISignature(test.points)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signature) > 16+8*test.points {
+			t.Errorf("For %s test the signature takes %d bytes", test.title, len(signature))
+		}
+		a, polynomial, err := local.GetCPIDifference(signature)
+		if err != nil {
+			t.Errorf("For %s test got %v", test.title, err)
+			continue
+		}
+		b, err := remote.CPIRoots(polynomial)
+		if err != nil {
+			t.Errorf("For %s test the remote roots were not found: %v", test.title, err)
+			continue
+		}
+		if !sameElements(a, localset[200:]) || !sameElements(b, remoteset[200:]) {
+			t.Errorf("For %s test the difference is incorrect", test.title)
+		}
+	}
+
+	// Too few points cannot be decoded
+	localset, remoteset := NewTestSets(keysize, 200, 6, 6)
+	local := NewReconcile(localset, len(remoteset))
+	remote := NewReconcile(remoteset, len(localset))
+	for _, points := range []int{3, 8, 13} {
+		signature, err := remote.GetCPISignature(points)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := local.GetCPIDifference(signature); err != ErrDecodeFailed {
+			t.Errorf("With %d points expected %v, got %v", points, ErrDecodeFailed, err)
+		}
+	}
+
+	// A seed mismatch is detected
+	signature, err := NewReconcile(remoteset, len(localset), WithSeed(9)).GetCPISignature(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := local.GetCPIDifference(signature); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+}
+
+func TestCPISyncUpdate(t *testing.T) {
+	keys := makeRandomElements(20, 16)
+	c := NewCPISync(10, WithSeed(3))
+	for _, key := range keys {
+		c.Add(key)
+	}
+	for _, key := range keys[10:] {
+		c.Remove(key)
+	}
+
+	fresh := NewCPISync(10, WithSeed(3))
+	for _, key := range keys[:10] {
+		fresh.Add(key)
+	}
+	if !reflect.DeepEqual(c, fresh) {
+		t.Error("Removing keys does not restore the evaluations")
+	}
+}
+
+func TestCPISyncSerialization(t *testing.T) {
+	c := NewCPISync(12, WithSeed(77))
+	for _, key := range makeRandomElements(30, 16) {
+		c.Add(key)
+	}
+
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &CPISync{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, decoded) {
+		t.Error("Binary decoded evaluations do not match the original")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+		t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+	}
+
+	data, err = c.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &CPISync{}
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, decoded) {
+		t.Error("JSON decoded evaluations do not match the original")
+	}
+	if err := decoded.UnmarshalJSON([]byte(`{"evaluations":[0],"setsize":1}`)); err != ErrMalformed {
+		t.Errorf("Expected %v for a zero evaluation, got %v", ErrMalformed, err)
+	}
+}
+
+func TestCPISession(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 100, 0, 0},
+		{"Single key", 300, 0, 1},
+		{"Small difference", 300, 4, 3},
+		{"Empty local set", 0, 0, 5},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		initiator := NewSession(nil, Initiator, localset)
+		responder := NewSession(nil, Responder, remoteset)
+		initiator.Keysize = keysize
+
+		local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+		if localErr != nil || remoteErr != nil {
+			t.Errorf("For %s test got errors %v and %v", test.title, localErr, remoteErr)
+			continue
+		}
+		if !sameElements(local.Local, localset[test.match:]) ||
+			!sameElements(local.Remote, remoteset[test.match:]) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remote.Local, remoteset[test.match:]) ||
+			!sameElements(remote.Remote, localset[test.match:]) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Format selects the wire encoding used by a Reconcile when producing and
+// consuming signatures.
+type Format int
+
+const (
+	// FormatBinary is the compact encoding produced by MarshalBinary. It is
+	// the default, and is intended for peers using this package.
+	FormatBinary Format = iota
+
+	// FormatJSON is the encoding produced by MarshalJSON, suitable for
+	// interoperating with ts-reconcile.
+	FormatJSON
+)
+
+// HashScheme identifies the hash function used to place keys in cells. It is
+// recorded in the binary encodings so that peers can detect a mismatch.
+type HashScheme uint8
+
+// HashMurmur3 is the 128-bit x86 murmur3 hash computed by Sum128x32.
+const HashMurmur3 HashScheme = 1
+
+// Errors returned when decoding the binary encodings.
+var (
+	ErrTruncated    = errors.New("Truncated binary data")
+	ErrMagic        = errors.New("Unrecognized binary data")
+	ErrVersion      = errors.New("Unsupported encoding version")
+	ErrHashScheme   = errors.New("Unsupported hash scheme")
+	ErrHashCount    = errors.New("Unsupported hash count")
+	ErrMalformed    = errors.New("Malformed binary data")
+	ErrTrailingData = errors.New("Trailing data after encoding")
+)
+
+// binaryVersion is the version of the binary encodings written by this
+// package.
+const binaryVersion = 1
+
+// flagVariable is set in the flags byte of a binary header when the filters
+// hold variable-length keys.
+const flagVariable = 1 << 0
+
+// flagSeeded is set in the flags byte of a binary header when the hash seed is
+// not zero, in which case the seed follows the header.
+const flagSeeded = 1 << 1
+
+// maxBinaryLength bounds the lengths read from a binary header. Decoders also
+// check with decoder.remaining that the input holds every declared cell before
+// allocating them, so that a corrupt or hostile header cannot cause an
+// allocation much larger than the input.
+const maxBinaryLength = 1 << 28
+
+// decoder reads the primitives used by the binary encodings. The first error
+// encountered is kept and all further reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.fail(ErrTruncated)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// length reads an unsigned varint and checks that it is a sensible length.
+func (d *decoder) length() int {
+	v := d.uvarint()
+	if v > maxBinaryLength {
+		d.fail(ErrMalformed)
+		return 0
+	}
+	return int(v)
+}
+
+// remaining checks that the input holds at least `count` items of at least
+// `size` bytes each.
+func (d *decoder) remaining(count, size int) bool {
+	if d.err == nil && count > len(d.data)/size {
+		d.fail(ErrTruncated)
+	}
+	return d.err == nil
+}
+
+// header checks the magic bytes and version at the start of an encoding.
+func (d *decoder) header(magic string) {
+	if string(d.bytes(len(magic))) != magic {
+		d.fail(ErrMagic)
+		return
+	}
+	if d.byte() != binaryVersion {
+		d.fail(ErrVersion)
+	}
+}
+
+// hasher reads a hash scheme and returns its Hasher.
+func (d *decoder) hasher() Hasher {
+	if d.err != nil {
+		return nil
+	}
+	h, err := LookupHasher(HashScheme(d.byte()))
+	if err != nil {
+		d.fail(err)
+	}
+	return h
+}
+
+// finish returns the first error encountered, or ErrTrailingData if there is
+// input left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		return ErrTrailingData
+	}
+	return d.err
+}
@@ -0,0 +1,177 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+)
+
+// grapheneFailure is the accepted probability that the IBF of a Graphene
+// signature is too small for the false positives of its Bloom filter.
+const grapheneFailure = 1.0 / 240
+
+// grapheneMagic begins the binary encoding of a Graphene signature.
+const grapheneMagic = "GR"
+
+// GrapheneSerialization is the JSON encoding of a Graphene signature.
+type GrapheneSerialization struct {
+	Bloom *BloomFilter `json:"bloom"`
+	IBF   *IBF         `json:"ibf"`
+}
+
+// GrapheneParameters chooses the false positive rate of the Bloom filter and
+// the size of the IBF of a Graphene signature, for a sender of `setsize` keys
+// and a receiver of `remotesetsize` keys, most of which are not the sender's.
+// A lower false positive rate makes the filter larger but lets fewer of the
+// receiver's extra keys through, so fewer IBF cells of `cellsize` bytes are
+// needed to decode them. Every expected number of false positives is tried,
+// and the one with the smallest total size chosen.
+//
+// The IBF is sized for a bound that the false positives exceed with
+// probability at most 1/240, by a Chernoff bound.
+//
+// A. P. Ozisik, G. Andresen, B. N. Levine, D. Tapp, G. Bissias, and S.
+// Katkuri. Graphene: Efficient interactive set reconciliation applied to
+// blockchain propagation. In Proceedings of the ACM Special Interest Group on
+// Data Communication (SIGCOMM '19), pages 303–317, 2019.
+func GrapheneParameters(setsize, remotesetsize, cellsize int) (fpr float64, cells int) {
+	extra := max(remotesetsize-setsize, 1)
+	best := math.Inf(1)
+	for expected := 1; expected <= extra; expected++ {
+		rate := float64(expected) / float64(extra)
+		size, _ := bloomParameters(setsize, rate)
+		ibfcells := cellsForEstimate(grapheneBound(expected))
+		total := float64(size)/8 + float64(ibfcells*cellsize)
+		if total < best {
+			best, fpr, cells = total, rate, ibfcells
+		}
+	}
+	return fpr, cells
+}
+
+// grapheneBound returns a bound on the number of false positives when
+// `expected` are expected, exceeded with probability at most grapheneFailure.
+func grapheneBound(expected int) int {
+	a := float64(expected)
+	return int(math.Ceil(a + math.Sqrt(3*a*math.Log(1/grapheneFailure))))
+}
+
+// GetGrapheneSignature encodes a Bloom filter and an IBF of the local keys, from
+// which a receiver of `remotesetsize` keys, holding most of the local keys,
+// recovers the difference with GetGrapheneDifference. The filter and IBF are
+// sized by GrapheneParameters. This needs no estimator, and is far smaller
+// than an IBF sized for the whole difference when the receiver holds nearly a
+// superset of the local keys.
+//
+// In the JSON format it is documented by the GrapheneSerialization type. The
+// binary format holds the magic bytes "GR" and a version byte, followed by the
+// binary encodings of the filter and the IBF, each prefixed by its length as
+// an unsigned varint.
+func (r *Reconcile) GetGrapheneSignature(remotesetsize int) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	setsize := len(r.Keyset)
+	if r.Source != nil {
+		setsize = 0
+		for range r.Source {
+			setsize++
+		}
+	}
+
+	cellsize := 4 + 2 + r.Keysize
+	if r.Variable {
+		cellsize += 2
+	}
+	fpr, cells := GrapheneParameters(setsize, remotesetsize, cellsize)
+	bloom := NewBloomFilterRate(setsize, fpr, WithHasher(r.Hasher), WithSeed(r.Seed))
+	ibf := r.newIBF(cells)
+	for key := range r.keys() {
+		bloom.Add(key)
+		ibf.Add(key)
+	}
+
+	if r.Format == FormatJSON {
+		return json.Marshal(&GrapheneSerialization{bloom, ibf})
+	}
+	encodedBloom, err := bloom.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	encodedIBF, err := ibf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(grapheneMagic), binaryVersion)
+	return appendKeys(data, [][]byte{encodedBloom, encodedIBF}), nil
+}
+
+// GetGrapheneDifference decodes the difference from a remote Graphene
+// signature. The local keys that pass the remote Bloom filter are placed in an
+// IBF, from which the remote IBF is subtracted to find the false positives and
+// any remote keys missing locally. The local keys failing the filter are only
+// present locally.
+//
+// The first result holds the keys only present locally, and the second holds
+// the keys only present remotely. It returns false if the IBF does not decode.
+// The IBF is only sized for the false positives, so this may happen if remote
+// keys are missing locally, and the caller may then fall back to Difference.
+func (r *Reconcile) GetGrapheneDifference(remotesignature []byte) (a [][]byte, b [][]byte, ok bool) {
+	bloom, remote, err := r.unmarshalGraphene(remotesignature)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	ibf := r.newIBF(remote.Size)
+	r.mu.RLock()
+	for key := range r.keys() {
+		if bloom.Contains(key) {
+			ibf.Add(key)
+		} else {
+			a = append(a, bytes.Clone(key))
+		}
+	}
+	r.mu.RUnlock()
+
+	if err := ibf.Subtract(remote); err != nil {
+		return nil, nil, false
+	}
+	positives, b, ok := ibf.Decode()
+	if !ok {
+		return nil, nil, false
+	}
+	return append(a, positives...), b, true
+}
+
+// unmarshalGraphene decodes the filter and IBF of a Graphene signature in the
+// configured format.
+func (r *Reconcile) unmarshalGraphene(data []byte) (*BloomFilter, *IBF, error) {
+	if r.Format == FormatJSON {
+		serialization := &GrapheneSerialization{}
+		if err := json.Unmarshal(data, serialization); err != nil {
+			return nil, nil, err
+		}
+		if serialization.Bloom == nil || serialization.IBF == nil {
+			return nil, nil, ErrMalformed
+		}
+		return serialization.Bloom, serialization.IBF, nil
+	}
+
+	d := &decoder{data: data}
+	d.header(grapheneMagic)
+	parts := readKeys(d)
+	if err := d.finish(); err != nil {
+		return nil, nil, err
+	}
+	if len(parts) != 2 {
+		return nil, nil, ErrMalformed
+	}
+	bloom, ibf := &BloomFilter{}, &IBF{}
+	if err := bloom.UnmarshalBinary(parts[0]); err != nil {
+		return nil, nil, err
+	}
+	if err := ibf.UnmarshalBinary(parts[1]); err != nil {
+		return nil, nil, err
+	}
+	return bloom, ibf, nil
+}
@@ -0,0 +1,82 @@
+package reconcile
+
+import (
+	"testing"
+)
+
+func TestGrapheneParameters(t *testing.T) {
+	// Many extra keys favour a low false positive rate
+	fpr, cells := GrapheneParameters(2000, 100000, 38)
+	if fpr >= 0.01 || cells < 4 {
+		t.Errorf("Unexpected parameters %f and %d", fpr, cells)
+	}
+
+	// Few extra keys are cheaper to decode than to filter
+	fpr, _ = GrapheneParameters(100000, 100002, 38)
+	if fpr != 1 {
+		t.Errorf("Expected a high false positive rate, got %f", fpr)
+	}
+}
+
+func TestGraphene(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title          string
+		missing, extra int
+		failures       int
+	}{
+		{"Identical sets", 0, 0, 0},
+		{"Superset", 0, 8000, 2},
+		{"Nearly a superset", 2, 3000, 6},
+	}
+
+	// The IBF is sized for the false positives to fail with probability
+	// 1/240, and keys missing from the receiver are not allowed for, so
+	// decoding is checked over many seeds, falling back to Difference
+	trials := 20
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		for _, test := range tests {
+			failures := 0
+			for trial := 0; trial < trials; trial++ {
+				seed := WithSeed(uint32(trial + 1))
+				senderset, receiverset := NewTestSets(keysize, 2000, test.missing, test.extra)
+				sender := NewReconcile(senderset, len(receiverset), seed)
+				receiver := NewReconcile(receiverset, len(senderset), seed)
+				sender.Format = format
+				receiver.Format = format
+
+				signature, err := sender.GetGrapheneSignature(len(receiverset))
+				if err != nil {
+					t.Fatal(err)
+				}
+				a, b, ok := receiver.GetGrapheneDifference(signature)
+				if !ok {
+					failures++
+					a, b, err = receiver.Difference(cellsForEstimate(test.extra+test.missing), sender.Signature)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !sameElements(a, receiverset[2000:]) || !sameElements(b, senderset[2000:]) {
+					t.Errorf("For %s test in format %d the difference is incorrect", test.title, format)
+				}
+
+				// Far smaller than an IBF for the whole difference
+				if format == FormatBinary && test.extra > 0 && trial == 0 {
+					ibf, err := receiver.GetIBFSignature(cellsForEstimate(test.extra))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(signature) >= len(ibf)/4 {
+						t.Errorf("For %s test the signature of %d bytes is not much smaller than an IBF of %d",
+							test.title, len(signature), len(ibf))
+					}
+				}
+			}
+			if failures > test.failures {
+				t.Errorf("For %s test in format %d the signature did not decode for %d of %d seeds",
+					test.title, format, failures, trials)
+			}
+		}
+	}
+}
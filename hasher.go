@@ -0,0 +1,129 @@
+package reconcile
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrHasherMismatch occurs when combining or comparing structures built with
+// different hash functions.
+var ErrHasherMismatch = errors.New("Mismatched hash functions")
+
+// ErrSeedMismatch occurs when combining or comparing structures built with
+// different hash seeds.
+var ErrSeedMismatch = errors.New("Mismatched hash seeds")
+
+// Hasher is a 128-bit hash function used to place keys in cells, to compute
+// the checksums of cells, and to compute MinHash signatures. Every peer must use
+// the same Hasher, which is identified on the wire by its scheme.
+//
+// Implementations other than the default must be registered with
+// RegisterHasher so that they can be found when decoding.
+type Hasher interface {
+	// Scheme returns the identifier recorded in serialized structures.
+	Scheme() HashScheme
+
+	// Sum128 returns the hash of `key` with the given `seed` as four 32-bit
+	// words.
+	Sum128(key []byte, seed uint32) [4]uint32
+}
+
+// Murmur3 is the default Hasher, computing Sum128x32.
+type Murmur3 struct{}
+
+// Scheme returns HashMurmur3.
+func (Murmur3) Scheme() HashScheme {
+	return HashMurmur3
+}
+
+// Sum128 returns Sum128x32(key, seed).
+func (Murmur3) Sum128(key []byte, seed uint32) [4]uint32 {
+	return Sum128x32(key, seed)
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[HashScheme]Hasher{HashMurmur3: Murmur3{}}
+)
+
+// RegisterHasher makes a Hasher available for decoding structures that record
+// its scheme. It panics if the scheme is zero or already registered.
+func RegisterHasher(h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	scheme := h.Scheme()
+	if scheme == 0 {
+		panic("reconcile: RegisterHasher with zero scheme")
+	}
+	if _, ok := hashers[scheme]; ok {
+		panic(fmt.Sprintf("reconcile: RegisterHasher called twice for scheme %d", scheme))
+	}
+	hashers[scheme] = h
+}
+
+// LookupHasher returns the registered Hasher for a scheme. The zero scheme is
+// taken to mean the default, for encodings that do not record one. It returns
+// ErrHashScheme if the scheme is unknown.
+func LookupHasher(scheme HashScheme) (Hasher, error) {
+	if scheme == 0 {
+		return Murmur3{}, nil
+	}
+
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+
+	h, ok := hashers[scheme]
+	if !ok {
+		return nil, ErrHashScheme
+	}
+	return h, nil
+}
+
+// defaultHasher returns `h`, or the default Hasher if it is nil.
+func defaultHasher(h Hasher) Hasher {
+	if h == nil {
+		return Murmur3{}
+	}
+	return h
+}
+
+// Option configures the structures of this package when they are created.
+type Option func(*options)
+
+// options holds the configuration applied by Option values.
+type options struct {
+	hasher Hasher
+	seed   uint32
+	hybrid bool
+	sketch bool
+}
+
+// WithHasher selects the hash function to use instead of Murmur3.
+func WithHasher(h Hasher) Option {
+	return func(o *options) {
+		o.hasher = h
+	}
+}
+
+// WithSeed selects the seed of the hash function, which is zero by default.
+//
+// An adversary who knows the keys and the seed can craft keys that collide in
+// the same cells, so that decoding always fails. Using a seed that is secret
+// or freshly chosen for each exchange prevents this.
+func WithSeed(seed uint32) Option {
+	return func(o *options) {
+		o.seed = seed
+	}
+}
+
+// applyOptions returns the configuration resulting from `opts`.
+func applyOptions(opts []Option) options {
+	o := options{hasher: Murmur3{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.hasher = defaultHasher(o.hasher)
+	return o
+}
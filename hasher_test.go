@@ -0,0 +1,98 @@
+package reconcile
+
+import (
+	"hash/fnv"
+	"testing"
+)
+
+// fnvHasher is a Hasher built on 32-bit FNV-1a for testing.
+type fnvHasher struct{}
+
+const testFNVScheme HashScheme = 200
+
+func (fnvHasher) Scheme() HashScheme {
+	return testFNVScheme
+}
+
+func (fnvHasher) Sum128(key []byte, seed uint32) [4]uint32 {
+	var sum [4]uint32
+	for i := range sum {
+		h := fnv.New32a()
+		h.Write([]byte{byte(i), byte(seed), byte(seed >> 8), byte(seed >> 16), byte(seed >> 24)})
+		h.Write(key)
+		sum[i] = h.Sum32()
+	}
+	return sum
+}
+
+func init() {
+	RegisterHasher(fnvHasher{})
+}
+
+func TestHasher(t *testing.T) {
+	keysize := 32
+	localset, remoteset := NewTestSets(keysize, 100, 6, 9)
+
+	local := NewReconcile(localset, len(remoteset), WithHasher(fnvHasher{}))
+	remote := NewReconcile(remoteset, len(localset), WithHasher(fnvHasher{}))
+	a, b, err := local.Difference(30, remote.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, localset[100:]) || !sameElements(b, remoteset[100:]) {
+		t.Error("Difference is incorrect")
+	}
+
+	// The hash function is recorded in each encoding
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		remote.Format = format
+		signature, err := remote.GetIBFSignature(30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &IBF{}
+		if format == FormatJSON {
+			err = decoded.UnmarshalJSON(signature)
+		} else {
+			err = decoded.UnmarshalBinary(signature)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Hasher.Scheme() != testFNVScheme {
+			t.Errorf("Expected scheme %d, got %d", testFNVScheme, decoded.Hasher.Scheme())
+		}
+		if err := NewIBF(30, keysize).Subtract(decoded); err != ErrHasherMismatch {
+			t.Errorf("Expected %v, got %v", ErrHasherMismatch, err)
+		}
+	}
+
+	remote.Format = FormatBinary
+	estimator, err := remote.GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReconcile(localset, len(remoteset)).EstimateDifferenceSize(estimator); err != ErrHasherMismatch {
+		t.Errorf("Expected %v, got %v", ErrHasherMismatch, err)
+	}
+
+	mh := NewMinHash(10, WithHasher(fnvHasher{}))
+	if _, err := mh.Estimate(NewMinHash(10)); err != ErrHasherMismatch {
+		t.Errorf("Expected %v, got %v", ErrHasherMismatch, err)
+	}
+}
+
+func TestLookupHasher(t *testing.T) {
+	if _, err := LookupHasher(250); err != ErrHashScheme {
+		t.Errorf("Expected %v, got %v", ErrHashScheme, err)
+	}
+
+	data, err := NewIBF(4, 8).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[3] = 250
+	if err := (&IBF{}).UnmarshalBinary(data); err != ErrHashScheme {
+		t.Errorf("Expected %v, got %v", ErrHashScheme, err)
+	}
+}
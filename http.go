@@ -0,0 +1,267 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SizeSerialization is returned by the size endpoint of a Handler.
+type SizeSerialization struct {
+	Size    int `json:"size"`
+	Keysize int `json:"keysize"`
+}
+
+// Handler serves the reconciliation exchange for a key set over HTTP, using
+// the JSON formats understood by ts-reconcile. It answers GET requests at the
+// following paths, relative to where it is mounted:
+//
+// - "/size" returns a SizeSerialization describing the key set.
+// - "/estimator?setsize=N" returns the strata estimator as a
+// DifferenceSerialization, where N is the size of the client's set.
+// - "/ibf?size=S" returns an IBFSerialization of S cells, or a
+// KeysetSerialization when S is -1 (FullSet).
+//
+// The estimator and ibf endpoints also accept a "keysize" parameter, which is
+// used when the served key set is empty and may be at most maxQueryKeysize.
+// IBFs are served with at most 4 cells per key plus 64, since the full set is
+// smaller than any larger one. The sketches of a non-empty set are cached
+// until the set is replaced.
+type Handler struct {
+	mu  sync.RWMutex
+	set *handlerSet
+}
+
+// handlerSet is the key set served by a Handler, with its cached sketches.
+type handlerSet struct {
+	keys      [][]byte
+	keysize   int
+	reconcile *Reconcile // Builds the signatures, caching recent IBFs
+
+	mu         sync.Mutex
+	estimators map[int][]byte // Encoded estimators by depth
+}
+
+// maxQueryKeysize bounds the keysize parameter of a Handler, so that the
+// largest strata estimator, of 80 cells per level and 64 levels, stays within
+// maxBinaryLength.
+const maxQueryKeysize = maxBinaryLength / (80 * 64)
+
+// maxHandlerCells returns the largest IBF size a Handler serves for a set of
+// `setsize` keys.
+func maxHandlerCells(setsize int) int {
+	return 4*setsize + 64
+}
+
+// NewHandler creates a handler serving the given keys.
+func NewHandler(keys [][]byte) *Handler {
+	h := &Handler{}
+	h.Register(keys)
+	return h
+}
+
+// Register replaces the key set served by the handler.
+func (h *Handler) Register(keys [][]byte) {
+	keysize := 0
+	if len(keys) > 0 {
+		keysize = len(keys[0])
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.set = newHandlerSet(keys, keysize)
+}
+
+// newHandlerSet creates a served key set with empty caches.
+func newHandlerSet(keys [][]byte, keysize int) *handlerSet {
+	return &handlerSet{
+		keys:       keys,
+		keysize:    keysize,
+		reconcile:  &Reconcile{Keyset: keys, Keysize: keysize, Format: FormatJSON},
+		estimators: map[int][]byte{},
+	}
+}
+
+// estimator returns the encoded estimator for a client with `setsize` keys.
+// Estimators of the same depth are identical, so they are built once.
+func (s *handlerSet) estimator(setsize int) ([]byte, error) {
+	depth := estimatorDepth(len(s.keys), setsize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.estimators[depth]; ok {
+		return data, nil
+	}
+
+	r := newReconcile(s.keys, s.keysize, setsize, false, nil)
+	r.Format = FormatJSON
+	data, err := r.GetDifferenceSizeEstimator()
+	if err != nil {
+		return nil, err
+	}
+	s.estimators[depth] = data
+	return data, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.RLock()
+	set := h.set
+	h.mu.RUnlock()
+	if set == nil {
+		set = newHandlerSet(nil, 0)
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "size" {
+		data, _ := json.Marshal(&SizeSerialization{len(set.keys), set.keysize})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	// An empty set is cheap to sketch, so it is not cached for each keysize
+	if set.keysize == 0 {
+		keysize, _ := strconv.Atoi(req.URL.Query().Get("keysize"))
+		if keysize < 1 {
+			keysize = 1
+		}
+		if keysize > maxQueryKeysize {
+			http.Error(w, "Invalid keysize parameter", http.StatusBadRequest)
+			return
+		}
+		set = newHandlerSet(set.keys, keysize)
+	}
+
+	var data []byte
+	var err error
+	switch path {
+	case "estimator":
+		setsize, perr := strconv.Atoi(req.URL.Query().Get("setsize"))
+		if perr != nil || setsize < 0 {
+			http.Error(w, "Invalid setsize parameter", http.StatusBadRequest)
+			return
+		}
+		data, err = set.estimator(setsize)
+
+	case "ibf":
+		size, perr := strconv.Atoi(req.URL.Query().Get("size"))
+		if perr != nil || (size < 1 && size != FullSet) || size > maxHandlerCells(len(set.keys)) {
+			http.Error(w, "Invalid size parameter", http.StatusBadRequest)
+			return
+		}
+		data, err = set.reconcile.Signature(size)
+
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Client reconciles a local key set with one served by a Handler.
+type Client struct {
+	URL   string       // Location the Handler is mounted at
+	HTTP  *http.Client // Client used for requests; http.DefaultClient if nil
+	Retry RetryPolicy
+}
+
+// NewClient creates a client for the Handler mounted at `url`.
+func NewClient(url string) *Client {
+	return &Client{strings.TrimSuffix(url, "/"), nil, DefaultRetryPolicy}
+}
+
+// Reconcile performs the exchange with the server and returns the difference
+// between the local and served key sets.
+func (c *Client) Reconcile(keys [][]byte) (*Result, error) {
+	data, err := c.get("size", nil)
+	if err != nil {
+		return nil, err
+	}
+	size := &SizeSerialization{}
+	if err := json.Unmarshal(data, size); err != nil {
+		return nil, err
+	}
+
+	keysize := size.Keysize
+	if len(keys) > 0 {
+		if keysize != 0 && keysize != len(keys[0]) {
+			return nil, ErrKeysize
+		}
+		keysize = len(keys[0])
+	}
+	if size.Size == 0 && len(keys) == 0 {
+		return &Result{}, nil
+	}
+
+	r := newReconcile(keys, keysize, size.Size, false, nil)
+	r.Format = FormatJSON
+	r.Retry = c.Retry
+
+	estimator, err := c.get("estimator", url.Values{
+		"setsize": {strconv.Itoa(len(keys))},
+		"keysize": {strconv.Itoa(keysize)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	estimate, err := r.EstimateDifferenceSize(estimator)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handler serves no IBF larger than maxHandlerCells, beyond which the
+	// full set is smaller
+	limit := maxHandlerCells(size.Size)
+	if r.Retry.MaxSize == 0 || r.Retry.MaxSize > limit {
+		r.Retry.MaxSize = limit
+	}
+	local, remote, err := r.Difference(min(cellsForEstimate(estimate), limit), func(size int) ([]byte, error) {
+		return c.get("ibf", url.Values{
+			"size":    {strconv.Itoa(size)},
+			"keysize": {strconv.Itoa(keysize)},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{local, remote}, nil
+}
+
+// get requests an endpoint of the handler and returns the response body.
+func (c *Client) get(endpoint string, query url.Values) ([]byte, error) {
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	location := c.URL + "/" + endpoint
+	if query != nil {
+		location += "?" + query.Encode()
+	}
+
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request to %s failed: %s", location, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageLength))
+}
@@ -0,0 +1,103 @@
+package reconcile
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Small difference", 200, 4, 7},
+		{"Large difference", 50, 100, 80},
+		{"Empty local set", 0, 0, 20},
+		{"Empty remote set", 0, 20, 0},
+		{"Small remote set", 10, 2000, 2},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		server := httptest.NewServer(NewHandler(remoteset))
+
+		result, err := NewClient(server.URL).Reconcile(localset)
+		server.Close()
+		if err != nil {
+			t.Errorf("For %s test got %v", test.title, err)
+			continue
+		}
+		if !sameElements(result.Local, localset[test.match:]) ||
+			!sameElements(result.Remote, remoteset[test.match:]) {
+			t.Errorf("For %s test the difference is incorrect", test.title)
+		}
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	handler := NewHandler(makeRandomElements(100, 32))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Clients of sets needing the same depth share an estimator, and the
+	// IBFs of recent sizes are kept
+	for _, path := range []string{"/estimator?setsize=90", "/estimator?setsize=120", "/ibf?size=40", "/ibf?size=40"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(handler.set.estimators) != 1 {
+		t.Errorf("Expected 1 cached estimator, got %d", len(handler.set.estimators))
+	}
+	if _, ok := handler.set.reconcile.cache[40]; !ok {
+		t.Error("The IBF was not cached")
+	}
+
+	handler.Register(makeRandomElements(10, 32))
+	if len(handler.set.estimators) != 0 || handler.set.reconcile.cache != nil {
+		t.Error("The cached sketches were kept after registering new keys")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	server := httptest.NewServer(NewHandler(makeRandomElements(10, 32)))
+	defer server.Close()
+
+	// IBFs of more than 4 cells per key plus 64 are refused
+	for _, path := range []string{"/ibf?size=0", "/ibf?size=105", "/estimator?setsize=x", "/missing"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Request to %s succeeded", path)
+		}
+	}
+
+	if resp, err := http.Get(server.URL + "/ibf?size=104"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Request for the largest IBF failed with %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if _, err := NewClient(server.URL).Reconcile(makeRandomElements(10, 16)); err != ErrKeysize {
+		t.Errorf("Expected %v, got %v", ErrKeysize, err)
+	}
+
+	// An empty set takes the keysize from the request, which is bounded
+	empty := httptest.NewServer(NewHandler(nil))
+	defer empty.Close()
+	resp, err := http.Get(empty.URL + "/estimator?setsize=1000000000&keysize=1000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
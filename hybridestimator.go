@@ -1,68 +1,380 @@
 package reconcile
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"iter"
 	"math"
+	"slices"
 )
 
+// hybridMinHashLevels is the number of low levels of a HybridEstimator that
+// also have MinHash signatures.
+const hybridMinHashLevels = 2
+
+// hybridCellsize is the size of the IBF of each high level of a
+// HybridEstimator.
+const hybridCellsize = 80
+
+// hybridHashCount is the signature size of the MinHash of each low level of a
+// HybridEstimator.
+const hybridHashCount = 400
+
+// HybridEstimator combines the Strata and MinHash estimators for the size of
+// the difference, as described by Eppstein et al. Keys are split into levels
+// by their trailing zeroes like in a Strata, and every level is an IBF, which
+// counts small differences exactly. The two dense low levels, which hold three
+// quarters of the keys, also have MinHash signatures, which estimate their
+// differences more accurately than a scaled strata count when their IBFs fail
+// to decode.
 type HybridEstimator struct {
-	Depth      int
-	Keysize    int
-	IBFset     []*IBF
-	MinHashset []*MinHash
+	Depth      int        // Number of levels
+	Keysize    int        // Bytes
+	Cellsize   int        // IBF size of each high level
+	Hashcount  int        // MinHash signature size of each low level
+	IBFset     []*IBF     // Every level
+	MinHashset []*MinHash // Levels 0 and 1, or fewer if Depth is smaller
+	Hasher     Hasher     // Hash function of every level; Murmur3 if nil
+	Seed       uint32     // Seed of the hash function
+}
+
+// HybridSerialization is the JSON encoding of a HybridEstimator. The MinHash
+// signatures hold the low levels in order, and the IBFs every level.
+type HybridSerialization struct {
+	Cellsize  int                    `json:"cellsize"`
+	Keysize   int                    `json:"keysize"`
+	Depth     int                    `json:"depth"`
+	Hashcount int                    `json:"hashcount"`
+	Hash      HashScheme             `json:"hash"`
+	MinHashes []MinHashSerialization `json:"minhashes"`
+	Levels    []IBFSerialization     `json:"levels"`
+	Seed      uint32                 `json:"seed,omitempty"`
 }
 
-//Combines the Strata and MinHash Estimators for size of difference
+// hybridMagic begins the binary encoding of a HybridEstimator.
+const hybridMagic = "HY"
 
+// WithHybridEstimator makes a Reconcile estimate the size of the difference
+// with a HybridEstimator instead of a Strata. Both peers must use it. It is
+// ignored for variable-length keys, which the HybridEstimator does not support.
+func WithHybridEstimator() Option {
+	return func(o *options) {
+		o.hybrid = true
+	}
+}
+
+// NewHybridEstimator creates an estimator for the keys, with a depth suitable
+// for their number. Peers whose sets differ in size should agree on a depth and
+// use NewHybridEstimatorDepth instead. An empty key set gives an estimator with
+// a keysize of zero, which is only compatible with other empty ones.
 func NewHybridEstimator(keys [][]byte) *HybridEstimator {
-	depth := int(math.Ceil(math.Log2(float64(len(keys)))))
-	IBFset := make([]*IBF, depth-2)
-	MinHashPair := make([]*MinHash, 2)
-	return &HybridEstimator{depth, len(keys[0]), IBFset, MinHashPair}
+	keysize := 0
+	if len(keys) > 0 {
+		keysize = len(keys[0])
+	}
+	depth := int(math.Ceil(math.Log2(float64(max(len(keys), 1)))))
+	return NewHybridEstimatorDepth(keysize, depth)
 }
 
-func (h *HybridEstimator) BuildSignature(keys [][]byte) {
-	//Split up the keys by trailing zeroes
-	//If 0 or 1 then use min hash
-	for d := 0; d < h.Depth; d++ {
-		if d > 1 {
-			h.IBFset[d-2] = NewIBF(80, h.Keysize)
-		}
+// NewHybridEstimatorDepth creates an estimator with `depth` levels for keys of
+// `keysize` bytes. The hash function and its seed may be selected with the
+// WithHasher and WithSeed options; as with NewStrata, keys are assigned to
+// levels by their hash when a seed is given.
+func NewHybridEstimatorDepth(keysize, depth int, opts ...Option) *HybridEstimator {
+	return newHybridEstimator(hybridCellsize, hybridHashCount, keysize, depth, opts)
+}
+
+// newHybridEstimator creates an estimator whose levels have the given sizes.
+func newHybridEstimator(cellsize, hashcount, keysize, depth int, opts []Option) *HybridEstimator {
+	if depth < 1 {
+		depth = 1
+	}
+	minhashes := depth
+	if minhashes > hybridMinHashLevels {
+		minhashes = hybridMinHashLevels
+	}
+
+	o := applyOptions(opts)
+	h := &HybridEstimator{
+		depth,
+		keysize,
+		cellsize,
+		hashcount,
+		make([]*IBF, depth),
+		make([]*MinHash, minhashes),
+		o.hasher,
+		o.seed,
+	}
+	h.reset()
+	return h
+}
+
+// reset replaces every level with an empty one.
+func (h *HybridEstimator) reset() {
+	opts := []Option{WithHasher(h.Hasher), WithSeed(h.Seed)}
+	for level := range h.MinHashset {
+		h.MinHashset[level] = NewMinHash(h.Hashcount, opts...)
+	}
+	for level := range h.IBFset {
+		h.IBFset[level] = NewIBF(h.Cellsize, h.Keysize, opts...)
 	}
+}
 
-	h.MinHashset[0] = NewMinHash(100)
-	h.MinHashset[1] = NewMinHash(100)
+// BuildSignature replaces the contents of the estimator with the keys.
+func (h *HybridEstimator) BuildSignature(keys [][]byte) {
+	h.BuildSignatureSource(slices.Values(keys))
+}
+
+// BuildSignatureSource replaces the contents of the estimator with the keys
+// yielded by `keys`, which are not retained.
+func (h *HybridEstimator) BuildSignatureSource(keys iter.Seq[[]byte]) {
+	h.reset()
 
 	//assign elements by trailing zeroes
-	for _, key := range keys {
-		tz := TrailingZeroes(key[:3], uint(h.Depth-1))
-		if tz > 1 {
-			h.IBFset[tz-2].Add(key)
-		} else {
-			h.MinHashset[tz].Add(key)
+	for key := range keys {
+		level := int(strataLevel(key, h.Depth, h.Hasher, h.Seed, h.Seed != 0))
+		h.IBFset[level].Add(key)
+		if level < hybridMinHashLevels {
+			h.MinHashset[level].Add(key)
 		}
 	}
+}
 
+// Compatible returns ErrStrataMismatch if the remote estimator was built with
+// different parameters, or ErrHasherMismatch or ErrSeedMismatch if it was built
+// with a different hash function or seed, in which case the two cannot be
+// compared.
+func (h *HybridEstimator) Compatible(remote *HybridEstimator) error {
+	if defaultHasher(h.Hasher).Scheme() != defaultHasher(remote.Hasher).Scheme() {
+		return ErrHasherMismatch
+	}
+	if h.Seed != remote.Seed {
+		return ErrSeedMismatch
+	}
+	if h.Depth != remote.Depth || h.Keysize != remote.Keysize ||
+		h.Cellsize != remote.Cellsize || h.Hashcount != remote.Hashcount ||
+		len(h.IBFset) != len(remote.IBFset) ||
+		len(h.MinHashset) != len(remote.MinHashset) {
+		return ErrStrataMismatch
+	}
+	return nil
 }
 
+// EstimateSizeDifference estimates the size of the difference with the remote
+// set. The IBF levels are decoded from the highest down, as by Strata.Estimate,
+// so that small differences are counted exactly. If the IBF of a high level
+// fails, the count so far is scaled up, and if that of a low level fails, the
+// MinHash estimates of it and the levels below are added to the count instead.
+//
+// The estimators must be compatible, as checked by Compatible. Neither is
+// changed by the estimate.
 func (h *HybridEstimator) EstimateSizeDifference(remote *HybridEstimator) int {
 	count := 0
 
-	for level := h.Depth - 1; level >= -1; level-- {
-		if level < 0 {
-			return count
-		} else if level < 2 { //MinHash
-			//mh := h.MinHashset[level]
-			//fmt.Println(mh.Difference(remote.MinHashset[level]))
-		} else { //IBF Strata
-			ibf := h.IBFset[level]
-			remotelevel := remote.IBFset[level]
-			ibf.Subtract(remotelevel)
-			a, b, ok := ibf.Decode()
-			if !ok {
-				return (2 << uint(level)) * count
-			}
+	for level := h.Depth - 1; level >= 0; level-- {
+		ibf, err := Difference(h.IBFset[level], remote.IBFset[level])
+		if err != nil {
+			return 0
+		}
+		if a, b, ok := ibf.Decode(); ok {
 			count += len(b) + len(a)
+			continue
 		}
+		if level >= len(h.MinHashset) {
+			return (2 << uint(level)) * count
+		}
+
+		for ; level >= 0; level-- {
+			estimate, err := h.MinHashset[level].Estimate(remote.MinHashset[level])
+			if err != nil {
+				return 0
+			}
+			count += estimate
+		}
+	}
+	return count
+}
+
+// scheme returns the identifier of the hash function of the estimator.
+func (h *HybridEstimator) scheme() HashScheme {
+	return defaultHasher(h.Hasher).Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (h *HybridEstimator) flags() (flags byte) {
+	if h.Seed != 0 {
+		flags |= flagSeeded
 	}
-	return 0
+	return flags
+}
+
+// MarshalJSON encodes the estimator in the format documented by the
+// HybridSerialization type.
+func (h *HybridEstimator) MarshalJSON() ([]byte, error) {
+	minhashes := make([]MinHashSerialization, len(h.MinHashset))
+	for level, mh := range h.MinHashset {
+		minhashes[level] = mh.getMinHash()
+	}
+	levels := make([]IBFSerialization, len(h.IBFset))
+	for level, ibf := range h.IBFset {
+		levels[level] = ibf.GetIBF()
+	}
+	return json.Marshal(&HybridSerialization{
+		h.Cellsize,
+		h.Keysize,
+		h.Depth,
+		h.Hashcount,
+		h.scheme(),
+		minhashes,
+		levels,
+		h.Seed,
+	})
+}
+
+// UnmarshalJSON decodes the estimator from the format documented by the
+// HybridSerialization type, checking that every level agrees with the
+// parameters.
+func (h *HybridEstimator) UnmarshalJSON(data []byte) error {
+	serialization := &HybridSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	if !validHybrid(serialization.Cellsize, serialization.Keysize, serialization.Depth, serialization.Hashcount) {
+		return ErrMalformed
+	}
+
+	// The levels are decoded as they are, rather than into allocated ones, so
+	// that the declared sizes cannot cause an allocation larger than the input
+	minhashes := min(serialization.Depth, hybridMinHashLevels)
+	if len(serialization.MinHashes) != minhashes || len(serialization.Levels) != serialization.Depth {
+		return fmt.Errorf("%w: %d levels do not match depth %d", ErrStrataMismatch,
+			len(serialization.MinHashes)+len(serialization.Levels), serialization.Depth)
+	}
+	decoded := &HybridEstimator{
+		serialization.Depth,
+		serialization.Keysize,
+		serialization.Cellsize,
+		serialization.Hashcount,
+		make([]*IBF, serialization.Depth),
+		make([]*MinHash, minhashes),
+		hasher,
+		serialization.Seed,
+	}
+
+	for level, minhash := range serialization.MinHashes {
+		mh := &MinHash{}
+		if err := mh.setMinHash(minhash); err != nil {
+			return err
+		}
+		if len(mh.signature) != decoded.Hashcount ||
+			mh.hasher.Scheme() != hasher.Scheme() || mh.seed != decoded.Seed {
+			return fmt.Errorf("%w: level %d differs in signature size or hash function", ErrStrataMismatch, level)
+		}
+		decoded.MinHashset[level] = mh
+	}
+	for level, serialization := range serialization.Levels {
+		ibf := &IBF{}
+		if err := ibf.SetIBF(serialization); err != nil {
+			return err
+		}
+		if ibf.Size != decoded.Cellsize || ibf.Keysize != decoded.Keysize || ibf.Variable ||
+			ibf.scheme() != hasher.Scheme() || ibf.Seed != decoded.Seed {
+			return fmt.Errorf("%w: level %d differs in size or hash function", ErrStrataMismatch, level)
+		}
+		decoded.IBFset[level] = ibf
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// MarshalBinary encodes the estimator in a compact binary format. The header
+// holds the magic bytes "HY", a version byte, the hash scheme, a flags byte,
+// the hash count, cellsize, keysize, depth and MinHash signature size as
+// unsigned varints, and the seed in 4 little-endian bytes if it is not zero.
+// The MinHash levels follow in order, each as its key count as an unsigned
+// varint and its signature in 4 little-endian bytes per value, and then the
+// cells of each IBF level, encoded as by IBF.MarshalBinary.
+func (h *HybridEstimator) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 24+len(h.MinHashset)*4*h.Hashcount+len(h.IBFset)*h.Cellsize*(4+2+h.Keysize))
+	data = append(data, hybridMagic...)
+	data = append(data, binaryVersion, byte(h.scheme()), h.flags())
+	data = binary.AppendUvarint(data, ibfHashCount)
+	data = binary.AppendUvarint(data, uint64(h.Cellsize))
+	data = binary.AppendUvarint(data, uint64(h.Keysize))
+	data = binary.AppendUvarint(data, uint64(h.Depth))
+	data = binary.AppendUvarint(data, uint64(h.Hashcount))
+	if h.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, h.Seed)
+	}
+	for _, mh := range h.MinHashset {
+		data = mh.appendSignature(data)
+	}
+	for _, ibf := range h.IBFset {
+		data = ibf.appendCells(data)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the estimator from the format produced by
+// MarshalBinary, allocating its levels.
+func (h *HybridEstimator) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(hybridMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^flagSeeded != 0 {
+		d.fail(ErrMalformed)
+	}
+	if d.err == nil && d.uvarint() != ibfHashCount {
+		d.fail(ErrHashCount)
+	}
+	cellsize := d.length()
+	keysize := d.length()
+	depth := d.length()
+	hashcount := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if !validHybrid(cellsize, keysize, depth, hashcount) {
+		return ErrMalformed
+	}
+	// Each MinHash takes at least a byte for its key count besides its
+	// signature, and each IBF level its cells
+	if !d.remaining(min(depth, hybridMinHashLevels), 1+4*hashcount) ||
+		!d.remaining(depth*cellsize, minCellLength+keysize) {
+		return d.err
+	}
+
+	decoded := newHybridEstimator(cellsize, hashcount, keysize, depth,
+		[]Option{WithHasher(hasher), WithSeed(seed)})
+	for _, mh := range decoded.MinHashset {
+		mh.readSignature(d)
+	}
+	for _, ibf := range decoded.IBFset {
+		ibf.readCells(d)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// validHybrid returns true if the parameters of a decoded estimator are within
+// the limits of the binary encoding. The decoders also check them against the
+// length of the input before allocating any level.
+func validHybrid(cellsize, keysize, depth, hashcount int) bool {
+	return cellsize >= 1 && keysize >= 1 && hashcount >= 1 && depth >= 1 && depth <= 64 &&
+		cellsize <= maxBinaryLength && keysize <= maxBinaryLength && hashcount <= maxBinaryLength
 }
@@ -0,0 +1,201 @@
+package reconcile
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHybridEstimator(t *testing.T) {
+	keysize := 32
+	match := 4000
+	depth := 13
+	trials := 5
+
+	for _, difference := range []int{0, 10, 100, 1000, 8000} {
+		hybridError, strataError := 0.0, 0.0
+		inexact := 0
+		for trial := 0; trial < trials; trial++ {
+			localset, remoteset := NewTestSets(keysize, match, difference/2, difference-difference/2)
+
+			local := NewHybridEstimatorDepth(keysize, depth)
+			remote := NewHybridEstimatorDepth(keysize, depth)
+			local.BuildSignature(localset)
+			remote.BuildSignature(remoteset)
+			if err := local.Compatible(remote); err != nil {
+				t.Fatal(err)
+			}
+			hybrid := local.EstimateSizeDifference(remote)
+
+			localStrata := NewStrata(80, keysize, depth)
+			remoteStrata := NewStrata(80, keysize, depth)
+			localStrata.Populate(localset)
+			remoteStrata.Populate(remoteset)
+			strata := localStrata.Estimate(remoteStrata)
+
+			if difference == 0 {
+				if hybrid != 0 {
+					t.Errorf("For identical sets expected 0, got %d", hybrid)
+				}
+				continue
+			}
+			if hybrid != difference {
+				inexact++
+			}
+			hybridError += math.Abs(float64(hybrid-difference)) / float64(trials)
+			strataError += math.Abs(float64(strata-difference)) / float64(trials)
+		}
+
+		// A MinHash mismatch stands for several keys, which adds some noise
+		// to small differences. Large differences are scaled up from the high
+		// levels as by Strata, so they are off by as much.
+		if hybridError > strataError+float64(difference)/4+10 {
+			t.Errorf("For a difference of %d the mean error is %.1f, and %.1f with Strata",
+				difference, hybridError, strataError)
+		}
+		// Small differences are counted exactly by the IBFs, as by Strata,
+		// unless one of the levels fails to decode, which happens for about
+		// 1% of the sets
+		if difference <= 10 && inexact > 1 {
+			t.Errorf("For a difference of %d the estimate was inexact in %d of %d trials",
+				difference, inexact, trials)
+		}
+		t.Logf("For a difference of %d the mean error is %.1f, and %.1f with Strata",
+			difference, hybridError, strataError)
+	}
+}
+
+func TestHybridEstimatorEmptySet(t *testing.T) {
+	local := NewHybridEstimator(nil)
+	local.BuildSignature(nil)
+	if estimate := local.EstimateSizeDifference(NewHybridEstimator(nil)); estimate != 0 {
+		t.Errorf("For empty sets got estimate %d", estimate)
+	}
+}
+
+func TestHybridEstimatorSmallSets(t *testing.T) {
+	for count := 1; count <= 4; count++ {
+		localset, remoteset := NewTestSets(32, count, 1, 0)
+		local := NewHybridEstimator(localset)
+		remote := NewHybridEstimatorDepth(32, local.Depth)
+		local.BuildSignature(localset)
+		remote.BuildSignature(remoteset)
+		if estimate := local.EstimateSizeDifference(remote); estimate < 0 {
+			t.Errorf("For %d keys got estimate %d", count, estimate)
+		}
+	}
+}
+
+func TestHybridEstimatorMismatch(t *testing.T) {
+	local := NewHybridEstimatorDepth(32, 8)
+	if err := local.Compatible(NewHybridEstimatorDepth(32, 9)); err != ErrStrataMismatch {
+		t.Errorf("Expected %v, got %v", ErrStrataMismatch, err)
+	}
+	if err := local.Compatible(NewHybridEstimatorDepth(32, 8, WithSeed(3))); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+	if err := local.Compatible(NewHybridEstimatorDepth(32, 8, WithHasher(fnvHasher{}))); err != ErrHasherMismatch {
+		t.Errorf("Expected %v, got %v", ErrHasherMismatch, err)
+	}
+}
+
+func TestHybridEstimatorSerialization(t *testing.T) {
+	keys := makeRandomElements(500, 16)
+	for _, h := range []*HybridEstimator{
+		NewHybridEstimatorDepth(16, 9),
+		NewHybridEstimatorDepth(16, 9, WithSeed(5)),
+		NewHybridEstimatorDepth(16, 1),
+	} {
+		h.BuildSignature(keys)
+
+		data, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &HybridEstimator{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h, decoded) {
+			t.Error("Binary decoded estimator does not match the original")
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+			t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+		}
+
+		data, err = h.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = &HybridEstimator{}
+		if err := decoded.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h, decoded) {
+			t.Error("JSON decoded estimator does not match the original")
+		}
+	}
+
+	// Parameters too large to allocate are rejected before allocating
+	for _, data := range []string{
+		`{"cellsize":80,"keysize":16,"hashcount":8,"depth":1000000000}`,
+		`{"cellsize":1000000000000,"keysize":16,"hashcount":8,"depth":8}`,
+		`{"cellsize":80,"keysize":16,"hashcount":1000000000000,"depth":8}`,
+	} {
+		if err := (&HybridEstimator{}).UnmarshalJSON([]byte(data)); err != ErrMalformed {
+			t.Errorf("Expected %v for %s, got %v", ErrMalformed, data, err)
+		}
+	}
+	if err := (&HybridEstimator{}).UnmarshalJSON([]byte(`{"cellsize":80,"keysize":16,"hashcount":100000000,"depth":64}`)); !errors.Is(err, ErrStrataMismatch) {
+		t.Errorf("Expected %v for missing levels, got %v", ErrStrataMismatch, err)
+	}
+
+	// A header declaring 64 levels of 1<<27 cells must be rejected before they
+	// are allocated
+	header := append([]byte(hybridMagic), binaryVersion, byte(HashMurmur3), 0, ibfHashCount, 0x80, 0x80, 0x80, 0x40, 1, 64, 8)
+	if err := (&HybridEstimator{}).UnmarshalBinary(header); err != ErrTruncated {
+		t.Errorf("Expected %v for a huge header, got %v", ErrTruncated, err)
+	}
+}
+
+func TestReconcileHybrid(t *testing.T) {
+	keysize := 32
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		localset, remoteset := NewTestSets(keysize, 300, 20, 10)
+		local := NewReconcile(localset, len(remoteset), WithHybridEstimator())
+		remote := NewReconcile(remoteset, len(localset), WithHybridEstimator())
+		local.Format = format
+		remote.Format = format
+		if local.Hybrid == nil || local.Estimator != nil {
+			t.Fatal("The hybrid estimator was not selected")
+		}
+
+		estimator, err := remote.GetDifferenceSizeEstimator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate, err := local.EstimateDifferenceSize(estimator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, b, err := local.Difference(cellsForEstimate(estimate), remote.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameElements(a, localset[300:]) || !sameElements(b, remoteset[300:]) {
+			t.Errorf("For format %d the difference is incorrect", format)
+		}
+	}
+
+	// A Strata cannot be compared with a HybridEstimator
+	localset, remoteset := NewTestSets(keysize, 10, 1, 1)
+	estimator, err := NewReconcile(remoteset, len(localset)).GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReconcile(localset, len(remoteset), WithHybridEstimator()).EstimateDifferenceSize(estimator); err != ErrMagic {
+		t.Errorf("Expected %v, got %v", ErrMagic, err)
+	}
+}
@@ -1,29 +1,42 @@
 package reconcile
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 )
 
+// ErrIBFMismatch occurs when combining filters of different sizes, keysizes or
+// kinds.
+var ErrIBFMismatch = errors.New("Mismatched filter parameters")
+
 // IBF is the stucture for the invertible bloom filter.
 type IBF struct {
-	Size     int
-	Keysize  int
-	Hashset  []uint32
-	Countset []int
-	Bitset   []byte
+	Size      int
+	Keysize   int
+	Hashset   []uint32
+	Countset  []int
+	Bitset    []byte
+	Variable  bool   // Whether keys may be shorter than Keysize
+	Lengthset []int  // Sum of key lengths in each cell, if Variable
+	Hasher    Hasher // Hash function placing keys; Murmur3 if nil
+	Seed      uint32 // Seed of the hash function
 }
 
 // IBFSerialization is used to transfer the IBF along the wire suitable for use
 // in a JavaScript implementation.
 type IBFSerialization struct {
-	Size     int      `json:"size"`
-	Keysize  int      `json:"keysize"`
-	Hashset  []uint32 `json:"hashes"`
-	Countset []int    `json:"counts"`
-	Data     string   `json:"data"`
+	Size     int        `json:"size"`
+	Keysize  int        `json:"keysize"`
+	Hashset  []uint32   `json:"hashes"`
+	Countset []int      `json:"counts"`
+	Data     string     `json:"data"`
+	Lengths  []int      `json:"lengths,omitempty"`
+	Hash     HashScheme `json:"hash,omitempty"`
+	Seed     uint32     `json:"seed,omitempty"`
 }
 
 // NewIBF creates a new invertible bloom filter of the specified `size`, or the
@@ -37,7 +50,10 @@ type IBFSerialization struct {
 // You might not want to call this function directly, as the best value of the
 // `size` argument is roughly determined by the size of the set difference. This
 // can be ascertained approximately with the stata estimator algorithm.
-func NewIBF(size, keysize int) *IBF {
+//
+// The hash function and its seed may be selected with the WithHasher and
+// WithSeed options.
+func NewIBF(size, keysize int, opts ...Option) *IBF {
 	if size < 1 {
 		size = 1
 	}
@@ -48,19 +64,26 @@ func NewIBF(size, keysize int) *IBF {
 	hashset := make([]uint32, size)
 	countset := make([]int, size)
 	bitset := make([]byte, keysize*size)
-	return &IBF{size, keysize, hashset, countset, bitset}
+	o := applyOptions(opts)
+	return &IBF{size, keysize, hashset, countset, bitset, false, nil, o.hasher, o.seed}
+}
+
+// NewVariableIBF creates a new invertible bloom filter like NewIBF, but which
+// accepts keys of any length up to `maxkeysize` bytes. Each cell stores its key
+// sum padded to `maxkeysize` along with the sum of the key lengths, so that
+// decoding recovers the original keys.
+func NewVariableIBF(size, maxkeysize int, opts ...Option) *IBF {
+	f := NewIBF(size, maxkeysize, opts...)
+	f.Variable = true
+	f.Lengthset = make([]int, f.Size)
+	return f
 }
 
 // MarshalJSON encodes the invertible bloom filter in a JSON byte format as
 // documented by the IBFSerialization type.
 func (f *IBF) MarshalJSON() ([]byte, error) {
-	return json.Marshal(&IBFSerialization{
-		f.Size,
-		f.Keysize,
-		f.Hashset,
-		f.Countset,
-		hex.EncodeToString(f.Bitset),
-	})
+	serialization := f.GetIBF()
+	return json.Marshal(&serialization)
 }
 
 // UnmarshalJSON decodes the invertible bloom filter from a JSON byte format as
@@ -71,50 +94,193 @@ func (f *IBF) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	bitset, err := hex.DecodeString(serialization.Data)
-	if err != nil {
+	return f.SetIBF(*serialization)
+}
+
+// ibfMagic begins the binary encoding of an IBF.
+const ibfMagic = "IB"
+
+// ibfHashCount is the number of cells each key is stored in.
+const ibfHashCount = 3
+
+// MarshalBinary encodes the invertible bloom filter in a compact binary format.
+// The encoding begins with a header holding the magic bytes "IB", a version
+// byte, the hash scheme, a flags byte, the hash count, size and keysize as
+// unsigned varints, and the seed in 4 little-endian bytes if it is not zero.
+// Each cell then follows as its hash sum in 4 little-endian bytes, its count as
+// a zigzag varint, its length sum as a zigzag varint if the filter is
+// variable, and its key sum.
+func (f *IBF) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 16+f.Size*(4+2+f.Keysize))
+	data = append(data, ibfMagic...)
+	data = append(data, binaryVersion, byte(f.scheme()), f.flags())
+	data = binary.AppendUvarint(data, ibfHashCount)
+	data = binary.AppendUvarint(data, uint64(f.Size))
+	data = binary.AppendUvarint(data, uint64(f.Keysize))
+	if f.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, f.Seed)
+	}
+	return f.appendCells(data), nil
+}
+
+// UnmarshalBinary decodes the invertible bloom filter from the format produced
+// by MarshalBinary.
+func (f *IBF) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(ibfMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^(flagVariable|flagSeeded) != 0 {
+		d.fail(ErrMalformed)
+	}
+	if d.err == nil && d.uvarint() != ibfHashCount {
+		d.fail(ErrHashCount)
+	}
+	size := d.length()
+	keysize := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if size < 1 || keysize < 1 {
+		return ErrMalformed
+	}
+	if !d.remaining(size, minCellLength+keysize) {
+		return d.err
+	}
+
+	newIBF := NewIBF
+	if flags&flagVariable != 0 {
+		newIBF = NewVariableIBF
+	}
+	decoded := newIBF(size, keysize, WithHasher(hasher), WithSeed(seed))
+	decoded.readCells(d)
+	if err := d.finish(); err != nil {
 		return err
 	}
 
-	f.Size = serialization.Size
-	f.Keysize = serialization.Keysize
-	f.Hashset = serialization.Hashset
-	f.Countset = serialization.Countset
-	f.Bitset = bitset
+	*f = *decoded
+	return nil
+}
+
+// hasher returns the hash function of the filter.
+func (f *IBF) hasher() Hasher {
+	return defaultHasher(f.Hasher)
+}
+
+// scheme returns the identifier of the hash function of the filter.
+func (f *IBF) scheme() HashScheme {
+	return f.hasher().Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (f *IBF) flags() (flags byte) {
+	if f.Variable {
+		flags |= flagVariable
+	}
+	if f.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
 
+// appendCells appends the binary encoding of every cell to `data`.
+func (f *IBF) appendCells(data []byte) []byte {
+	for i := 0; i < f.Size; i++ {
+		data = binary.LittleEndian.AppendUint32(data, f.Hashset[i])
+		data = binary.AppendVarint(data, int64(f.Countset[i]))
+		if f.Variable {
+			data = binary.AppendVarint(data, int64(f.Lengthset[i]))
+		}
+		data = append(data, f.Bitset[i*f.Keysize:(i+1)*f.Keysize]...)
+	}
+	return data
+}
+
+// minCellLength is the least number of bytes taken by an encoded cell besides
+// its key sum: the hash sum and a single byte count.
+const minCellLength = 5
+
+// readCells fills every cell from the binary encoding read by `d`. The caller
+// checks with decoder.remaining that the input can hold every cell.
+func (f *IBF) readCells(d *decoder) {
+	for i := 0; i < f.Size; i++ {
+		f.Hashset[i] = d.uint32()
+		f.Countset[i] = int(d.varint())
+		if f.Variable {
+			f.Lengthset[i] = int(d.varint())
+		}
+		copy(f.Bitset[i*f.Keysize:], d.bytes(f.Keysize))
+	}
+}
+
+// validate checks that the cell arrays agree with the size and keysize, as
+// they may not when decoded from JSON.
+func (f *IBF) validate() error {
+	if f.Size < 1 || f.Keysize < 1 ||
+		len(f.Hashset) != f.Size ||
+		len(f.Countset) != f.Size ||
+		len(f.Bitset) != f.Size*f.Keysize {
+		return ErrMalformed
+	}
+	if f.Variable != (f.Lengthset != nil) ||
+		(f.Variable && len(f.Lengthset) != f.Size) {
+		return ErrMalformed
+	}
 	return nil
 }
 
-//Takes and sets values in the IBF directly
+// SetIBF takes and sets values in the IBF directly. It returns ErrMalformed if
+// the cell arrays do not agree with the size and keysize.
 func (f *IBF) SetIBF(data IBFSerialization) error {
 	bitset, err := hex.DecodeString(data.Data)
 	if err != nil {
 		return err
 	}
-	fmt.Println(f.Size)
 
-	f.Size = data.Size
-	fmt.Println("GO2")
-	f.Keysize = data.Keysize
-	f.Hashset = data.Hashset
-	f.Countset = data.Countset
-	f.Bitset = bitset
+	hasher, err := LookupHasher(data.Hash)
+	if err != nil {
+		return err
+	}
+
+	variable := data.Lengths != nil
+	decoded := IBF{data.Size, data.Keysize, data.Hashset, data.Countset, bitset, variable, data.Lengths, hasher, data.Seed}
+	if err := decoded.validate(); err != nil {
+		return err
+	}
 
+	*f = decoded
 	return nil
 }
 
+// GetIBF returns the values of the IBF as they are serialized to JSON.
 func (f *IBF) GetIBF() IBFSerialization {
 	return IBFSerialization{
 		f.Size,
 		f.Keysize,
 		f.Hashset,
 		f.Countset,
-		hex.EncodeToString(f.Bitset)}
+		hex.EncodeToString(f.Bitset),
+		f.Lengthset,
+		f.jsonScheme(),
+		f.Seed}
+}
+
+// jsonScheme returns the hash scheme recorded in the JSON encoding, which is
+// omitted for the default so that ts-reconcile can read it.
+func (f *IBF) jsonScheme() HashScheme {
+	if f.scheme() == HashMurmur3 {
+		return 0
+	}
+	return f.scheme()
 }
 
 // Hashes returns an array of hash values resulting from the specified `key`.
-// This implementation uses the 128-bit x86 murmur3 hash and returns the
-// following, in order:
+// This implementation uses the filter's Hasher with the filter's Seed, which is
+// the 128-bit x86 murmur3 hash by default, and returns the following, in order:
 //
 // - the low 32 bits of the first part of the result
 // - the high 32 bits of the first part of the result
@@ -125,17 +291,42 @@ func (f *IBF) GetIBF() IBFSerialization {
 // values are used for indices.
 func (f *IBF) Hashes(key []byte) []uint32 {
 	// Hash the key to get array indices
-	values := Sum128x32(key, 0)
+	values := f.hasher().Sum128(key, f.Seed)
 	return values[:]
 }
 
 // Indices converts an array of hash values into indices suitable for use in the
 // filter. This implementation returns a new array where the elements are taken
 // from the elements of the hash value array `mod` the size of the filter.
+//
+// Variable filters drop duplicate indices. The hash values of keys shorter than
+// 16 bytes are partly equal, so a short key would otherwise be stored several
+// times in one cell, cancelling its key sum while changing the count. Fixed
+// filters keep them, so that their cells match those of ts-reconcile.
 func (f *IBF) Indices(hashes []uint32) []int {
+	if f.Variable {
+		return cellIndices(hashes, f.Size)
+	}
 	indices := make([]int, len(hashes))
-	for index, hash := range hashes {
-		indices[index] = int(uint(hash) % uint(f.Size))
+	for i, hash := range hashes {
+		indices[i] = int(uint(hash) % uint(f.Size))
+	}
+	return indices
+}
+
+// cellIndices returns the distinct cells of a filter of `size` cells given by
+// the hash values.
+func cellIndices(hashes []uint32, size int) []int {
+	indices := make([]int, 0, len(hashes))
+next:
+	for _, hash := range hashes {
+		index := int(uint(hash) % uint(size))
+		for _, existing := range indices {
+			if existing == index {
+				continue next
+			}
+		}
+		indices = append(indices, index)
 	}
 	return indices
 }
@@ -143,12 +334,14 @@ func (f *IBF) Indices(hashes []uint32) []int {
 // Update changes the value of the filter at the indices specified from the
 // `indices` argument. Each value at those indices hash its bitset XORed with
 // the `key` argument, the count value is increased by `incCount`, and the
-// hashset is XORed with the value of the `hash` argument.
+// hashset is XORed with the value of the `hash` argument. If the filter is
+// variable, the length sum is increased by `incCount` times the key length.
 //
-// If the key is not of the proper length, this function returns an error.
+// If the key is not of the proper length, or is longer than the maximum key
+// size of a variable filter, this function returns an error.
 func (f *IBF) Update(key []byte, hash uint32, indices []int, incCount int) error {
 	keysize := len(key)
-	if keysize != f.Keysize {
+	if keysize > f.Keysize || (keysize != f.Keysize && !f.Variable) {
 		return fmt.Errorf("Update key '%s' of size %d to filter with key size of %d",
 			key, keysize, f.Keysize)
 	}
@@ -160,6 +353,9 @@ func (f *IBF) Update(key []byte, hash uint32, indices []int, incCount int) error
 		}
 		f.Hashset[index] ^= hash
 		f.Countset[index] += incCount
+		if f.Variable {
+			f.Lengthset[index] += incCount * keysize
+		}
 	}
 
 	return nil
@@ -183,13 +379,23 @@ func (f *IBF) Remove(key []byte) error {
 
 // Subtract performs the invertible bloom filter subtraction algorithm and
 // stores the result into this filter. This function returns an error if the
-// filters were initialized with a different size or keysize.
+// filters were initialized with a different size, keysize, hash function or
+// seed, or if only one of them is variable.
 func (f *IBF) Subtract(subtrahend *IBF) error {
 	if f.Size != subtrahend.Size {
-		return errors.New("Subtracting two filters of differing size")
+		return fmt.Errorf("%w: subtracting two filters of differing size", ErrIBFMismatch)
 	}
 	if f.Keysize != subtrahend.Keysize {
-		return errors.New("Subtracting two filters with differing max key size")
+		return fmt.Errorf("%w: subtracting two filters with differing max key size", ErrIBFMismatch)
+	}
+	if f.Variable != subtrahend.Variable {
+		return fmt.Errorf("%w: subtracting a variable filter and a fixed filter", ErrIBFMismatch)
+	}
+	if f.scheme() != subtrahend.scheme() {
+		return ErrHasherMismatch
+	}
+	if f.Seed != subtrahend.Seed {
+		return ErrSeedMismatch
 	}
 
 	// Subtract keyset
@@ -202,11 +408,37 @@ func (f *IBF) Subtract(subtrahend *IBF) error {
 		// Subtract hashset
 		f.Hashset[i] ^= subtrahend.Hashset[i]
 		f.Countset[i] -= subtrahend.Countset[i]
+		if f.Variable {
+			f.Lengthset[i] -= subtrahend.Lengthset[i]
+		}
 	}
 
 	return nil
 }
 
+// Clone returns a copy of the filter that shares no cells with it.
+func (f *IBF) Clone() *IBF {
+	clone := *f
+	clone.Hashset = append([]uint32{}, f.Hashset...)
+	clone.Countset = append([]int{}, f.Countset...)
+	clone.Bitset = append([]byte{}, f.Bitset...)
+	if f.Lengthset != nil {
+		clone.Lengthset = append([]int{}, f.Lengthset...)
+	}
+	return &clone
+}
+
+// Difference returns a new filter holding `a` minus `b`, leaving both
+// unchanged, so that it can be decoded without destroying either. It returns an
+// error if the filters cannot be subtracted.
+func Difference(a, b *IBF) (*IBF, error) {
+	difference := a.Clone()
+	if err := difference.Subtract(b); err != nil {
+		return nil, err
+	}
+	return difference, nil
+}
+
 // Count returns the value of the count cell at the specified `index`.
 func (f *IBF) Count(index int) int {
 	return f.Countset[index]
@@ -226,31 +458,76 @@ func (f *IBF) HashSum(index int) uint32 {
 }
 
 // IsPure returns true if the cell has a count of 1 or -1, and that the hash sum
-// value matches the hash of the cell's key sum.
+// value matches the hash of the cell's key sum. In a variable filter, the length
+// sum must also describe a key whose padding is zero.
 //
 // This indicates a good chance that only one element has been stored at the
-// cell with this index, and that it may be uncovered.
+// cell with this index, and that it may be uncovered. A key inserted more than
+// once cancels its own key sum, so multisets are held by a MultisetIBF instead.
 func (f *IBF) IsPure(index int) bool {
+	_, ok := f.pureKey(index)
+	return ok
+}
+
+// opposed returns whether one of the cells at `indices` other than `index` is
+// pure for the key with the opposite count.
+func (f *IBF) opposed(key []byte, count, index int, indices []int) bool {
+	for _, i := range indices {
+		if i == index || f.Count(i) != -count {
+			continue
+		}
+		if other, ok := f.pureKey(i); ok && bytes.Equal(other, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// pureKey returns the key stored in the cell at the specified `index`, and
+// whether the cell is pure. In a variable filter the key is trimmed to its
+// original length.
+func (f *IBF) pureKey(index int) ([]byte, bool) {
 	count := f.Count(index)
 	if count != 1 && count != -1 {
-		return false
+		return nil, false
 	}
 
 	keyindex := index * f.Keysize
-	hashes := f.Hashes(f.Bitset[keyindex : keyindex+f.Keysize])
-	return hashes[0] == f.HashSum(index)
+	keysum := f.Bitset[keyindex : keyindex+f.Keysize]
+	if f.Variable {
+		length := f.Lengthset[index] * count
+		if length < 0 || length > f.Keysize {
+			return nil, false
+		}
+		for _, v := range keysum[length:] {
+			if v != 0 {
+				return nil, false
+			}
+		}
+		keysum = keysum[:length]
+	}
+
+	hashes := f.Hashes(keysum)
+	if hashes[0] != f.HashSum(index) {
+		return nil, false
+	}
+	return append([]byte{}, keysum...), true
 }
 
 // Decode performs the decoding operation for this invertible bloom filter.
 // Suppose this filter is called `A`, and that we have called `A.Subtract(B)`.
 // This function returns three values in order, where "∖" is the set difference:
-// - Some subset of A ∖ B,
-// - Some subset of B ∖ A,
+// - A ∖ B,
+// - B ∖ A,
 // - An indication of whether all the elements have been properly decoded.
 //
+// No keys are returned if decoding fails. A key with a repeated cell index
+// cancels itself in that cell, and may then let another key be peeled with the
+// wrong sign, so the keys of an incomplete decoding cannot be trusted.
+//
 // The process of decoding changes the filter. The filter removes all keys that
 // have been successfully decoded. So it will be empty if all elements were
-// decoded.
+// decoded. Decode a Clone, or the result of Difference, to keep the filter.
 func (f *IBF) Decode() (a [][]byte, b [][]byte, ok bool) {
 	pureIndices := []int{}
 
@@ -268,15 +545,22 @@ func (f *IBF) Decode() (a [][]byte, b [][]byte, ok bool) {
 		index := pureIndices[len(pureIndices)-1]
 		pureIndices = pureIndices[:len(pureIndices)-1]
 
-		if !f.IsPure(index) {
+		key, pure := f.pureKey(index)
+		if !pure {
 			continue
 		}
 
-		key := f.KeySum(index)
 		count := f.Count(index)
 		hashes := f.Hashes(key)
 		indices := f.Indices(hashes[1:])
 
+		// Another key repeated in this cell cancels itself, and may leave
+		// the cell looking pure with the opposite count. Peel the key from
+		// its other cells instead.
+		if f.opposed(key, count, index, indices) {
+			continue
+		}
+
 		// Use the value of count to determine which difference we are part of
 		if count > 0 {
 			a = append(a, key)
@@ -297,12 +581,15 @@ func (f *IBF) Decode() (a [][]byte, b [][]byte, ok bool) {
 	// Check for failure; we need an empty filter after decoding
 	for i := 0; i < f.Size; i++ {
 		if f.HashSum(i) != 0 || f.Count(i) != 0 {
-			return
+			return nil, nil, false
+		}
+		if f.Variable && f.Lengthset[i] != 0 {
+			return nil, nil, false
 		}
 	}
 	for _, v := range f.Bitset {
 		if v != 0 {
-			return
+			return nil, nil, false
 		}
 	}
 
@@ -3,8 +3,12 @@ package reconcile
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -126,3 +130,290 @@ func TestIBF(t *testing.T) {
 		}
 	}
 }
+
+func TestIBFBinary(t *testing.T) {
+	keysize := 32
+	filter := NewIBF(40, keysize)
+	for _, element := range makeRandomElements(25, keysize) {
+		if err := filter.Add(element); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := filter.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Binary encoding is %d bytes, JSON encoding is %d bytes", len(data), len(jsonData))
+	if len(data) >= len(jsonData) {
+		t.Errorf("Binary encoding of %d bytes is not smaller than JSON of %d bytes", len(data), len(jsonData))
+	}
+
+	decoded := &IBF{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filter, decoded) {
+		t.Error("Decoded filter does not match the original")
+	}
+
+	// Every truncation of the encoding must be rejected
+	for i := 0; i < len(data); i++ {
+		if err := (&IBF{}).UnmarshalBinary(data[:i]); err == nil {
+			t.Errorf("Truncated encoding of %d bytes was accepted", i)
+			break
+		}
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[2] = binaryVersion + 1
+	if err := (&IBF{}).UnmarshalBinary(corrupt); err != ErrVersion {
+		t.Errorf("Expected %v, got %v", ErrVersion, err)
+	}
+
+	if err := (&IBF{}).UnmarshalBinary(append(data, 0)); err != ErrTrailingData {
+		t.Errorf("Expected %v, got %v", ErrTrailingData, err)
+	}
+
+	// A header declaring 1<<27 cells must be rejected before they are allocated
+	header := append([]byte(ibfMagic), binaryVersion, byte(HashMurmur3), 0, ibfHashCount, 0x80, 0x80, 0x80, 0x40, 1)
+	if err := (&IBF{}).UnmarshalBinary(header); err != ErrTruncated {
+		t.Errorf("Expected %v for a huge header, got %v", ErrTruncated, err)
+	}
+}
+
+func makeVariableElements(count, maxkeysize int) [][]byte {
+	elements := make([][]byte, count)
+	for i := range elements {
+		elements[i] = makeRandomElements(1, 1+rand.Intn(maxkeysize))[0]
+	}
+	return elements
+}
+
+func TestVariableIBF(t *testing.T) {
+	maxkeysize := 64
+	fill := func(size int) (filterA, filterB *IBF, uniqueA, uniqueB [][]byte) {
+		common := makeVariableElements(50, maxkeysize)
+		uniqueA = makeVariableElements(10, maxkeysize)
+		uniqueB = append(makeVariableElements(9, maxkeysize), []byte{})
+		filterA = NewVariableIBF(size, maxkeysize)
+		filterB = NewVariableIBF(size, maxkeysize)
+		for _, element := range append(append([][]byte{}, common...), uniqueA...) {
+			if err := filterA.Add(element); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, element := range append(append([][]byte{}, common...), uniqueB...) {
+			if err := filterB.Add(element); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	filterA, filterB, _, _ := fill(60)
+	if err := filterA.Add(make([]byte, maxkeysize+1)); err == nil {
+		t.Error("Key longer than the maximum key size was accepted")
+	}
+
+	// The encodings must preserve the lengths
+	data, err := filterB.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &IBF{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filterB, decoded) {
+		t.Error("Binary decoded filter does not match the original")
+	}
+	data, err = filterB.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &IBF{}
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filterB, decoded) {
+		t.Error("JSON decoded filter does not match the original")
+	}
+	if err := filterA.Subtract(NewIBF(60, maxkeysize)); err == nil {
+		t.Error("Subtracting a fixed filter from a variable filter succeeded")
+	}
+
+	// Short keys occupy fewer cells, so decoding fails for about 2% of the
+	// sets with 5 times as many cells as keys in the difference
+	trials, failures := 20, 0
+	for trial := 0; trial < trials; trial++ {
+		filterA, filterB, uniqueA, uniqueB := fill(100)
+		if err := filterA.Subtract(filterB); err != nil {
+			t.Fatal(err)
+		}
+		local, remote, ok := filterA.Decode()
+		if !ok {
+			failures++
+			continue
+		}
+		if !sameElements(local, uniqueA) || !sameElements(remote, uniqueB) {
+			t.Error("Decoded keys do not match the originals")
+		}
+	}
+	if failures > trials/5 {
+		t.Errorf("Could not decode the difference for %d of %d sets", failures, trials)
+	}
+}
+
+func TestIBFSeed(t *testing.T) {
+	keysize := 16
+	size := 30
+
+	// Craft keys that all occupy the same cells under the default seed
+	target := NewIBF(size, keysize)
+	crafted := [][]byte{}
+	want := ""
+	for len(crafted) < 6 {
+		key := makeRandomElements(1, keysize)[0]
+		indices := target.Indices(target.Hashes(key)[1:])
+		if len(indices) != 3 {
+			continue
+		}
+		sort.Ints(indices)
+		if want == "" {
+			want = fmt.Sprint(indices)
+		}
+		if fmt.Sprint(indices) == want {
+			crafted = append(crafted, key)
+		}
+	}
+
+	decode := func(seed uint32) bool {
+		filterA := NewIBF(size, keysize, WithSeed(seed))
+		filterB := NewIBF(size, keysize, WithSeed(seed))
+		for _, key := range crafted {
+			filterA.Add(key)
+		}
+		if err := filterA.Subtract(filterB); err != nil {
+			t.Fatal(err)
+		}
+		a, _, ok := filterA.Decode()
+		return ok && sameElements(a, crafted)
+	}
+
+	if decode(0) {
+		t.Error("Crafted keys decoded under the default seed")
+	}
+	decoded := false
+	for seed := uint32(1); seed <= 5 && !decoded; seed++ {
+		decoded = decode(seed)
+	}
+	if !decoded {
+		t.Error("Crafted keys did not decode under any other seed")
+	}
+
+	// The seed must survive the encodings
+	filter := NewIBF(size, keysize, WithSeed(0xdeadbeef))
+	filter.Add(crafted[0])
+	for _, encoding := range []struct {
+		marshal   func(*IBF) ([]byte, error)
+		unmarshal func(*IBF, []byte) error
+	}{
+		{(*IBF).MarshalBinary, (*IBF).UnmarshalBinary},
+		{(*IBF).MarshalJSON, (*IBF).UnmarshalJSON},
+	} {
+		data, err := encoding.marshal(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &IBF{}
+		if err := encoding.unmarshal(decoded, data); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Seed != filter.Seed {
+			t.Errorf("Expected seed %x, got %x", filter.Seed, decoded.Seed)
+		}
+		if err := NewIBF(size, keysize).Subtract(decoded); err != ErrSeedMismatch {
+			t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+		}
+	}
+}
+
+func TestIBFDifference(t *testing.T) {
+	// Decoding 10 keys in 80 cells fails for about 1% of the sets
+	trials, failures := 20, 0
+	for trial := 0; trial < trials; trial++ {
+		a, b, _, onlyA, onlyB := MakeTestSets(16, 50, 10)
+
+		filterA := NewIBF(80, 16)
+		filterB := NewIBF(80, 16)
+		for _, element := range a {
+			filterA.Add(element)
+		}
+		for _, element := range b {
+			filterB.Add(element)
+		}
+		cloneA, cloneB := filterA.Clone(), filterB.Clone()
+
+		difference, err := Difference(filterA, filterB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(filterA, cloneA) || !reflect.DeepEqual(filterB, cloneB) {
+			t.Error("Difference changed its arguments")
+		}
+		local, remote, ok := difference.Decode()
+		if !ok {
+			failures++
+			continue
+		}
+		if !sameElements(local, onlyA) || !sameElements(remote, onlyB) {
+			t.Error("Decoded keys do not match the originals")
+		}
+	}
+	if failures > trials/4 {
+		t.Errorf("Could not decode the difference for %d of %d sets", failures, trials)
+	}
+
+	if _, err := Difference(NewIBF(40, 16), NewIBF(41, 16)); !errors.Is(err, ErrIBFMismatch) {
+		t.Errorf("Expected %v for filters with differing sizes, got %v", ErrIBFMismatch, err)
+	}
+}
+
+func TestIBFRepeatedIndex(t *testing.T) {
+	f := NewIBF(16, 16)
+	key := func(i int) []byte {
+		k := make([]byte, 16)
+		k[0], k[1] = byte(i), byte(i>>8)
+		return k
+	}
+
+	// Find a key placed twice in the last cell of another, which then looks
+	// pure with the opposite count, and is decoded first
+	var repeated, other []byte
+	var cell, single int
+	for i := 0; repeated == nil; i++ {
+		indices := f.Indices(f.Hashes(key(i))[1:])
+		if indices[0] == indices[1] && indices[2] < indices[0] {
+			repeated, cell, single = key(i), indices[0], indices[2]
+		}
+	}
+	for i := 1 << 15; other == nil; i++ {
+		indices := f.Indices(f.Hashes(key(i))[1:])
+		if indices[2] == cell && indices[0] < cell && indices[1] < cell &&
+			indices[0] != indices[1] && indices[0] != single && indices[1] != single {
+			other = key(i)
+		}
+	}
+
+	f.Add(other)
+	f.Remove(repeated)
+	a, b, ok := f.Decode()
+	if !ok || !sameElements(a, [][]byte{other}) || !sameElements(b, [][]byte{repeated}) {
+		t.Errorf("Decoded %x and %x, ok %v", a, b, ok)
+	}
+}
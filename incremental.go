@@ -0,0 +1,154 @@
+package reconcile
+
+// maxCachedIBFs is the number of filter sizes a Reconcile keeps up to date.
+const maxCachedIBFs = 4
+
+// Insert adds the key to the local set. The strata estimator and the cached
+// filters are updated in constant time, so the reconciler need not be rebuilt
+// when the set changes. A HybridEstimator cannot remove keys from its MinHash
+// signatures, so it is instead rebuilt when it is next needed.
+//
+// Inserting a key already in the set has no effect. It returns ErrKeysize if
+// the key is not of the proper length.
+//
+// Once Insert or Delete is used, the Keyset must not be changed directly, and
+// its order is not preserved. The keys of a reconciler reading from a Source
+// cannot be changed, and ErrSource is returned.
+func (r *Reconcile) Insert(key []byte) error {
+	if r.Source != nil {
+		return ErrSource
+	}
+	if len(key) > r.Keysize || (len(key) != r.Keysize && !r.Variable) {
+		return ErrKeysize
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buildIndex()
+	if _, ok := r.index[string(key)]; ok {
+		return nil
+	}
+
+	key = append([]byte{}, key...)
+	r.index[string(key)] = len(r.Keyset)
+	r.Keyset = append(r.Keyset, key)
+	r.update(key, true)
+	return nil
+}
+
+// Delete removes the key from the local set, updating the estimator and the
+// cached filters as Insert does. It returns false if the key was not present,
+// or if the keys are read from a Source.
+func (r *Reconcile) Delete(key []byte) bool {
+	if r.Source != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buildIndex()
+	i, ok := r.index[string(key)]
+	if !ok {
+		return false
+	}
+
+	// Move the last key into the gap
+	stored := r.Keyset[i]
+	last := len(r.Keyset) - 1
+	r.Keyset[i] = r.Keyset[last]
+	r.index[string(r.Keyset[i])] = i
+	r.Keyset[last] = nil
+	r.Keyset = r.Keyset[:last]
+	delete(r.index, string(key))
+
+	r.update(stored, false)
+	return true
+}
+
+// buildIndex indexes the keyset if it is not yet maintained. The keyset is
+// copied, since it may share its array with the caller's.
+func (r *Reconcile) buildIndex() {
+	if r.index != nil {
+		return
+	}
+	r.Keyset = append([][]byte{}, r.Keyset...)
+	r.index = make(map[string]int, len(r.Keyset))
+	for i, key := range r.Keyset {
+		r.index[string(key)] = i
+	}
+}
+
+// update adds the key to the estimator and the cached filters if `insert` is
+// true, or else removes it.
+func (r *Reconcile) update(key []byte, insert bool) {
+	if r.Hybrid != nil {
+		r.stale = true
+	}
+	if insert {
+		if r.Estimator != nil {
+			r.Estimator.Add(key)
+		}
+		for _, ibf := range r.cache {
+			ibf.Add(key)
+		}
+		return
+	}
+
+	if r.Estimator != nil {
+		r.Estimator.Remove(key)
+	}
+	for _, ibf := range r.cache {
+		ibf.Remove(key)
+	}
+}
+
+// refreshHybrid rebuilds the hybrid estimator if the set changed since it was
+// built.
+func (r *Reconcile) refreshHybrid() {
+	if r.Hybrid == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stale {
+		r.Hybrid.BuildSignatureSource(r.keys())
+		r.stale = false
+	}
+}
+
+// localIBF returns a filter of the given size holding the local keys, which
+// the caller may change. Filters of the most recently built sizes are kept and
+// updated by Insert and Delete, so that they are only copied when requested
+// again.
+func (r *Reconcile) localIBF(size int) *IBF {
+	r.mu.RLock()
+	ibf, ok := r.cache[size]
+	if ok {
+		ibf = ibf.Clone()
+	}
+	r.mu.RUnlock()
+	if ok {
+		return ibf
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ibf, ok := r.cache[size]; ok {
+		return ibf.Clone()
+	}
+
+	ibf = r.newIBF(size)
+	for key := range r.keys() {
+		ibf.Add(key)
+	}
+
+	if r.cache == nil {
+		r.cache = make(map[int]*IBF, maxCachedIBFs)
+	}
+	if len(r.cached) == maxCachedIBFs {
+		delete(r.cache, r.cached[0])
+		r.cached = r.cached[1:]
+	}
+	r.cache[size] = ibf
+	r.cached = append(r.cached, size)
+	return ibf.Clone()
+}
@@ -0,0 +1,116 @@
+package reconcile
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestReconcileInsertDelete(t *testing.T) {
+	keysize := 16
+	initial := makeRandomElements(200, keysize)
+	inserted := makeRandomElements(50, keysize)
+	original := append([][]byte{}, initial...)
+
+	for _, opts := range [][]Option{nil, {WithHybridEstimator()}} {
+		r := NewReconcile(initial, 300, opts...)
+
+		// Cache a filter before changing the set
+		if _, err := r.GetIBFSignature(30); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range inserted {
+			if err := r.Insert(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Insert(inserted[0]); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range initial[:100] {
+			if !r.Delete(key) {
+				t.Fatal("Could not delete a key in the set")
+			}
+		}
+		if r.Delete(initial[0]) {
+			t.Error("Deleted a key that is no longer in the set")
+		}
+		if err := r.Insert(make([]byte, keysize+1)); err != ErrKeysize {
+			t.Errorf("Expected %v for a long key, got %v", ErrKeysize, err)
+		}
+
+		expected := append(append([][]byte{}, initial[100:]...), inserted...)
+		if !sameElements(r.Keyset, expected) {
+			t.Fatal("The keyset does not hold the inserted keys")
+		}
+		for i := range initial {
+			if !bytes.Equal(initial[i], original[i]) {
+				t.Fatal("The caller's keys were changed")
+			}
+		}
+
+		// The signatures must match a reconciler built from scratch
+		fresh := NewReconcile(expected, 300, opts...)
+		for _, size := range []int{30, 45} {
+			got, err := r.GetIBFSignature(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := fresh.GetIBFSignature(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Signature of size %d does not match a fresh reconciler", size)
+			}
+		}
+		got, err := r.GetDifferenceSizeEstimator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := fresh.GetDifferenceSizeEstimator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("Estimator does not match a fresh reconciler")
+		}
+	}
+}
+
+func TestReconcileConcurrentInsert(t *testing.T) {
+	keysize := 16
+	localset, remoteset := NewTestSets(keysize, 100, 0, 40)
+	local := NewReconcile(localset, len(remoteset))
+	remote := NewReconcile(remoteset, len(localset))
+
+	signature := mustSignature(t, remote, 100)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, key := range remoteset[100:] {
+			local.Insert(key)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			local.GetDifference(100, signature)
+		}
+	}()
+	wg.Wait()
+
+	a, b, ok := local.GetDifference(20, mustSignature(t, remote, 20))
+	if !ok || len(a) != 0 || len(b) != 0 {
+		t.Error("The sets differ after inserting the remote keys")
+	}
+}
+
+func mustSignature(t *testing.T, r *Reconcile, size int) []byte {
+	signature, err := r.GetIBFSignature(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
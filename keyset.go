@@ -0,0 +1,136 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// ErrKeysize occurs when a remote signature holds keys of a different size.
+var ErrKeysize = errors.New("Mismatched key sizes")
+
+// KeysetSerialization is used to transfer an entire keyset along the wire when
+// the set difference could not be decoded from an IBF.
+type KeysetSerialization struct {
+	Keysize int      `json:"keysize"`
+	Keys    []string `json:"keys"`
+}
+
+// keysetMagic begins the binary encoding of a keyset.
+const keysetMagic = "KS"
+
+// GetKeysetSignature encodes every local key in the configured format. The
+// binary format holds the magic bytes "KS", a version byte, and the keysize
+// and key count as unsigned varints, followed by each key prefixed by its
+// length as an unsigned varint.
+func (r *Reconcile) GetKeysetSignature() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keysize := r.Keysize
+	if r.Format == FormatJSON {
+		keys := make([]string, 0, len(r.Keyset))
+		for key := range r.keys() {
+			keys = append(keys, hex.EncodeToString(key))
+		}
+		return json.Marshal(&KeysetSerialization{keysize, keys})
+	}
+
+	// The keys are counted as they are encoded, since a source may not know
+	// their number
+	count := 0
+	encoded := make([]byte, 0, len(r.Keyset)*(keysize+1))
+	for key := range r.keys() {
+		encoded = binary.AppendUvarint(encoded, uint64(len(key)))
+		encoded = append(encoded, key...)
+		count++
+	}
+
+	data := make([]byte, 0, 16+len(encoded))
+	data = append(data, keysetMagic...)
+	data = append(data, binaryVersion)
+	data = binary.AppendUvarint(data, uint64(keysize))
+	data = binary.AppendUvarint(data, uint64(count))
+	return append(data, encoded...), nil
+}
+
+// GetKeysetDifference compares the local keys with the keys in a remote keyset
+// signature. The first result holds the keys only present locally, and the
+// second holds the keys only present remotely. Only the remote keys are held
+// in memory, so the local keys may be scanned from a source.
+func (r *Reconcile) GetKeysetDifference(remotesignature []byte) (a [][]byte, b [][]byte, err error) {
+	remote, err := r.unmarshalKeyset(remotesignature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Whether each remote key is also present locally
+	remoteset := make(map[string]bool, len(remote))
+	for _, key := range remote {
+		remoteset[string(key)] = false
+	}
+	for key := range r.keys() {
+		if _, ok := remoteset[string(key)]; ok {
+			remoteset[string(key)] = true
+		} else {
+			a = append(a, bytes.Clone(key))
+		}
+	}
+	for _, key := range remote {
+		if !remoteset[string(key)] {
+			b = append(b, key)
+		}
+	}
+	return a, b, nil
+}
+
+// unmarshalKeyset decodes the keys from a keyset signature in the configured
+// format.
+func (r *Reconcile) unmarshalKeyset(data []byte) ([][]byte, error) {
+	keysize := r.Keysize
+
+	if r.Format == FormatJSON {
+		serialization := &KeysetSerialization{}
+		if err := json.Unmarshal(data, serialization); err != nil {
+			return nil, err
+		}
+		if serialization.Keysize != keysize {
+			return nil, ErrKeysize
+		}
+		keys := make([][]byte, len(serialization.Keys))
+		for i, encoded := range serialization.Keys {
+			key, err := hex.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = key
+		}
+		return keys, r.checkKeys(keys)
+	}
+
+	d := &decoder{data: data}
+	d.header(keysetMagic)
+	if d.err == nil && d.length() != keysize {
+		d.fail(ErrKeysize)
+	}
+	keys := readKeys(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return keys, r.checkKeys(keys)
+}
+
+// checkKeys returns ErrKeysize if any of the keys is not of the proper length.
+func (r *Reconcile) checkKeys(keys [][]byte) error {
+	for _, key := range keys {
+		if len(key) > r.Keysize || (len(key) != r.Keysize && !r.Variable) {
+			return ErrKeysize
+		}
+	}
+	return nil
+}
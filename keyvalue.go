@@ -0,0 +1,137 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DigestSize is the size in bytes of the value digests stored alongside each
+// key by a KeyValueReconcile.
+const DigestSize = 16
+
+// ErrShortElement occurs when classifying an element too short to hold a value
+// digest, which cannot have been produced from a record.
+var ErrShortElement = errors.New("Element shorter than a value digest")
+
+// KeyValue is a record to be reconciled by a KeyValueReconcile.
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// Changes classifies the keys of the records that differ between two sets.
+type Changes struct {
+	LocalOnly  [][]byte // Keys only present locally
+	RemoteOnly [][]byte // Keys only present remotely
+	Modified   [][]byte // Keys present on both sides with differing values
+}
+
+// KeyValueReconcile reconciles sets of records, detecting keys whose values
+// differ as well as keys missing from either side. Each record is stored in
+// the filters as a digest of its value followed by its key, so a record whose
+// value changed appears in the difference on both sides with the same key.
+//
+// Since the elements begin with the digest, the strata estimator spreads them
+// across its levels evenly however the keys are distributed.
+type KeyValueReconcile struct {
+	*Reconcile
+}
+
+// NewKeyValueReconcile creates a reconciler for records whose keys all have
+// the same length.
+func NewKeyValueReconcile(records []KeyValue, remotesetsize int, opts ...Option) *KeyValueReconcile {
+	return &KeyValueReconcile{NewReconcile(KeyValueElements(records, opts...), remotesetsize, opts...)}
+}
+
+// NewVariableKeyValueReconcile creates a reconciler for records whose keys
+// have any length up to `maxkeysize` bytes.
+func NewVariableKeyValueReconcile(records []KeyValue, maxkeysize, remotesetsize int, opts ...Option) *KeyValueReconcile {
+	return &KeyValueReconcile{
+		NewVariableReconcile(KeyValueElements(records, opts...), DigestSize+maxkeysize, remotesetsize, opts...),
+	}
+}
+
+// ValueDigest returns the digest of a record's value, computed with the hash
+// function and seed selected by the WithHasher and WithSeed options.
+func ValueDigest(value []byte, opts ...Option) []byte {
+	o := applyOptions(opts)
+	sum := o.hasher.Sum128(value, o.seed)
+	digest := make([]byte, 0, DigestSize)
+	for _, word := range sum {
+		digest = binary.LittleEndian.AppendUint32(digest, word)
+	}
+	return digest
+}
+
+// KeyValueElements returns the elements representing the records, which may
+// also be reconciled by a Session and classified with ClassifyChanges. The
+// options select the hash function of the value digests, and should be those
+// of the reconciler.
+func KeyValueElements(records []KeyValue, opts ...Option) [][]byte {
+	elements := make([][]byte, len(records))
+	for i, record := range records {
+		elements[i] = append(ValueDigest(record.Value, opts...), record.Key...)
+	}
+	return elements
+}
+
+// ClassifyChanges takes the elements only present locally and those only
+// present remotely, as decoded from records, and classifies their keys. It
+// returns ErrShortElement if an element is shorter than a value digest.
+func ClassifyChanges(local, remote [][]byte) (*Changes, error) {
+	for _, elements := range [][][]byte{local, remote} {
+		for _, element := range elements {
+			if len(element) < DigestSize {
+				return nil, ErrShortElement
+			}
+		}
+	}
+	changes := &Changes{}
+
+	remotekeys := make(map[string]struct{}, len(remote))
+	for _, element := range remote {
+		remotekeys[string(element[DigestSize:])] = struct{}{}
+	}
+
+	localkeys := make(map[string]struct{}, len(local))
+	for _, element := range local {
+		key := element[DigestSize:]
+		localkeys[string(key)] = struct{}{}
+		if _, ok := remotekeys[string(key)]; ok {
+			changes.Modified = append(changes.Modified, key)
+		} else {
+			changes.LocalOnly = append(changes.LocalOnly, key)
+		}
+	}
+
+	for _, element := range remote {
+		key := element[DigestSize:]
+		if _, ok := localkeys[string(key)]; !ok {
+			changes.RemoteOnly = append(changes.RemoteOnly, key)
+		}
+	}
+
+	return changes, nil
+}
+
+// GetChanges decodes the remote signature like GetDifference, and classifies
+// the keys of the records that differ. It returns false if the difference does
+// not decode or holds elements that are not records.
+func (r *KeyValueReconcile) GetChanges(size int, remotesignature []byte) (*Changes, bool) {
+	local, remote, ok := r.GetDifference(size, remotesignature)
+	if !ok {
+		return nil, false
+	}
+	changes, err := ClassifyChanges(local, remote)
+	return changes, err == nil
+}
+
+// Changes computes the difference like Difference, retrying per the retry
+// policy, and classifies the keys of the records that differ.
+func (r *KeyValueReconcile) Changes(size int, remote SignatureFunc) (*Changes, error) {
+	local, remoteonly, err := r.Difference(size, remote)
+	if err != nil {
+		return nil, err
+	}
+	return ClassifyChanges(local, remoteonly)
+}
@@ -0,0 +1,87 @@
+package reconcile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyValueReconcile(t *testing.T) {
+	keysize := 16
+	keys := makeRandomElements(200, keysize)
+	values := makeVariableElements(200, 100)
+
+	// The first 10 keys are only local, the next 8 only remote, the next 6
+	// have modified values, and the rest are identical.
+	localrecords := []KeyValue{}
+	remoterecords := []KeyValue{}
+	for i, key := range keys {
+		switch {
+		case i < 10:
+			localrecords = append(localrecords, KeyValue{key, values[i]})
+		case i < 18:
+			remoterecords = append(remoterecords, KeyValue{key, values[i]})
+		case i < 24:
+			localrecords = append(localrecords, KeyValue{key, values[i]})
+			remoterecords = append(remoterecords, KeyValue{key, append(values[i], 1)})
+		default:
+			localrecords = append(localrecords, KeyValue{key, values[i]})
+			remoterecords = append(remoterecords, KeyValue{key, values[i]})
+		}
+	}
+
+	reconcilers := []struct {
+		title         string
+		local, remote *KeyValueReconcile
+	}{
+		{"fixed",
+			NewKeyValueReconcile(localrecords, len(remoterecords)),
+			NewKeyValueReconcile(remoterecords, len(localrecords))},
+		{"variable",
+			NewVariableKeyValueReconcile(localrecords, keysize, len(remoterecords)),
+			NewVariableKeyValueReconcile(remoterecords, keysize, len(localrecords))},
+	}
+
+	for _, test := range reconcilers {
+		estimator, err := test.remote.GetDifferenceSizeEstimator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate, err := test.local.EstimateDifferenceSize(estimator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changes, err := test.local.Changes(estimate, test.remote.Signature)
+		if err != nil {
+			t.Errorf("For %s test got %v", test.title, err)
+			continue
+		}
+		if !sameElements(changes.LocalOnly, keys[:10]) {
+			t.Errorf("For %s test the local keys are incorrect", test.title)
+		}
+		if !sameElements(changes.RemoteOnly, keys[10:18]) {
+			t.Errorf("For %s test the remote keys are incorrect", test.title)
+		}
+		if !sameElements(changes.Modified, keys[18:24]) {
+			t.Errorf("For %s test the modified keys are incorrect", test.title)
+		}
+	}
+}
+
+func TestClassifyChangesShortElement(t *testing.T) {
+	elements := KeyValueElements([]KeyValue{{[]byte("key"), []byte("value")}})
+	if _, err := ClassifyChanges(elements, [][]byte{[]byte("short")}); err != ErrShortElement {
+		t.Errorf("Expected %v, got %v", ErrShortElement, err)
+	}
+}
+
+func TestValueDigestSeed(t *testing.T) {
+	value := []byte("value")
+	if bytes.Equal(ValueDigest(value), ValueDigest(value, WithSeed(1))) {
+		t.Error("The value digest does not depend on the seed")
+	}
+	elements := KeyValueElements([]KeyValue{{[]byte("key"), value}}, WithSeed(1))
+	if !bytes.Equal(elements[0][:DigestSize], ValueDigest(value, WithSeed(1))) {
+		t.Error("The element does not begin with the seeded value digest")
+	}
+}
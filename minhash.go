@@ -1,6 +1,10 @@
 package reconcile
 
-import "errors"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
 
 // ErrMinHashSize occurs when the signature lengths are different,
 // and so they cannot be compared.
@@ -18,16 +22,31 @@ var ErrMinHashSize = errors.New("Mismatched signature sizes")
 type MinHash struct {
 	signature []uint32
 	keycount  int
+	hasher    Hasher
+	seed      uint32
 }
 
+// MinHashSerialization is the JSON encoding of a MinHash.
+type MinHashSerialization struct {
+	Signature []uint32   `json:"signature"`
+	Keycount  int        `json:"keycount"`
+	Hash      HashScheme `json:"hash,omitempty"`
+	Seed      uint32     `json:"seed,omitempty"`
+}
+
+// minhashMagic begins the binary encoding of a MinHash.
+const minhashMagic = "MH"
+
 // NewMinHash creates a new MinHash structure and initializes the signature
-// required for the specified hashcount and keysize.
+// required for the specified hashcount. The hash function and its seed may be
+// selected with the WithHasher and WithSeed options.
 //
 // TODO: Consider b-bit Minwise Hashing https://arxiv.org/pdf/0910.3349.pdf
-func NewMinHash(hashcount int) *MinHash {
+func NewMinHash(hashcount int, opts ...Option) *MinHash {
 	// Initialise signature
 	signature := make([]uint32, hashcount)
-	return &MinHash{signature, 0}
+	o := applyOptions(opts)
+	return &MinHash{signature, 0, o.hasher, o.seed}
 }
 
 // Add updates the signature to include the desired key
@@ -37,7 +56,7 @@ func (mh *MinHash) Add(key []byte) {
 	for seed := 0; seed < hashcount; seed++ {
 		// TODO: XOR with pregenerated data instead of calling this hash
 		// function `hashcount` times.
-		sum := Sum128x32(key, uint32(seed))
+		sum := mh.hasher.Sum128(key, mh.seed+uint32(seed))
 		hash := sum[0]
 
 		// Take the maximum so we can rely on zero-initialization.
@@ -55,10 +74,16 @@ func (mh *MinHash) Similarity(remote *MinHash) (float64, error) {
 	matches := 0
 	total := len(mh.signature)
 
-	// Remote MinHash must have same signature size.
+	// Remote MinHash must have same signature size and hash function.
 	if len(remote.signature) != total {
 		return 0, ErrMinHashSize
 	}
+	if mh.hasher.Scheme() != remote.hasher.Scheme() {
+		return 0, ErrHasherMismatch
+	}
+	if mh.seed != remote.seed {
+		return 0, ErrSeedMismatch
+	}
 
 	// Count signature matches
 	for i := 0; i < total; i++ {
@@ -71,15 +96,22 @@ func (mh *MinHash) Similarity(remote *MinHash) (float64, error) {
 	return float64(matches) / float64(total), nil
 }
 
-// Estimate calculates the expected size of the set intersection.
+// Estimate calculates the expected size of the symmetric difference of the
+// sets, that is the number of keys present in only one of them.
 func (mh *MinHash) Estimate(remote *MinHash) (int, error) {
 	matches := 0
 	total := len(mh.signature)
 
-	// Remote MinHash must have same signature size.
+	// Remote MinHash must have same signature size and hash function.
 	if len(remote.signature) != total {
 		return 0, ErrMinHashSize
 	}
+	if mh.hasher.Scheme() != remote.hasher.Scheme() {
+		return 0, ErrHasherMismatch
+	}
+	if mh.seed != remote.seed {
+		return 0, ErrSeedMismatch
+	}
 
 	// Count signature matches
 	for i := 0; i < total; i++ {
@@ -93,9 +125,126 @@ func (mh *MinHash) Estimate(remote *MinHash) (int, error) {
 	// |A ∩ B| over |A| + |B| - |A ∩ B|
 	// which is estimated by matches / total.
 	//
-	// Solving for |A ∩ B| yields
+	// Solving for the size of the difference |A ∪ B| - |A ∩ B| yields
 	// (|A| + |B|) * (total - matches) / (total + matches)
 
 	keycountSum := mh.keycount + remote.keycount
 	return keycountSum * (total - matches) / (total + matches), nil
 }
+
+// MarshalJSON encodes the signature in the format documented by the
+// MinHashSerialization type. The hash scheme is omitted for the default.
+func (mh *MinHash) MarshalJSON() ([]byte, error) {
+	serialization := mh.getMinHash()
+	return json.Marshal(&serialization)
+}
+
+// UnmarshalJSON decodes the signature from the format documented by the
+// MinHashSerialization type.
+func (mh *MinHash) UnmarshalJSON(data []byte) error {
+	serialization := &MinHashSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	return mh.setMinHash(*serialization)
+}
+
+// getMinHash returns the values of the MinHash as they are serialized to JSON.
+func (mh *MinHash) getMinHash() MinHashSerialization {
+	var scheme HashScheme
+	if mh.hasher.Scheme() != HashMurmur3 {
+		scheme = mh.hasher.Scheme()
+	}
+	return MinHashSerialization{mh.signature, mh.keycount, scheme, mh.seed}
+}
+
+// setMinHash replaces the MinHash with the decoded values.
+func (mh *MinHash) setMinHash(serialization MinHashSerialization) error {
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	if len(serialization.Signature) < 1 || serialization.Keycount < 0 {
+		return ErrMalformed
+	}
+	*mh = MinHash{serialization.Signature, serialization.Keycount, hasher, serialization.Seed}
+	return nil
+}
+
+// MarshalBinary encodes the signature in a compact binary format. The header
+// holds the magic bytes "MH", a version byte, the hash scheme, a flags byte,
+// and the signature size as an unsigned varint, followed by the seed in 4
+// little-endian bytes if it is not zero. The key count follows as an unsigned
+// varint, and then each value of the signature in 4 little-endian bytes.
+func (mh *MinHash) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 16+4*len(mh.signature))
+	data = append(data, minhashMagic...)
+	data = append(data, binaryVersion, byte(mh.hasher.Scheme()), mh.flags())
+	data = binary.AppendUvarint(data, uint64(len(mh.signature)))
+	if mh.seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, mh.seed)
+	}
+	return mh.appendSignature(data), nil
+}
+
+// UnmarshalBinary decodes the signature from the format produced by
+// MarshalBinary.
+func (mh *MinHash) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(minhashMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^flagSeeded != 0 {
+		d.fail(ErrMalformed)
+	}
+	hashcount := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if hashcount < 1 {
+		return ErrMalformed
+	}
+	if !d.remaining(hashcount, 4) {
+		return d.err
+	}
+
+	decoded := NewMinHash(hashcount, WithHasher(hasher), WithSeed(seed))
+	decoded.readSignature(d)
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*mh = *decoded
+	return nil
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (mh *MinHash) flags() (flags byte) {
+	if mh.seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// appendSignature appends the key count and signature to `data`.
+func (mh *MinHash) appendSignature(data []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(mh.keycount))
+	for _, hash := range mh.signature {
+		data = binary.LittleEndian.AppendUint32(data, hash)
+	}
+	return data
+}
+
+// readSignature fills the key count and signature from the binary encoding
+// read by `d`. The caller checks with decoder.remaining that the input can hold
+// the signature.
+func (mh *MinHash) readSignature(d *decoder) {
+	mh.keycount = d.length()
+	for i := range mh.signature {
+		mh.signature[i] = d.uint32()
+	}
+}
@@ -2,6 +2,7 @@ package reconcile
 
 import (
 	"math"
+	"reflect"
 	"testing"
 )
 
@@ -65,3 +66,39 @@ func TestMinHash(t *testing.T) {
 		"expected between", countMin, "and", countMax,
 		"got", count)
 }
+
+func TestMinHashSerialization(t *testing.T) {
+	elements := makeRandomElements(50, 16)
+	for _, mh := range []*MinHash{NewMinHash(20), NewMinHash(20, WithSeed(9)), NewMinHash(20, WithHasher(fnvHasher{}))} {
+		for _, element := range elements {
+			mh.Add(element)
+		}
+
+		data, err := mh.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &MinHash{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mh, decoded) {
+			t.Error("Binary decoded MinHash does not match the original")
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+			t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+		}
+
+		data, err = mh.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = &MinHash{}
+		if err := decoded.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mh, decoded) {
+			t.Error("JSON decoded MinHash does not match the original")
+		}
+	}
+}
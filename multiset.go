@@ -0,0 +1,412 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrMultisetMismatch occurs when subtracting multiset filters of different
+// sizes or keysizes.
+var ErrMultisetMismatch = errors.New("Mismatched multiset filter parameters")
+
+// multisetChunk is the number of key bytes held by each field element of a
+// multiset key sum, so that every chunk is below the prime.
+const multisetChunk = 7
+
+// multisetMagic begins the binary encoding of a MultisetIBF.
+const multisetMagic = "MS"
+
+// MultisetIBF is an invertible bloom filter of a multiset, in which a key may
+// be inserted many times. An IBF sums its keys by XOR, so a key inserted twice
+// cancels itself while its count remains, and its cells never become pure.
+// Here the key sums are instead taken in the field of integers modulo the
+// prime 2^61-1, with each key split into chunks of 7 bytes, and every key is
+// added as many times as it is inserted. A cell holding copies of a single key
+// has a count of ±k and key sums that are k times the key, which are divided
+// by the count to recover it.
+//
+// The hash sums are likewise sums of the 32-bit hashes of the keys in the
+// field, so that a pure cell of count k has k times the hash of its key.
+// Multiplying by a count is invertible in the field, so the check is as strong
+// for many copies of a key as for one.
+//
+// Keys are all of the filter's keysize.
+type MultisetIBF struct {
+	Size     int
+	Keysize  int
+	Hashset  []uint64 // Hash sums, as field elements
+	Countset []int
+	Sumset   []uint64 // Key sums, one field element for each chunk of each cell
+	Hasher   Hasher   // Hash function placing keys; Murmur3 if nil
+	Seed     uint32   // Seed of the hash function
+}
+
+// MultisetSerialization is the JSON encoding of a MultisetIBF.
+type MultisetSerialization struct {
+	Size     int        `json:"size"`
+	Keysize  int        `json:"keysize"`
+	Hashset  []uint64   `json:"hashes"`
+	Countset []int      `json:"counts"`
+	Sumset   []uint64   `json:"sums"`
+	Hash     HashScheme `json:"hash,omitempty"`
+	Seed     uint32     `json:"seed,omitempty"`
+}
+
+// Multiplicity is a key decoded from a MultisetIBF with the difference in the
+// number of times it was inserted. A positive count is the number of extra
+// copies in the filter that was subtracted from, and a negative count the
+// number of extra copies in the subtrahend.
+type Multiplicity struct {
+	Key   []byte
+	Count int
+}
+
+// NewMultisetIBF creates a new multiset filter of the specified `size`, or
+// the number of cells to create, holding keys of `keysize` bytes. Each cell
+// takes 8 bytes for every 7 bytes of key, besides its hash sum and count. The
+// hash function and its seed may be selected with the WithHasher and WithSeed
+// options.
+func NewMultisetIBF(size, keysize int, opts ...Option) *MultisetIBF {
+	size = max(size, 1)
+	keysize = max(keysize, 1)
+	o := applyOptions(opts)
+	return &MultisetIBF{size, keysize, make([]uint64, size), make([]int, size),
+		make([]uint64, size*multisetChunks(keysize)), o.hasher, o.seed}
+}
+
+// chunks returns the number of field elements in the key sum of each cell.
+func (f *MultisetIBF) chunks() int {
+	return multisetChunks(f.Keysize)
+}
+
+// multisetChunks returns the number of field elements in a key sum of
+// `keysize` bytes.
+func multisetChunks(keysize int) int {
+	return (keysize + multisetChunk - 1) / multisetChunk
+}
+
+// Add inserts one copy of the key into the filter. If the key is not of the
+// proper length, this function returns an error.
+func (f *MultisetIBF) Add(key []byte) error {
+	return f.Update(key, 1)
+}
+
+// Remove removes one copy of the key from the filter. If the key is not of
+// the proper length, this function returns an error.
+func (f *MultisetIBF) Remove(key []byte) error {
+	return f.Update(key, -1)
+}
+
+// Update inserts `count` copies of the key into the filter, or removes them
+// if `count` is negative. If the key is not of the proper length, this
+// function returns an error.
+func (f *MultisetIBF) Update(key []byte, count int) error {
+	if len(key) != f.Keysize {
+		return fmt.Errorf("Update key '%s' of size %d to filter with key size of %d",
+			key, len(key), f.Keysize)
+	}
+
+	hashes := defaultHasher(f.Hasher).Sum128(key, f.Seed)
+	weight := multisetWeight(count)
+	chunks := f.chunks()
+	for _, index := range cellIndices(hashes[1:], f.Size) {
+		f.Hashset[index] = cpiAdd(f.Hashset[index], cpiMul(weight, uint64(hashes[0])))
+		f.Countset[index] += count
+		sums := f.Sumset[index*chunks : (index+1)*chunks]
+		for i := range sums {
+			sums[i] = cpiAdd(sums[i], cpiMul(weight, multisetElement(key, i)))
+		}
+	}
+	return nil
+}
+
+// Subtract performs the invertible bloom filter subtraction algorithm and
+// stores the result into this filter, whose cells then hold the difference in
+// the number of copies of each key. It returns ErrMultisetMismatch if the
+// filters differ in size or keysize, and an error if they differ in hash
+// function or seed.
+func (f *MultisetIBF) Subtract(subtrahend *MultisetIBF) error {
+	if f.Size != subtrahend.Size || f.Keysize != subtrahend.Keysize {
+		return ErrMultisetMismatch
+	}
+	if f.scheme() != subtrahend.scheme() {
+		return ErrHasherMismatch
+	}
+	if f.Seed != subtrahend.Seed {
+		return ErrSeedMismatch
+	}
+
+	for i := 0; i < f.Size; i++ {
+		f.Hashset[i] = cpiSub(f.Hashset[i], subtrahend.Hashset[i])
+		f.Countset[i] -= subtrahend.Countset[i]
+	}
+	for i, sum := range subtrahend.Sumset {
+		f.Sumset[i] = cpiSub(f.Sumset[i], sum)
+	}
+	return nil
+}
+
+// Clone returns a copy of the filter that shares no cells with it.
+func (f *MultisetIBF) Clone() *MultisetIBF {
+	clone := *f
+	clone.Hashset = append([]uint64{}, f.Hashset...)
+	clone.Countset = append([]int{}, f.Countset...)
+	clone.Sumset = append([]uint64{}, f.Sumset...)
+	return &clone
+}
+
+// IsPure returns true if the cell holds copies of a single key: its count is
+// not zero, its key sums divided by the count are a key, and its hash sum is
+// the count times the hash of that key.
+func (f *MultisetIBF) IsPure(index int) bool {
+	_, ok := f.pureKey(index)
+	return ok
+}
+
+// pureKey returns the key stored in the cell at the specified `index`, and
+// whether the cell is pure.
+func (f *MultisetIBF) pureKey(index int) ([]byte, bool) {
+	count := f.Countset[index]
+	if count == 0 {
+		return nil, false
+	}
+
+	inverse := cpiInverse(multisetWeight(count))
+	chunks := f.chunks()
+	key := make([]byte, f.Keysize)
+	for i, sum := range f.Sumset[index*chunks : (index+1)*chunks] {
+		element := cpiMul(sum, inverse)
+		chunk := key[i*multisetChunk : min((i+1)*multisetChunk, f.Keysize)]
+		if element>>(8*len(chunk)) != 0 {
+			return nil, false
+		}
+		for j := len(chunk) - 1; j >= 0; j-- {
+			chunk[j] = byte(element)
+			element >>= 8
+		}
+	}
+
+	hash := defaultHasher(f.Hasher).Sum128(key, f.Seed)[0]
+	if cpiMul(multisetWeight(count), uint64(hash)) != f.Hashset[index] {
+		return nil, false
+	}
+	return key, true
+}
+
+// Decode performs the decoding operation for this filter. Suppose this filter
+// is called `A`, and that we have called `A.Subtract(B)`. This function returns
+// each key whose number of copies differs between A and B, with the number of
+// copies in A less the number in B, and an indication of whether all the keys
+// have been properly decoded.
+//
+// The process of decoding changes the filter, as with IBF.Decode. Decode a
+// Clone to keep the filter.
+func (f *MultisetIBF) Decode() (keys []Multiplicity, ok bool) {
+	pureIndices := []int{}
+	for i := 0; i < f.Size; i++ {
+		if f.IsPure(i) {
+			pureIndices = append(pureIndices, i)
+		}
+	}
+
+	for len(pureIndices) > 0 {
+		index := pureIndices[len(pureIndices)-1]
+		pureIndices = pureIndices[:len(pureIndices)-1]
+
+		key, pure := f.pureKey(index)
+		if !pure {
+			continue
+		}
+		count := f.Countset[index]
+		keys = append(keys, Multiplicity{key, count})
+
+		// Remove every copy to uncover new pure cells
+		f.Update(key, -count)
+		hashes := defaultHasher(f.Hasher).Sum128(key, f.Seed)
+		for _, i := range cellIndices(hashes[1:], f.Size) {
+			if f.IsPure(i) {
+				pureIndices = append(pureIndices, i)
+			}
+		}
+	}
+
+	// Check for failure; we need an empty filter after decoding
+	for i := 0; i < f.Size; i++ {
+		if f.Hashset[i] != 0 || f.Countset[i] != 0 {
+			return
+		}
+	}
+	for _, sum := range f.Sumset {
+		if sum != 0 {
+			return
+		}
+	}
+
+	ok = true
+	return
+}
+
+// multisetWeight returns the count as a field element.
+func multisetWeight(count int) uint64 {
+	if count < 0 {
+		return cpiSub(0, uint64(-count)%cpiPrime)
+	}
+	return uint64(count) % cpiPrime
+}
+
+// multisetElement returns the i-th chunk of the key as a field element, taking
+// its bytes in big-endian order.
+func multisetElement(key []byte, i int) uint64 {
+	var element uint64
+	for _, b := range key[i*multisetChunk : min((i+1)*multisetChunk, len(key))] {
+		element = element<<8 | uint64(b)
+	}
+	return element
+}
+
+// scheme returns the identifier of the hash function of the filter.
+func (f *MultisetIBF) scheme() HashScheme {
+	return defaultHasher(f.Hasher).Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (f *MultisetIBF) flags() (flags byte) {
+	if f.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// MarshalJSON encodes the filter as documented by the MultisetSerialization
+// type.
+func (f *MultisetIBF) MarshalJSON() ([]byte, error) {
+	var scheme HashScheme
+	if f.scheme() != HashMurmur3 {
+		scheme = f.scheme()
+	}
+	return json.Marshal(&MultisetSerialization{f.Size, f.Keysize, f.Hashset, f.Countset, f.Sumset, scheme, f.Seed})
+}
+
+// UnmarshalJSON decodes the filter from the format produced by MarshalJSON.
+func (f *MultisetIBF) UnmarshalJSON(data []byte) error {
+	serialization := &MultisetSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	decoded := MultisetIBF{serialization.Size, serialization.Keysize, serialization.Hashset,
+		serialization.Countset, serialization.Sumset, hasher, serialization.Seed}
+	if !decoded.valid() {
+		return ErrMalformed
+	}
+	*f = decoded
+	return nil
+}
+
+// MarshalBinary encodes the filter in a compact binary format. The header
+// holds the magic bytes "MS", a version byte, the hash scheme, a flags byte,
+// the hash count, size and keysize as unsigned varints, and the seed in 4
+// little-endian bytes if it is not zero. Each cell then follows as its hash
+// sum in 8 little-endian bytes, its count as a zigzag varint, and each field
+// element of its key sum in 8 little-endian bytes.
+func (f *MultisetIBF) MarshalBinary() ([]byte, error) {
+	chunks := f.chunks()
+	data := make([]byte, 0, 16+f.Size*(8+2+8*chunks))
+	data = append(data, multisetMagic...)
+	data = append(data, binaryVersion, byte(f.scheme()), f.flags())
+	data = binary.AppendUvarint(data, ibfHashCount)
+	data = binary.AppendUvarint(data, uint64(f.Size))
+	data = binary.AppendUvarint(data, uint64(f.Keysize))
+	if f.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, f.Seed)
+	}
+	for i := 0; i < f.Size; i++ {
+		data = binary.LittleEndian.AppendUint64(data, f.Hashset[i])
+		data = binary.AppendVarint(data, int64(f.Countset[i]))
+		for _, sum := range f.Sumset[i*chunks : (i+1)*chunks] {
+			data = binary.LittleEndian.AppendUint64(data, sum)
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the filter from the format produced by
+// MarshalBinary.
+func (f *MultisetIBF) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(multisetMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^flagSeeded != 0 {
+		d.fail(ErrMalformed)
+	}
+	if d.err == nil && d.uvarint() != ibfHashCount {
+		d.fail(ErrHashCount)
+	}
+	size := d.length()
+	keysize := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if size < 1 || keysize < 1 {
+		return ErrMalformed
+	}
+	// Each cell takes at least 9 bytes plus the key sums
+	chunks := multisetChunks(keysize)
+	if !d.remaining(size, 9+8*chunks) {
+		return d.err
+	}
+
+	decoded := NewMultisetIBF(size, keysize, WithHasher(hasher), WithSeed(seed))
+	for i := 0; i < size; i++ {
+		if b := d.bytes(8); b != nil {
+			decoded.Hashset[i] = binary.LittleEndian.Uint64(b)
+		}
+		decoded.Countset[i] = int(d.varint())
+		for j := 0; j < chunks; j++ {
+			if b := d.bytes(8); b != nil {
+				decoded.Sumset[i*chunks+j] = binary.LittleEndian.Uint64(b)
+			}
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if !decoded.valid() {
+		return ErrMalformed
+	}
+
+	*f = *decoded
+	return nil
+}
+
+// valid returns true if the cell arrays agree with the size and keysize, and
+// every hash and key sum is a field element.
+func (f *MultisetIBF) valid() bool {
+	if f.Size < 1 || f.Keysize < 1 ||
+		len(f.Hashset) != f.Size ||
+		len(f.Countset) != f.Size ||
+		len(f.Sumset) != f.Size*f.chunks() {
+		return false
+	}
+	for _, sum := range f.Hashset {
+		if sum >= cpiPrime {
+			return false
+		}
+	}
+	for _, sum := range f.Sumset {
+		if sum >= cpiPrime {
+			return false
+		}
+	}
+	return true
+}
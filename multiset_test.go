@@ -0,0 +1,164 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMultisetIBF(t *testing.T) {
+	// Fixed keys, so that the filters decode the same way on every run
+	keysize := 20
+	keys := make([][]byte, 300)
+	for i := range keys {
+		keys[i] = binary.BigEndian.AppendUint64(make([]byte, keysize-8), uint64(i)*0x9e3779b97f4a7c15)
+	}
+
+	// The sets share every key, but the first 30 keys differ in multiplicity
+	a := NewMultisetIBF(128, keysize, WithSeed(3))
+	b := NewMultisetIBF(128, keysize, WithSeed(3))
+	expected := map[string]int{}
+	for i, key := range keys {
+		copiesA, copiesB := 1+i%3, 1+i%3
+		if i < 30 {
+			copiesA, copiesB = i%7, (i+2)%5
+		}
+		if err := a.Update(key, copiesA); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < copiesB; j++ {
+			if err := b.Add(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if copiesA != copiesB {
+			expected[string(key)] = copiesA - copiesB
+		}
+	}
+
+	difference := a.Clone()
+	if err := difference.Subtract(b); err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := difference.Decode()
+	if !ok {
+		t.Fatal("The difference did not decode")
+	}
+	if len(decoded) != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), len(decoded))
+	}
+	for _, m := range decoded {
+		if expected[string(m.Key)] != m.Count {
+			t.Errorf("Key %x has count %d, expected %d", m.Key, m.Count, expected[string(m.Key)])
+		}
+	}
+
+	// Removing the copies empties the filter
+	for _, m := range decoded {
+		if err := a.Update(m.Key, -m.Count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Subtract(b); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, ok := a.Decode(); !ok || len(decoded) != 0 {
+		t.Errorf("Expected an empty difference, got %d keys", len(decoded))
+	}
+
+	if err := a.Subtract(NewMultisetIBF(128, keysize+1, WithSeed(3))); err != ErrMultisetMismatch {
+		t.Errorf("Expected %v, got %v", ErrMultisetMismatch, err)
+	}
+	if err := a.Subtract(NewMultisetIBF(128, keysize)); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+	if err := a.Add(make([]byte, keysize-1)); err == nil {
+		t.Error("Added a key of the wrong size")
+	}
+}
+
+func TestMultisetIBFPure(t *testing.T) {
+	key := []byte("fourteen bytes")
+	f := NewMultisetIBF(10, len(key))
+	f.Update(key, 6)
+	for i := range f.Countset {
+		if f.Countset[i] != 0 && !f.IsPure(i) {
+			t.Errorf("Cell %d holding 6 copies is not pure", i)
+		}
+	}
+
+	// An IBF loses a key inserted an even number of times
+	g := NewIBF(10, len(key))
+	for i := 0; i < 6; i++ {
+		g.Add(key)
+	}
+	if _, _, ok := g.Clone().Decode(); ok {
+		t.Error("Decoded an IBF holding copies of a key")
+	}
+
+	f.Update(key, -9)
+	decoded, ok := f.Decode()
+	if !ok || len(decoded) != 1 || !bytes.Equal(decoded[0].Key, key) || decoded[0].Count != -3 {
+		t.Errorf("Expected 3 missing copies of the key, got %v", decoded)
+	}
+
+	// The hash sum is checked as strictly for many copies as for one
+	f = NewMultisetIBF(10, len(key))
+	f.Update(key, 1<<32)
+	for i := range f.Countset {
+		if f.Countset[i] == 0 {
+			continue
+		}
+		if !f.IsPure(i) {
+			t.Errorf("Cell %d holding 2^32 copies is not pure", i)
+		}
+		f.Hashset[i] = 0
+		if f.IsPure(i) {
+			t.Errorf("Cell %d with a wrong hash sum is pure", i)
+		}
+	}
+}
+
+func TestMultisetIBFSerialization(t *testing.T) {
+	f := NewMultisetIBF(12, 10, WithSeed(9))
+	for i, key := range makeRandomElements(20, 10) {
+		f.Update(key, i-10)
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &MultisetIBF{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, decoded) {
+		t.Error("Binary decoded filter does not match the original")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+		t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+	}
+
+	// A header declaring 1<<27 cells must be rejected before they are allocated
+	header := append([]byte(multisetMagic), binaryVersion, byte(HashMurmur3), 0, ibfHashCount, 0x80, 0x80, 0x80, 0x40, 1)
+	if err := decoded.UnmarshalBinary(header); err != ErrTruncated {
+		t.Errorf("Expected %v for a huge header, got %v", ErrTruncated, err)
+	}
+
+	data, err = f.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &MultisetIBF{}
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, decoded) {
+		t.Error("JSON decoded filter does not match the original")
+	}
+	if err := decoded.UnmarshalJSON([]byte(`{"size":1,"keysize":8,"hashes":[0],"counts":[0],"sums":[0]}`)); err != ErrMalformed {
+		t.Errorf("Expected %v for missing key sums, got %v", ErrMalformed, err)
+	}
+}
@@ -1,9 +1,5 @@
 package reconcile
 
-import (
-	"unsafe"
-)
-
 func fmix32(h uint32) uint32 {
 	h ^= h >> 16
 	h *= 0x85ebca6b
@@ -14,7 +10,8 @@ func fmix32(h uint32) uint32 {
 }
 
 // Sum128x32 computes the Murmur32 128-bit hash for the 32-bit platform.
-// It assumes a little-endian architecture.
+// Blocks are read as little-endian words whatever the byte order and alignment
+// of the platform, so every peer computes the same hashes.
 func Sum128x32(key []byte, seed uint32) [4]uint32 {
 	const c1 = 0x239b961b
 	const c2 = 0xab0e9789
@@ -26,15 +23,14 @@ func Sum128x32(key []byte, seed uint32) [4]uint32 {
 	size := len(key)
 	blocks := size / 16
 
-	head := *(*[]uint32)(unsafe.Pointer(&key))
 	tail := key[blocks*16:]
 
 	// Head
 	for i := 0; i < blocks; i++ {
-		k1 := head[i*4+0]
-		k2 := head[i*4+1]
-		k3 := head[i*4+2]
-		k4 := head[i*4+3]
+		k1 := load32(key, i*16+0)
+		k2 := load32(key, i*16+4)
+		k3 := load32(key, i*16+8)
+		k4 := load32(key, i*16+12)
 
 		k1 *= c1
 		k1 = (k1 << 15) | (k1 >> 17) // rotl32(k1, 15)
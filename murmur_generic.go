@@ -0,0 +1,12 @@
+//go:build !(386 || amd64 || arm64 || ppc64le)
+
+package reconcile
+
+import (
+	"encoding/binary"
+)
+
+// load32 reads the little-endian word at offset `i` of `key`.
+func load32(key []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(key[i:])
+}
@@ -0,0 +1,14 @@
+//go:build 386 || amd64 || arm64 || ppc64le
+
+package reconcile
+
+import (
+	"unsafe"
+)
+
+// load32 reads the little-endian word at offset `i` of `key`. These platforms
+// are little-endian and permit unaligned loads, so the word is read directly.
+func load32(key []byte, i int) uint32 {
+	_ = key[i+3] // Bounds check
+	return *(*uint32)(unsafe.Pointer(&key[i]))
+}
@@ -1,6 +1,7 @@
 package reconcile
 
 import (
+	"encoding/binary"
 	"testing"
 )
 
@@ -30,6 +31,21 @@ func TestSum128x32(t *testing.T) {
 			[]byte("This is 47 bytes so we can have a 15-byte tail."),
 			[...]uint32{0x373e6102, 0x3309e580, 0x5babab6c, 0x35d0b798},
 		},
+		{
+			"Match one byte",
+			[]byte("a"),
+			[...]uint32{0xa794933c, 0x5556b01b, 0x5556b01b, 0x5556b01b},
+		},
+		{
+			"Match with 11 byte tail",
+			[]byte("The quick brown fox jumps over the lazy dog"),
+			[...]uint32{0x2f1583c3, 0xecee2c67, 0x5d7bf66c, 0xe5e91d2c},
+		},
+		{
+			"Match bytes with high bits set",
+			[]byte("\x80\x81\xfe\xff\x00\x7f\xc0\x01\x02\x03\x04\x05\x06\x07\x08\x09\xaa\xbb\xcc"),
+			[...]uint32{0xe5ffef08, 0x5c0dd827, 0xb6a4702a, 0xbf123999},
+		},
 	}
 
 	for _, test := range tests {
@@ -42,3 +58,56 @@ func TestSum128x32(t *testing.T) {
 		}
 	}
 }
+
+func TestSum128x32Seed(t *testing.T) {
+	tests := []struct {
+		data []byte
+		seed uint32
+		out  [4]uint32
+	}{
+		{
+			[]byte("The quick brown fox jumps over the lazy dog"),
+			0x9747b28c,
+			[...]uint32{0x8ad4d55e, 0x4cb86171, 0x8ea73a9c, 0xcdb6793e},
+		},
+		{
+			[]byte("Hello, world!"),
+			1234,
+			[...]uint32{0xf9e74509, 0xc756c17b, 0x35feb7d9, 0x07d9cdff},
+		},
+	}
+
+	for _, test := range tests {
+		actual := Sum128x32(test.data, test.seed)
+		if actual != test.out {
+			t.Errorf("For %q with seed %#x expected %x, got %x", test.data, test.seed, test.out, actual)
+		}
+	}
+}
+
+func TestSum128x32Unaligned(t *testing.T) {
+	buffer := make([]byte, 64+3)
+	for i := range buffer {
+		buffer[i] = byte(i*7 + 1)
+	}
+
+	for offset := 0; offset < 4; offset++ {
+		for size := 0; size <= 64; size++ {
+			key := buffer[offset : offset+size]
+			aligned := append(make([]byte, 0, size), key...)
+			if Sum128x32(key, 1) != Sum128x32(aligned, 1) {
+				t.Fatalf("Hash of %d bytes at offset %d differs from aligned copy", size, offset)
+			}
+		}
+	}
+}
+
+func TestLoad32(t *testing.T) {
+	buffer := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	for i := 0; i+4 <= len(buffer); i++ {
+		expected := binary.LittleEndian.Uint32(buffer[i:])
+		if actual := load32(buffer, i); actual != expected {
+			t.Errorf("At offset %d expected %#08x, got %#08x", i, expected, actual)
+		}
+	}
+}
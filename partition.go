@@ -0,0 +1,301 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math/bits"
+)
+
+// partitionBits is the number of hash bits added to the prefix of a bucket
+// that fails to decode, splitting it into 16 buckets.
+const partitionBits = 4
+
+// partitionCells is the IBF size of each bucket used by PartitionDifference.
+const partitionCells = 64
+
+// maxPartitionBuckets bounds the number of buckets requested at once, and so
+// the size of a partition signature.
+const maxPartitionBuckets = 256
+
+// maxPartitionDepth bounds the prefix length of the first buckets.
+const maxPartitionDepth = 20
+
+// partitionSalt is mixed into the seed of the partition hash, so that it is
+// independent of the hashes placing keys in the cells of a bucket.
+const partitionSalt = 0x9e3779b9
+
+// partitionMagic begins the binary encoding of a partition signature.
+const partitionMagic = "PT"
+
+// Bucket identifies the keys whose partition hash begins with the `Depth` bits
+// of `Prefix`. The bucket of depth zero holds every key.
+type Bucket struct {
+	Depth  uint8
+	Prefix uint32
+}
+
+// valid returns true if the depth and prefix are within range.
+func (b Bucket) valid() bool {
+	return b.Depth <= 32 && (b.Depth == 32 || b.Prefix < 1<<b.Depth)
+}
+
+// Split returns the buckets that this bucket is divided into when it fails to
+// decode, or nil if it cannot be divided further.
+func (b Bucket) Split() []Bucket {
+	if b.Depth >= 32 {
+		return nil
+	}
+	split := uint8(partitionBits)
+	if b.Depth+split > 32 {
+		split = 32 - b.Depth
+	}
+
+	buckets := make([]Bucket, 1<<split)
+	for i := range buckets {
+		buckets[i] = Bucket{b.Depth + split, b.Prefix<<split | uint32(i)}
+	}
+	return buckets
+}
+
+// PartitionFunc obtains the remote partition signature for the buckets, with
+// an IBF of the given size for each, or the remote keyset signature when the
+// size is FullSet. The remote side produces it with PartitionSignature.
+type PartitionFunc func(buckets []Bucket, size int) ([]byte, error)
+
+// partitionHash returns the hash that assigns the key to buckets.
+func (r *Reconcile) partitionHash(key []byte) uint32 {
+	return defaultHasher(r.Hasher).Sum128(key, r.Seed^partitionSalt)[0]
+}
+
+// PartitionSignature returns the local signature requested by a remote
+// PartitionDifference call: the partition signature of the buckets, or the
+// keyset signature if the size is FullSet.
+func (r *Reconcile) PartitionSignature(buckets []Bucket, size int) ([]byte, error) {
+	if size == FullSet {
+		return r.GetKeysetSignature()
+	}
+	return r.GetPartitionSignature(buckets, size)
+}
+
+// GetPartitionSignature encodes an IBF of `size` cells for each bucket, holding
+// the local keys in that bucket. In the JSON format it is an array of IBF
+// encodings. The binary format holds the magic bytes "PT", a version byte, and
+// the number of buckets as an unsigned varint, followed by the binary encoding
+// of each IBF prefixed by its length as an unsigned varint.
+func (r *Reconcile) GetPartitionSignature(buckets []Bucket, size int) ([]byte, error) {
+	ibfs, err := r.partitionIBFs(buckets, size)
+	if err != nil {
+		return nil, err
+	}
+	if r.Format == FormatJSON {
+		return json.Marshal(ibfs)
+	}
+
+	encoded := make([][]byte, len(ibfs))
+	for i, ibf := range ibfs {
+		if encoded[i], err = ibf.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	data := append([]byte(partitionMagic), binaryVersion)
+	return appendKeys(data, encoded), nil
+}
+
+// GetPartitionDifference decodes the remote partition signature of the
+// buckets. It returns the keys only present locally and those only present
+// remotely in the buckets that decoded, and the buckets that did not.
+func (r *Reconcile) GetPartitionDifference(buckets []Bucket, size int, remotesignature []byte) (a [][]byte, b [][]byte, failed []Bucket, err error) {
+	remote, err := r.unmarshalPartition(remotesignature)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(remote) != len(buckets) {
+		return nil, nil, nil, ErrMalformed
+	}
+
+	local, err := r.partitionIBFs(buckets, size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, ibf := range local {
+		if err := ibf.Subtract(remote[i]); err != nil {
+			return nil, nil, nil, err
+		}
+		la, lb, ok := ibf.Decode()
+		if !ok {
+			failed = append(failed, buckets[i])
+			continue
+		}
+		a = append(a, la...)
+		b = append(b, lb...)
+	}
+	return a, b, failed, nil
+}
+
+// PartitionDifference computes the set difference by splitting the keys into
+// buckets by a prefix of their hash, and reconciling each bucket with its own
+// small IBF. Enough buckets are used at first for the estimated difference to
+// decode, and any bucket that fails is split into smaller buckets and tried
+// again, so that no signature grows with the size of the difference. The
+// remote signatures are obtained from `remote`.
+//
+// If a bucket cannot be split further, the full set is transferred if the
+// retry policy allows it, or else ErrDecodeFailed is returned.
+func (r *Reconcile) PartitionDifference(estimate int, remote PartitionFunc) (a [][]byte, b [][]byte, err error) {
+	// Each bucket should hold about half as many differences as cells
+	count := (2*estimate + partitionCells - 1) / partitionCells
+	depth := bits.Len(uint(count))
+	if depth > maxPartitionDepth {
+		depth = maxPartitionDepth
+	}
+	pending := make([]Bucket, 1<<depth)
+	for i := range pending {
+		pending[i] = Bucket{uint8(depth), uint32(i)}
+	}
+
+	for len(pending) > 0 {
+		batch := pending[:min(len(pending), maxPartitionBuckets)]
+		pending = pending[len(batch):]
+
+		signature, err := remote(batch, partitionCells)
+		if err != nil {
+			return nil, nil, err
+		}
+		la, lb, failed, err := r.GetPartitionDifference(batch, partitionCells, signature)
+		if err != nil {
+			return nil, nil, err
+		}
+		a = append(a, la...)
+		b = append(b, lb...)
+
+		for _, bucket := range failed {
+			split := bucket.Split()
+			if split == nil {
+				return r.partitionFallback(remote)
+			}
+			pending = append(pending, split...)
+		}
+	}
+	return a, b, nil
+}
+
+// partitionFallback transfers the full set if the retry policy allows it.
+func (r *Reconcile) partitionFallback(remote PartitionFunc) (a [][]byte, b [][]byte, err error) {
+	if !r.Retry.Fallback {
+		return nil, nil, ErrDecodeFailed
+	}
+	signature, err := remote(nil, FullSet)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.GetKeysetDifference(signature)
+}
+
+// bucketSeed returns the seed of the IBFs of buckets of the given depth. A key
+// whose cells coincide cannot be decoded from its IBF, so the seed changes with
+// the depth to place it in other cells once its bucket is split.
+func bucketSeed(seed uint32, depth uint8) uint32 {
+	return seed ^ uint32(depth)<<24
+}
+
+// partitionIBFs creates an IBF for each bucket holding the local keys in it,
+// with a single scan of the keys.
+func (r *Reconcile) partitionIBFs(buckets []Bucket, size int) ([]*IBF, error) {
+	if size < 1 || len(buckets)*size > maxBinaryLength/(r.Keysize+1) {
+		return nil, ErrMalformed
+	}
+
+	// Index the buckets by depth and prefix
+	depths := map[uint8]map[uint32]*IBF{}
+	ibfs := make([]*IBF, len(buckets))
+	for i, bucket := range buckets {
+		if !bucket.valid() {
+			return nil, ErrMalformed
+		}
+		if depths[bucket.Depth] == nil {
+			depths[bucket.Depth] = map[uint32]*IBF{}
+		}
+		ibfs[i] = r.newIBF(size)
+		ibfs[i].Seed = bucketSeed(r.Seed, bucket.Depth)
+		depths[bucket.Depth][bucket.Prefix] = ibfs[i]
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key := range r.keys() {
+		hash := r.partitionHash(key)
+		for depth, prefixes := range depths {
+			prefix := uint32(0)
+			if depth > 0 {
+				prefix = hash >> (32 - depth)
+			}
+			if ibf, ok := prefixes[prefix]; ok {
+				ibf.Add(key)
+			}
+		}
+	}
+	return ibfs, nil
+}
+
+// unmarshalPartition decodes the IBFs of a partition signature in the
+// configured format.
+func (r *Reconcile) unmarshalPartition(data []byte) ([]*IBF, error) {
+	if r.Format == FormatJSON {
+		ibfs := []*IBF{}
+		if err := json.Unmarshal(data, &ibfs); err != nil {
+			return nil, err
+		}
+		for _, ibf := range ibfs {
+			if ibf == nil {
+				return nil, ErrMalformed
+			}
+		}
+		return ibfs, nil
+	}
+
+	d := &decoder{data: data}
+	d.header(partitionMagic)
+	encoded := readKeys(d)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	ibfs := make([]*IBF, len(encoded))
+	for i, data := range encoded {
+		ibfs[i] = &IBF{}
+		if err := ibfs[i].UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	}
+	return ibfs, nil
+}
+
+// appendBuckets appends a list of buckets to `data`, each as its depth byte
+// and its prefix as an unsigned varint.
+func appendBuckets(data []byte, buckets []Bucket) []byte {
+	data = binary.AppendUvarint(data, uint64(len(buckets)))
+	for _, bucket := range buckets {
+		data = append(data, bucket.Depth)
+		data = binary.AppendUvarint(data, uint64(bucket.Prefix))
+	}
+	return data
+}
+
+// readBuckets reads a list of buckets encoded by appendBuckets.
+func readBuckets(d *decoder) []Bucket {
+	count := d.length()
+	if count > len(d.data) {
+		d.fail(ErrTruncated)
+		return nil
+	}
+	buckets := make([]Bucket, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		depth := d.byte()
+		prefix := d.uvarint()
+		bucket := Bucket{depth, uint32(prefix)}
+		if prefix > 1<<32-1 || !bucket.valid() {
+			d.fail(ErrMalformed)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
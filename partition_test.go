@@ -0,0 +1,104 @@
+package reconcile
+
+import (
+	"testing"
+)
+
+func TestPartitionDifference(t *testing.T) {
+	keysize := 32
+	localset, remoteset := NewTestSets(keysize, 500, 3000, 2000)
+	local := NewReconcile(localset, len(remoteset))
+	remote := NewReconcile(remoteset, len(localset))
+
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		local.Format = format
+		remote.Format = format
+
+		// An estimate of zero starts from a single bucket, which is split
+		for _, estimate := range []int{5000, 0} {
+			requests, largest := 0, 0
+			a, b, err := local.PartitionDifference(estimate, func(buckets []Bucket, size int) ([]byte, error) {
+				if len(buckets) > maxPartitionBuckets || size != partitionCells {
+					t.Errorf("Requested %d buckets of size %d", len(buckets), size)
+				}
+				requests++
+				signature, err := remote.PartitionSignature(buckets, size)
+				largest = max(largest, len(signature))
+				return signature, err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameElements(a, localset[500:]) || !sameElements(b, remoteset[500:]) {
+				t.Errorf("For format %d and estimate %d the difference is incorrect", format, estimate)
+			}
+			t.Logf("Format %d, estimate %d: %d requests, largest signature %d bytes",
+				format, estimate, requests, largest)
+		}
+	}
+
+	// The remote signature must cover the requested buckets
+	buckets := Bucket{}.Split()
+	signature, err := remote.GetPartitionSignature(buckets[:2], partitionCells)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := local.GetPartitionDifference(buckets, partitionCells, signature); err != ErrMalformed {
+		t.Errorf("Expected %v, got %v", ErrMalformed, err)
+	}
+	if _, err := remote.GetPartitionSignature([]Bucket{{4, 16}}, partitionCells); err != ErrMalformed {
+		t.Errorf("Expected %v for an invalid bucket, got %v", ErrMalformed, err)
+	}
+}
+
+func TestBucketSplit(t *testing.T) {
+	split := Bucket{4, 9}.Split()
+	if len(split) != 1<<partitionBits {
+		t.Fatalf("Expected %d buckets, got %d", 1<<partitionBits, len(split))
+	}
+	for i, bucket := range split {
+		if bucket != (Bucket{8, 9<<4 | uint32(i)}) {
+			t.Errorf("Unexpected bucket %v", bucket)
+		}
+	}
+	if split := (Bucket{30, 1}).Split(); len(split) != 4 || split[3] != (Bucket{32, 7}) {
+		t.Errorf("Unexpected split %v of the deepest buckets", split)
+	}
+	if split := (Bucket{32, 1}).Split(); split != nil {
+		t.Errorf("Expected no split at the full depth, got %v", split)
+	}
+}
+
+func TestPartitionedSession(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 100, 0, 0},
+		{"Small difference", 200, 5, 3},
+		{"Large difference", 100, 1500, 1200},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		initiator := NewSession(nil, Initiator, localset)
+		responder := NewSession(nil, Responder, remoteset)
+		initiator.Partitioned = true
+		responder.Partitioned = true
+
+		local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+		if localErr != nil || remoteErr != nil {
+			t.Errorf("For %s test got errors %v and %v", test.title, localErr, remoteErr)
+			continue
+		}
+		if !sameElements(local.Local, localset[test.match:]) ||
+			!sameElements(local.Remote, remoteset[test.match:]) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remote.Local, remoteset[test.match:]) ||
+			!sameElements(remote.Remote, localset[test.match:]) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+	}
+}
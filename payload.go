@@ -0,0 +1,161 @@
+package reconcile
+
+import "errors"
+
+// ErrValueTooLarge occurs when a value is too large to be sent in a message.
+var ErrValueTooLarge = errors.New("Value too large to send")
+
+// defaultBatchSize is the largest size of a batch of values sent by a Session
+// whose BatchSize is zero.
+const defaultBatchSize = 64 << 10
+
+// Store holds the values behind the keys of a Session, so that the session can
+// synchronize them along with the keys.
+type Store interface {
+	// Get returns the value of a local key.
+	Get(key []byte) ([]byte, error)
+
+	// Put stores the value of a key received from the peer.
+	Put(key, value []byte) error
+}
+
+// transfer exchanges the values of the difference after it is found. The
+// initiator sends first and the responder second, so that neither blocks
+// writing while the other is also writing. The initiator then acknowledges the
+// values it stored, so that the responder does not finish before learning
+// whether they were.
+func (s *Session) transfer(result *Result) error {
+	if s.Role == Initiator {
+		if err := s.sendValues(result.Local); err != nil {
+			return err
+		}
+		if err := s.receiveValues(result.Remote); err != nil {
+			return err
+		}
+		return s.send(msgPayloadAck, nil)
+	}
+	if err := s.receiveValues(result.Remote); err != nil {
+		return err
+	}
+	if err := s.sendValues(result.Local); err != nil {
+		return err
+	}
+	return s.receiveAck()
+}
+
+// sendValues sends the values of the keys in batches of at most BatchSize
+// bytes, unless a single value is larger, followed by the end of the values.
+func (s *Session) sendValues(keys [][]byte) error {
+	limit := s.BatchSize
+	if limit <= 0 {
+		limit = defaultBatchSize
+	}
+
+	var batch [][]byte
+	size := 0
+	for _, key := range keys {
+		value, err := s.Store.Get(key)
+		if err != nil {
+			return s.abort(err)
+		}
+		if len(key)+len(value) > maxMessageLength-32 {
+			return s.abort(ErrValueTooLarge)
+		}
+
+		if len(batch) > 0 && size+len(key)+len(value) > limit {
+			if err := s.send(msgPayload, appendKeys(nil, batch)); err != nil {
+				return err
+			}
+			batch, size = batch[:0], 0
+		}
+		batch = append(batch, key, value)
+		size += len(key) + len(value)
+	}
+	if len(batch) > 0 {
+		if err := s.send(msgPayload, appendKeys(nil, batch)); err != nil {
+			return err
+		}
+	}
+	return s.send(msgPayloadEnd, nil)
+}
+
+// receiveValues puts the values sent by the peer in the store, until the end
+// of the values. Each of the keys must be sent once, and no others.
+//
+// After an error the remaining batches are read and discarded, so that the
+// peer is not left blocked writing them, and the peer is then informed of the
+// error. The initiator receives it in place of the responder's values, and the
+// responder in place of the acknowledgement.
+func (s *Session) receiveValues(keys [][]byte) error {
+	pending := keySet(keys)
+	var failure error
+	for {
+		kind, data, err := s.receive()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case msgPayload:
+			if failure == nil {
+				failure = s.putValues(data, pending)
+			}
+
+		case msgPayloadEnd:
+			if failure == nil && len(pending) > 0 {
+				failure = ErrProtocol
+			}
+			if failure != nil {
+				return s.abort(failure)
+			}
+			return nil
+
+		case msgError:
+			return &RemoteError{string(data)}
+
+		default:
+			return s.abort(ErrProtocol)
+		}
+	}
+}
+
+// receiveAck waits for the initiator to acknowledge the values sent to it.
+func (s *Session) receiveAck() error {
+	kind, data, err := s.receive()
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case msgPayloadAck:
+		return nil
+	case msgError:
+		return &RemoteError{string(data)}
+	default:
+		return s.abort(ErrProtocol)
+	}
+}
+
+// putValues puts the values of a batch in the store, removing their keys from
+// those pending.
+func (s *Session) putValues(data []byte, pending map[string]bool) error {
+	d := &decoder{data: data}
+	batch := readKeys(d)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if len(batch)%2 != 0 {
+		return ErrMalformed
+	}
+	for i := 0; i < len(batch); i += 2 {
+		key, value := batch[i], batch[i+1]
+		if !pending[string(key)] {
+			return ErrProtocol
+		}
+		delete(pending, string(key))
+		if err := s.Store.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// mapStore is a Store holding values in a map.
+type mapStore map[string][]byte
+
+func (s mapStore) Get(key []byte) ([]byte, error) {
+	value, ok := s[string(key)]
+	if !ok {
+		return nil, errors.New("No value for key")
+	}
+	return value, nil
+}
+
+func (s mapStore) Put(key, value []byte) error {
+	s[string(key)] = value
+	return nil
+}
+
+// failingStore is a Store whose values cannot be put.
+type failingStore struct {
+	mapStore
+}
+
+func (s failingStore) Put(key, value []byte) error {
+	return errors.New("Store is read-only")
+}
+
+// newMapStore returns a store holding a value derived from each key.
+func newMapStore(keys [][]byte) mapStore {
+	s := mapStore{}
+	for _, key := range keys {
+		s[string(key)] = bytes.Repeat(key[:1], 1+int(key[1])%200)
+	}
+	return s
+}
+
+func TestSessionPayload(t *testing.T) {
+	keysize := 32
+	localset, remoteset := NewTestSets(keysize, 100, 40, 25)
+	localStore, remoteStore := newMapStore(localset), newMapStore(remoteset)
+	expected := newMapStore(append(append([][]byte{}, localset...), remoteset[100:]...))
+
+	initiator := NewSession(nil, Initiator, localset)
+	responder := NewSession(nil, Responder, remoteset)
+	initiator.Store = localStore
+	responder.Store = remoteStore
+	initiator.BatchSize = 256
+
+	local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+	if localErr != nil || remoteErr != nil {
+		t.Fatalf("Got errors %v and %v", localErr, remoteErr)
+	}
+	if !sameElements(local.Local, localset[100:]) || !sameElements(remote.Local, remoteset[100:]) {
+		t.Error("The difference is incorrect")
+	}
+	for name, store := range map[string]mapStore{"initiator": localStore, "responder": remoteStore} {
+		if len(store) != len(expected) {
+			t.Errorf("The %s holds %d values, expected %d", name, len(store), len(expected))
+		}
+		for key, value := range expected {
+			if !bytes.Equal(store[key], value) {
+				t.Errorf("The %s holds the wrong value for a key", name)
+				break
+			}
+		}
+	}
+}
+
+func TestSessionPayloadErrors(t *testing.T) {
+	localset, remoteset := NewTestSets(16, 50, 5, 5)
+
+	// Both peers must exchange values
+	initiator := NewSession(nil, Initiator, localset)
+	responder := NewSession(nil, Responder, remoteset)
+	initiator.Store = newMapStore(localset)
+	if _, _, localErr, remoteErr := runSessions(t, initiator, responder); localErr != ErrSessionMismatch || remoteErr != ErrSessionMismatch {
+		t.Errorf("Expected %v, got %v and %v", ErrSessionMismatch, localErr, remoteErr)
+	}
+
+	// A value missing from the initiator's store aborts both sessions
+	store := newMapStore(localset)
+	delete(store, string(localset[len(localset)-1]))
+	initiator = NewSession(nil, Initiator, localset)
+	responder = NewSession(nil, Responder, remoteset)
+	initiator.Store = store
+	responder.Store = newMapStore(remoteset)
+	_, _, localErr, remoteErr := runSessions(t, initiator, responder)
+	var remoteError *RemoteError
+	if localErr == nil || !errors.As(remoteErr, &remoteError) {
+		t.Errorf("Expected the initiator to fail and inform the responder, got %v and %v", localErr, remoteErr)
+	}
+
+	// A value missing from the responder's store aborts both sessions
+	store = newMapStore(remoteset)
+	delete(store, string(remoteset[len(remoteset)-1]))
+	initiator = NewSession(nil, Initiator, localset)
+	responder = NewSession(nil, Responder, remoteset)
+	initiator.Store = newMapStore(localset)
+	responder.Store = store
+	_, _, localErr, remoteErr = runSessions(t, initiator, responder)
+	if remoteErr == nil || !errors.As(localErr, &remoteError) {
+		t.Errorf("Expected the responder to fail and inform the initiator, got %v and %v", localErr, remoteErr)
+	}
+
+	// The responder learns that the initiator could not store its values,
+	// although it has nothing left to receive
+	initiator = NewSession(nil, Initiator, localset)
+	responder = NewSession(nil, Responder, remoteset)
+	initiator.Store = failingStore{newMapStore(localset)}
+	responder.Store = newMapStore(remoteset)
+	_, _, localErr, remoteErr = runSessions(t, initiator, responder)
+	if localErr == nil || !errors.As(remoteErr, &remoteError) {
+		t.Errorf("Expected the initiator to fail and inform the responder, got %v and %v", localErr, remoteErr)
+	}
+}
@@ -0,0 +1,618 @@
+package reconcile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/bits"
+)
+
+// ErrSketchKey occurs when a key cannot be held by a PinSketch: when it is
+// longer than the sketch's keysize, or when it is the zero key of 8 bytes.
+var ErrSketchKey = errors.New("Key cannot be held by the sketch")
+
+// ErrSketchMismatch occurs when sketches of different capacities or keysizes
+// are combined.
+var ErrSketchMismatch = errors.New("Mismatched sketch parameters")
+
+// pinSketchMaxKeysize is the largest key held by a PinSketch, since each key
+// is an element of GF(2^64).
+const pinSketchMaxKeysize = 8
+
+// gf64Reduction holds the low terms of the irreducible polynomial
+// x^64 + x^4 + x^3 + x + 1 defining GF(2^64).
+const gf64Reduction = 0x1b
+
+// pinSketchMagic begins the binary encoding of a PinSketch.
+const pinSketchMagic = "PS"
+
+// PinSketch is a BCH-based sketch of a set of keys of up to 8 bytes, each
+// taken as an element of GF(2^64). It holds the sums of the odd powers of the
+// elements, x, x^3, x^5, and so on, one for each unit of capacity. Since
+// addition in the field is XOR, combining the sketches of two sets gives the
+// sketch of their symmetric difference, which is always decoded if it holds
+// no more keys than the capacity. Unlike an IBF, each unit of capacity is a
+// single 8-byte sum and no cell collisions can make decoding fail.
+//
+// Keys shorter than 8 bytes have a bit set above their last byte, so that the
+// zero key is held and, with variable-length keys, the length is recovered.
+// Variable-length keys are therefore at most 7 bytes.
+//
+// Y. Dodis, R. Ostrovsky, L. Reyzin, and A. Smith. Fuzzy extractors: How to
+// generate strong keys from biometrics and other noisy data. SIAM Journal on
+// Computing, 38(1):97–139, 2008.
+type PinSketch struct {
+	Syndromes []uint64 // Sum of the (2i+1)-th powers of the elements
+	Keysize   int
+	Variable  bool // Whether keys may be shorter than Keysize
+}
+
+// PinSketchSerialization is the JSON encoding of a PinSketch.
+type PinSketchSerialization struct {
+	Keysize   int      `json:"keysize"`
+	Variable  bool     `json:"variable,omitempty"`
+	Syndromes []uint64 `json:"syndromes"`
+}
+
+// NewPinSketch creates an empty sketch able to decode a difference of up to
+// `capacity` keys of `keysize` bytes, at most 8.
+func NewPinSketch(capacity, keysize int) *PinSketch {
+	capacity = max(capacity, 1)
+	keysize = min(max(keysize, 1), pinSketchMaxKeysize)
+	return &PinSketch{make([]uint64, capacity), keysize, false}
+}
+
+// NewVariablePinSketch creates an empty sketch like NewPinSketch, but which
+// accepts keys of any length up to `maxkeysize` bytes, at most 7.
+func NewVariablePinSketch(capacity, maxkeysize int) *PinSketch {
+	s := NewPinSketch(capacity, min(maxkeysize, pinSketchMaxKeysize-1))
+	s.Variable = true
+	return s
+}
+
+// Capacity returns the largest difference the sketch can decode.
+func (s *PinSketch) Capacity() int {
+	return len(s.Syndromes)
+}
+
+// Add toggles the key in the sketch: adding a key a second time removes it.
+// It returns ErrSketchKey if the key cannot be held.
+func (s *PinSketch) Add(key []byte) error {
+	x, err := s.element(key)
+	if err != nil {
+		return err
+	}
+
+	// Each odd power is the previous one times x^2
+	power := newGF64Multiplier(gf64Mul(x, x))
+	for i := range s.Syndromes {
+		s.Syndromes[i] ^= x
+		x = power.mul(x)
+	}
+	return nil
+}
+
+// Merge combines the remote sketch into this one, which then holds the
+// symmetric difference of the sets.
+func (s *PinSketch) Merge(remote *PinSketch) error {
+	if len(s.Syndromes) != len(remote.Syndromes) || s.Keysize != remote.Keysize ||
+		s.Variable != remote.Variable {
+		return ErrSketchMismatch
+	}
+	for i, syndrome := range remote.Syndromes {
+		s.Syndromes[i] ^= syndrome
+	}
+	return nil
+}
+
+// Decode returns the keys held by the sketch, usually the symmetric
+// difference of two merged sketches. It returns false if there are more keys
+// than the capacity allows.
+func (s *PinSketch) Decode() ([][]byte, bool) {
+	// The even power sums are the squares of the odd ones: s_2i = s_i^2
+	capacity := len(s.Syndromes)
+	sums := make([]uint64, 2*capacity)
+	for i := range sums {
+		if i%2 == 0 {
+			sums[i] = s.Syndromes[i/2]
+		} else {
+			half := sums[i/2]
+			sums[i] = gf64Mul(half, half)
+		}
+	}
+
+	// The locator polynomial has the inverses of the elements as its roots,
+	// so its reverse has the elements themselves
+	locator := berlekampMassey(sums)
+	degree := len(locator) - 1
+	if degree > capacity || locator[degree] == 0 {
+		return nil, false
+	}
+	if degree == 0 {
+		return [][]byte{}, true
+	}
+	reversed := make(gf64Poly, degree+1)
+	for i, coefficient := range locator {
+		reversed[degree-i] = coefficient
+	}
+	monic := reversed.monic()
+
+	roots, ok := monic.roots()
+	if !ok {
+		return nil, false
+	}
+	keys := make([][]byte, 0, len(roots))
+	for _, root := range roots {
+		key, ok := s.key(root)
+		if !ok {
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// element maps the key to a nonzero field element.
+func (s *PinSketch) element(key []byte) (uint64, error) {
+	if len(key) > s.Keysize || (len(key) != s.Keysize && !s.Variable) {
+		return 0, ErrSketchKey
+	}
+	padded := make([]byte, 8)
+	copy(padded, key)
+	x := binary.LittleEndian.Uint64(padded)
+	if len(key) < pinSketchMaxKeysize {
+		x |= 1 << (8 * len(key))
+	}
+	if x == 0 {
+		return 0, ErrSketchKey
+	}
+	return x, nil
+}
+
+// key maps a decoded field element back to its key, and returns false if no
+// key is mapped to it.
+func (s *PinSketch) key(x uint64) ([]byte, bool) {
+	length := pinSketchMaxKeysize
+	if s.Keysize < pinSketchMaxKeysize {
+		// Find the length from the bit set above the last byte
+		top := bits.Len64(x) - 1
+		if top%8 != 0 {
+			return nil, false
+		}
+		length = top / 8
+		x &^= 1 << top
+	}
+	if length > s.Keysize || (length != s.Keysize && !s.Variable) {
+		return nil, false
+	}
+	return binary.LittleEndian.AppendUint64(nil, x)[:length], true
+}
+
+// MarshalJSON encodes the sketch as documented by the PinSketchSerialization
+// type.
+func (s *PinSketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&PinSketchSerialization{s.Keysize, s.Variable, s.Syndromes})
+}
+
+// UnmarshalJSON decodes the sketch from the format produced by MarshalJSON.
+func (s *PinSketch) UnmarshalJSON(data []byte) error {
+	serialization := &PinSketchSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	if !validSketch(len(serialization.Syndromes), serialization.Keysize, serialization.Variable) {
+		return ErrMalformed
+	}
+	*s = PinSketch{serialization.Syndromes, serialization.Keysize, serialization.Variable}
+	return nil
+}
+
+// MarshalBinary encodes the sketch in a compact binary format. The header
+// holds the magic bytes "PS", a version byte, a flags byte, and the keysize
+// and capacity as unsigned varints. Keys are not hashed, so no hash scheme or
+// seed is recorded. Each sum then follows in 8 little-endian bytes.
+func (s *PinSketch) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 8+8*len(s.Syndromes))
+	data = append(data, pinSketchMagic...)
+	data = append(data, binaryVersion, s.flags())
+	data = binary.AppendUvarint(data, uint64(s.Keysize))
+	data = binary.AppendUvarint(data, uint64(len(s.Syndromes)))
+	for _, syndrome := range s.Syndromes {
+		data = binary.LittleEndian.AppendUint64(data, syndrome)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the sketch from the format produced by
+// MarshalBinary.
+func (s *PinSketch) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(pinSketchMagic)
+	flags := d.byte()
+	if flags&^flagVariable != 0 {
+		d.fail(ErrMalformed)
+	}
+	keysize := d.length()
+	capacity := d.length()
+	if d.err != nil {
+		return d.err
+	}
+	variable := flags&flagVariable != 0
+	if !validSketch(capacity, keysize, variable) {
+		return ErrMalformed
+	}
+	if len(d.data) < 8*capacity {
+		return ErrTruncated
+	}
+
+	syndromes := make([]uint64, capacity)
+	for i := range syndromes {
+		syndromes[i] = binary.LittleEndian.Uint64(d.bytes(8))
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*s = PinSketch{syndromes, keysize, variable}
+	return nil
+}
+
+// validSketch returns true if a sketch may have the given parameters.
+func validSketch(capacity, keysize int, variable bool) bool {
+	maxkeysize := pinSketchMaxKeysize
+	if variable {
+		maxkeysize--
+	}
+	return capacity >= 1 && keysize >= 1 && keysize <= maxkeysize
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (s *PinSketch) flags() (flags byte) {
+	if s.Variable {
+		flags |= flagVariable
+	}
+	return flags
+}
+
+// WithPinSketch makes a Reconcile exchange PinSketches in place of IBFs, with
+// the size of a signature being the capacity of the sketch. Both peers must
+// use it. It is ignored for keys longer than 8 bytes, or variable-length keys
+// longer than 7 bytes, which the PinSketch cannot hold.
+func WithPinSketch() Option {
+	return func(o *options) {
+		o.sketch = true
+	}
+}
+
+// newSketch creates an empty sketch suitable for the local keys.
+func (r *Reconcile) newSketch(capacity int) *PinSketch {
+	if r.Variable {
+		return NewVariablePinSketch(capacity, r.Keysize)
+	}
+	return NewPinSketch(capacity, r.Keysize)
+}
+
+// getSketchSignature encodes a sketch of the local keys with the given
+// capacity in the configured format.
+func (r *Reconcile) getSketchSignature(capacity int) ([]byte, error) {
+	sketch, err := r.localSketch(capacity)
+	if err != nil {
+		return nil, err
+	}
+	if r.Format == FormatJSON {
+		return sketch.MarshalJSON()
+	}
+	return sketch.MarshalBinary()
+}
+
+// sketchDifference decodes the difference from a remote sketch, returning
+// errors like Reconcile.difference. The sketch only yields the symmetric
+// difference, so the keys are told apart by scanning the local keys.
+func (r *Reconcile) sketchDifference(capacity int, remotesignature []byte) (a [][]byte, b [][]byte, err error) {
+	remote := &PinSketch{}
+	if r.Format == FormatJSON {
+		err = remote.UnmarshalJSON(remotesignature)
+	} else {
+		err = remote.UnmarshalBinary(remotesignature)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sketch, err := r.localSketch(capacity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sketch.Merge(remote); err != nil {
+		return nil, nil, err
+	}
+	keys, ok := sketch.Decode()
+	if !ok {
+		return nil, nil, ErrDecodeFailed
+	}
+
+	local := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		local[string(key)] = false
+	}
+	r.mu.RLock()
+	for key := range r.keys() {
+		if _, ok := local[string(key)]; ok {
+			local[string(key)] = true
+		}
+	}
+	r.mu.RUnlock()
+
+	a, b = [][]byte{}, [][]byte{}
+	for _, key := range keys {
+		if local[string(key)] {
+			a = append(a, key)
+		} else {
+			b = append(b, key)
+		}
+	}
+	return a, b, nil
+}
+
+// localSketch creates a sketch of the local keys.
+func (r *Reconcile) localSketch(capacity int) (*PinSketch, error) {
+	sketch := r.newSketch(capacity)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key := range r.keys() {
+		if err := sketch.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return sketch, nil
+}
+
+// gf64Mul returns the product of two elements of GF(2^64).
+func gf64Mul(a, b uint64) uint64 {
+	product := uint64(0)
+	for ; b != 0; b >>= 1 {
+		product ^= a & -(b & 1)
+		a = a<<1 ^ gf64Reduction&-(a>>63)
+	}
+	return product
+}
+
+// gf64Inverse returns the multiplicative inverse of a nonzero element, which
+// is its (2^64-2)-th power.
+func gf64Inverse(a uint64) uint64 {
+	result := uint64(1)
+	for i := 0; i < 63; i++ {
+		a = gf64Mul(a, a)
+		result = gf64Mul(result, a)
+	}
+	return result
+}
+
+// gf64Multiplier multiplies by a fixed element using tables of its products
+// with each 4-bit digit at each position, which is faster than gf64Mul when
+// the same element is used many times.
+type gf64Multiplier [16][16]uint64
+
+// newGF64Multiplier creates the tables for multiplying by `b`.
+func newGF64Multiplier(b uint64) *gf64Multiplier {
+	m := &gf64Multiplier{}
+	for position := range m {
+		// Products with the four bits of this digit
+		var shifted [4]uint64
+		for i := range shifted {
+			shifted[i] = b
+			b = b<<1 ^ gf64Reduction&-(b>>63)
+		}
+		for digit := 1; digit < 16; digit++ {
+			low := bits.TrailingZeros(uint(digit))
+			m[position][digit] = m[position][digit&(digit-1)] ^ shifted[low]
+		}
+	}
+	return m
+}
+
+// mul returns the product of `a` and the fixed element.
+func (m *gf64Multiplier) mul(a uint64) uint64 {
+	product := uint64(0)
+	for position := range m {
+		product ^= m[position][a>>(4*position)&15]
+	}
+	return product
+}
+
+// berlekampMassey returns the shortest linear feedback shift register
+// generating the power sums, which is the locator polynomial whose roots are
+// the inverses of the elements summed.
+func berlekampMassey(sums []uint64) gf64Poly {
+	current := gf64Poly{1}
+	previous := gf64Poly{1}
+	length, shift, last := 0, 1, uint64(1)
+	for n, sum := range sums {
+		discrepancy := sum
+		for i := 1; i <= length && i < len(current); i++ {
+			discrepancy ^= gf64Mul(current[i], sums[n-i])
+		}
+		if discrepancy == 0 {
+			shift++
+			continue
+		}
+
+		coefficient := gf64Mul(discrepancy, gf64Inverse(last))
+		saved := append(gf64Poly{}, current...)
+		for len(current) < len(previous)+shift {
+			current = append(current, 0)
+		}
+		for i, term := range previous {
+			current[i+shift] ^= gf64Mul(coefficient, term)
+		}
+		if 2*length <= n {
+			length = n + 1 - length
+			previous, last, shift = saved, discrepancy, 1
+		} else {
+			shift++
+		}
+	}
+
+	for len(current) < length+1 {
+		current = append(current, 0)
+	}
+	return current[:length+1]
+}
+
+// gf64Poly is a polynomial over GF(2^64), with coefficients from the constant
+// term upward.
+type gf64Poly []uint64
+
+// trim removes leading zero coefficients.
+func (p gf64Poly) trim() gf64Poly {
+	for len(p) > 0 && p[len(p)-1] == 0 {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// monic returns the polynomial divided by its leading coefficient.
+func (p gf64Poly) monic() gf64Poly {
+	p = p.trim()
+	inverse := gf64Inverse(p[len(p)-1])
+	monic := make(gf64Poly, len(p))
+	for i, coefficient := range p {
+		monic[i] = gf64Mul(coefficient, inverse)
+	}
+	return monic
+}
+
+// divide returns the quotient and remainder of dividing by a monic
+// polynomial.
+func (p gf64Poly) divide(divisor gf64Poly) (quotient, remainder gf64Poly) {
+	remainder = append(gf64Poly{}, p...).trim()
+	degree := len(divisor) - 1
+	if len(remainder) <= degree {
+		return gf64Poly{}, remainder
+	}
+	quotient = make(gf64Poly, len(remainder)-degree)
+	for i := len(quotient) - 1; i >= 0; i-- {
+		factor := remainder[i+degree]
+		quotient[i] = factor
+		if factor == 0 {
+			continue
+		}
+		for j, coefficient := range divisor {
+			remainder[i+j] ^= gf64Mul(factor, coefficient)
+		}
+	}
+	return quotient, remainder.trim()
+}
+
+// gf64Modulus reduces polynomials modulo a monic polynomial, using a
+// multiplier for each of its coefficients since it is used many times.
+type gf64Modulus struct {
+	poly        gf64Poly
+	multipliers []*gf64Multiplier
+}
+
+// newGF64Modulus creates the multipliers for reducing modulo `p`.
+func newGF64Modulus(p gf64Poly) *gf64Modulus {
+	multipliers := make([]*gf64Multiplier, len(p)-1)
+	for i := range multipliers {
+		multipliers[i] = newGF64Multiplier(p[i])
+	}
+	return &gf64Modulus{p, multipliers}
+}
+
+// reduce returns the remainder of the polynomial, which it overwrites.
+func (m *gf64Modulus) reduce(p gf64Poly) gf64Poly {
+	degree := len(m.poly) - 1
+	for i := len(p) - 1; i >= degree; i-- {
+		factor := p[i]
+		p[i] = 0
+		if factor == 0 {
+			continue
+		}
+		for j, multiplier := range m.multipliers {
+			p[i-degree+j] ^= multiplier.mul(factor)
+		}
+	}
+	return p.trim()
+}
+
+// square returns the square of the polynomial modulo the modulus. Squaring is
+// linear in characteristic 2, so each coefficient is squared in place of the
+// even power.
+func (m *gf64Modulus) square(p gf64Poly) gf64Poly {
+	square := make(gf64Poly, 2*len(p))
+	for i, coefficient := range p {
+		square[2*i] = gf64Mul(coefficient, coefficient)
+	}
+	return m.reduce(square)
+}
+
+// gcd returns the monic greatest common divisor of the polynomial and a
+// monic polynomial.
+func (p gf64Poly) gcd(q gf64Poly) gf64Poly {
+	a, b := q, p.trim()
+	for len(b) > 0 {
+		b = b.monic()
+		_, remainder := a.divide(b)
+		a, b = b, remainder
+	}
+	return a
+}
+
+// roots returns the roots of a monic polynomial, and false unless it is the
+// product of distinct linear factors.
+func (p gf64Poly) roots() ([]uint64, bool) {
+	// The polynomial splits into distinct linear factors exactly when it
+	// divides z^(2^64) - z
+	modulus := newGF64Modulus(p)
+	reduced := modulus.reduce(gf64Poly{0, 1})
+	power := reduced
+	for i := 0; i < 64; i++ {
+		power = modulus.square(power)
+	}
+	if len(power) != len(reduced) {
+		return nil, false
+	}
+	for i := range power {
+		if power[i] != reduced[i] {
+			return nil, false
+		}
+	}
+
+	roots := make([]uint64, 0, len(p)-1)
+	return p.split(roots, 1), true
+}
+
+// split appends the roots of a monic polynomial with distinct roots, found
+// with Berlekamp's trace algorithm. The trace of βz, the sum of its 64
+// squarings, is 0 or 1 at each root, so its greatest common divisor with the
+// polynomial holds about half of the factors. `beta` is varied pseudorandomly
+// until the factors are separated.
+func (p gf64Poly) split(roots []uint64, beta uint64) []uint64 {
+	if len(p) == 2 {
+		// z + c has the root c
+		return append(roots, p[0])
+	}
+
+	modulus := newGF64Modulus(p)
+	for ; ; beta = beta*0x9e3779b97f4a7c15 + 1 {
+		term := modulus.reduce(gf64Poly{0, beta})
+		trace := append(gf64Poly{}, term...)
+		for i := 1; i < 64; i++ {
+			term = modulus.square(term)
+			for len(trace) < len(term) {
+				trace = append(trace, 0)
+			}
+			for j, coefficient := range term {
+				trace[j] ^= coefficient
+			}
+		}
+
+		factor := trace.gcd(p)
+		if degree := len(factor) - 1; degree > 0 && degree < len(p)-1 {
+			quotient, _ := p.divide(factor)
+			roots = factor.split(roots, beta+1)
+			return quotient.split(roots, beta+2)
+		}
+	}
+}
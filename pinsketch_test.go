@@ -0,0 +1,201 @@
+package reconcile
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestGF64(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		a, b := rand.Uint64(), rand.Uint64()
+		if a == 0 {
+			continue
+		}
+		if got := gf64Mul(a, gf64Inverse(a)); got != 1 {
+			t.Fatalf("%#x times its inverse is %#x", a, got)
+		}
+		if gf64Mul(a, b) != gf64Mul(b, a) {
+			t.Fatalf("Multiplication of %#x and %#x does not commute", a, b)
+		}
+		if got, want := newGF64Multiplier(b).mul(a), gf64Mul(a, b); got != want {
+			t.Fatalf("Table product of %#x and %#x is %#x, expected %#x", a, b, got, want)
+		}
+	}
+
+	// z^63 * z = z^64 = z^4 + z^3 + z + 1
+	if got := gf64Mul(1<<63, 2); got != gf64Reduction {
+		t.Errorf("Expected the reduction %#x, got %#x", gf64Reduction, got)
+	}
+}
+
+func TestPinSketch(t *testing.T) {
+	keysize := 8
+	tests := []struct {
+		title            string
+		capacity         int
+		uniquea, uniqueb int
+	}{
+		{"Identical sets", 4, 0, 0},
+		{"Single key", 1, 1, 0},
+		{"Full capacity", 10, 6, 4},
+		{"Only remote keys", 20, 0, 13},
+		{"Large capacity", 64, 30, 30},
+	}
+
+	for _, test := range tests {
+		// The difference decodes with certainty, so try many sets
+		for trial := 0; trial < 20; trial++ {
+			a, b := NewTestSets(keysize, 50, test.uniquea, test.uniqueb)
+			sketchA := NewPinSketch(test.capacity, keysize)
+			sketchB := NewPinSketch(test.capacity, keysize)
+			for _, key := range a {
+				if err := sketchA.Add(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, key := range b {
+				if err := sketchB.Add(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sketchA.Merge(sketchB); err != nil {
+				t.Fatal(err)
+			}
+			keys, ok := sketchA.Decode()
+			if !ok {
+				t.Fatalf("For %s test the sketch did not decode", test.title)
+			}
+			if !sameElements(keys, append(append([][]byte{}, a[50:]...), b[50:]...)) {
+				t.Fatalf("For %s test the decoded keys are incorrect", test.title)
+			}
+		}
+	}
+
+	// A difference larger than the capacity is detected
+	a, b := NewTestSets(keysize, 50, 10, 10)
+	sketchA := NewPinSketch(12, keysize)
+	for _, key := range append(a[50:], b[50:]...) {
+		sketchA.Add(key)
+	}
+	if _, ok := sketchA.Decode(); ok {
+		t.Error("Decoded a difference larger than the capacity")
+	}
+
+	if err := sketchA.Merge(NewPinSketch(13, keysize)); err != ErrSketchMismatch {
+		t.Errorf("Expected %v, got %v", ErrSketchMismatch, err)
+	}
+	if err := sketchA.Add(make([]byte, keysize)); err != ErrSketchKey {
+		t.Errorf("Expected %v for the zero key, got %v", ErrSketchKey, err)
+	}
+	if err := sketchA.Add(make([]byte, 4)); err != ErrSketchKey {
+		t.Errorf("Expected %v for a short key, got %v", ErrSketchKey, err)
+	}
+}
+
+func TestVariablePinSketch(t *testing.T) {
+	keys := [][]byte{{}, {0}, {0, 0}, {1, 2, 3}, {255, 255, 255, 255, 255, 255, 255}}
+	sketch := NewVariablePinSketch(len(keys), 7)
+	for _, key := range keys {
+		if err := sketch.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoded, ok := sketch.Decode()
+	if !ok || !sameElements(decoded, keys) {
+		t.Errorf("Expected %v, got %v", keys, decoded)
+	}
+
+	// Adding a key again removes it
+	sketch.Add(keys[0])
+	decoded, ok = sketch.Decode()
+	if !ok || !sameElements(decoded, keys[1:]) {
+		t.Errorf("Expected %v, got %v", keys[1:], decoded)
+	}
+	if err := sketch.Add(make([]byte, 8)); err != ErrSketchKey {
+		t.Errorf("Expected %v for a long key, got %v", ErrSketchKey, err)
+	}
+}
+
+func TestPinSketchSerialization(t *testing.T) {
+	sketch := NewVariablePinSketch(16, 6)
+	for _, key := range makeVariableElements(30, 6) {
+		sketch.Add(key)
+	}
+
+	data, err := sketch.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &PinSketch{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sketch, decoded) {
+		t.Error("Binary decoded sketch does not match the original")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrTruncated {
+		t.Errorf("Expected %v for truncated data, got %v", ErrTruncated, err)
+	}
+
+	data, err = sketch.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = &PinSketch{}
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sketch, decoded) {
+		t.Error("JSON decoded sketch does not match the original")
+	}
+	if err := decoded.UnmarshalJSON([]byte(`{"keysize":8,"variable":true,"syndromes":[1]}`)); err != ErrMalformed {
+		t.Errorf("Expected %v for an oversized key, got %v", ErrMalformed, err)
+	}
+}
+
+func TestReconcilePinSketch(t *testing.T) {
+	keysize := 8
+	localset, remoteset := NewTestSets(keysize, 500, 25, 15)
+
+	for _, format := range []Format{FormatBinary, FormatJSON} {
+		local := NewReconcile(localset, len(remoteset), WithPinSketch())
+		remote := NewReconcile(remoteset, len(localset), WithPinSketch())
+		local.Format = format
+		remote.Format = format
+		if !local.Sketch {
+			t.Fatal("The sketch was not selected")
+		}
+
+		estimator, err := remote.GetDifferenceSizeEstimator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate, err := local.EstimateDifferenceSize(estimator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b, err := local.Difference(cellsForEstimate(estimate), remote.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameElements(a, localset[500:]) || !sameElements(b, remoteset[500:]) {
+			t.Errorf("For format %d the difference is incorrect", format)
+		}
+
+		// A capacity that is too small is grown by the retry policy
+		local.Retry.Fallback = false
+		a, b, err = local.Difference(8, remote.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameElements(a, localset[500:]) || !sameElements(b, remoteset[500:]) {
+			t.Errorf("For format %d the difference after retrying is incorrect", format)
+		}
+	}
+
+	// Keys too long for the sketch use IBFs
+	if r := NewReconcile(makeRandomElements(10, 9), 10, WithPinSketch()); r.Sketch {
+		t.Error("Selected the sketch for keys longer than 8 bytes")
+	}
+}
@@ -0,0 +1,497 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"slices"
+	"sort"
+)
+
+// rangeMagic begins the binary encoding of a range reconciliation message.
+const rangeMagic = "RR"
+
+// defaultRangeBranches is the number of ranges a mismatching range is split
+// into.
+const defaultRangeBranches = 16
+
+// defaultRangeIDLimit is the largest number of keys sent as a list in place of
+// a fingerprint.
+const defaultRangeIDLimit = 32
+
+// rangeFingerprintSize is the size of a range fingerprint in bytes.
+const rangeFingerprintSize = 16
+
+// rangeMode determines how a range in a message is reconciled.
+type rangeMode byte
+
+const (
+	rangeSkip        rangeMode = iota // The range is already reconciled
+	rangeFingerprint                  // Fingerprint of the keys in the range
+	rangeIDList                       // Every key of the sender in the range
+	rangeIDListReply                  // Keys of the replier missing from a list, and listed keys it lacks
+)
+
+// RangeReconcile reconciles sorted keys, such as the identifiers of a time
+// ordered event log, by comparing fingerprints of ranges of keys. The ranges
+// whose fingerprints differ are split into smaller ranges and compared again,
+// until they are small enough to exchange their keys. Unlike Reconcile, it
+// needs no estimate of the size of the difference, and a change to the set
+// only changes the fingerprints of the ranges holding it.
+//
+// Each message is a series of consecutive ranges covering the key space, each
+// given by its upper bound, the lower bound being that of the previous range.
+// A range is skipped, or holds a fingerprint, a list of keys, or the reply to
+// a list. The initiator sends the first message from Initiate, and each party
+// then passes the messages it receives to Reconcile until there is no reply.
+//
+// A fingerprint is the hash of the sum of the 128-bit hashes of the keys in
+// the range and their count. The sums of the sorted keys are kept as prefix
+// sums, so the fingerprint of any range takes constant time, and Insert and
+// Delete update them without hashing the other keys.
+//
+// A RangeReconcile is not safe for concurrent use.
+//
+// A. Meyer. Range-Based Set Reconciliation. In 2023 42nd International
+// Symposium on Reliable Distributed Systems (SRDS), pages 59–69, 2023.
+type RangeReconcile struct {
+	Keyset   [][]byte // Local keys in ascending order
+	Keysize  int
+	Variable bool   // Whether keys may be shorter than Keysize
+	Hasher   Hasher // Hash function of the fingerprints; Murmur3 if nil
+	Seed     uint32 // Seed of the hash function
+	Branches int    // Number of ranges a mismatching range is split into
+	IDLimit  int    // Largest number of keys sent in place of a fingerprint; at least 1
+
+	sums []rangeSum // Sums of the hashes of the first i keys, once computed
+}
+
+// rangeSum is a 128-bit sum of key hashes.
+type rangeSum [2]uint64
+
+// rangeBound is the upper bound of a range: every key below it, or every key
+// if it is infinite.
+type rangeBound struct {
+	key      []byte
+	infinite bool
+}
+
+// rangeEntry is a range of a message.
+type rangeEntry struct {
+	upper       rangeBound
+	mode        rangeMode
+	fingerprint []byte
+	keys        [][]byte // The keys of a list, or the missing keys of a reply
+	lacking     [][]byte // The listed keys lacked by the replier
+}
+
+// NewRangeReconcile creates a range reconciler for the keys, which all have
+// the length of the first. The keys are copied and sorted, and duplicates are
+// removed. The hash function and its seed may be selected with the WithHasher
+// and WithSeed options.
+func NewRangeReconcile(keys [][]byte, opts ...Option) *RangeReconcile {
+	keysize := 0
+	if len(keys) > 0 {
+		keysize = len(keys[0])
+	}
+	return newRangeReconcile(keys, keysize, false, opts)
+}
+
+// NewVariableRangeReconcile creates a range reconciler for keys of any length
+// up to `maxkeysize` bytes.
+func NewVariableRangeReconcile(keys [][]byte, maxkeysize int, opts ...Option) *RangeReconcile {
+	return newRangeReconcile(keys, maxkeysize, true, opts)
+}
+
+// newRangeReconcile creates a range reconciler for keys of the given size.
+func newRangeReconcile(keys [][]byte, keysize int, variable bool, opts []Option) *RangeReconcile {
+	o := applyOptions(opts)
+	keyset := slices.Clone(keys)
+	slices.SortFunc(keyset, bytes.Compare)
+	keyset = slices.CompactFunc(keyset, bytes.Equal)
+	return &RangeReconcile{keyset, keysize, variable, o.hasher, o.seed,
+		defaultRangeBranches, defaultRangeIDLimit, nil}
+}
+
+// Insert adds the key to the local set, keeping the keys in order. Inserting
+// a key already in the set has no effect. It returns ErrKeysize if the key is
+// not of the proper length.
+func (r *RangeReconcile) Insert(key []byte) error {
+	if !r.validKey(key) {
+		return ErrKeysize
+	}
+	i, found := slices.BinarySearchFunc(r.Keyset, key, bytes.Compare)
+	if found {
+		return nil
+	}
+	r.Keyset = slices.Insert(r.Keyset, i, bytes.Clone(key))
+	if r.sums != nil {
+		h := r.hash(key)
+		r.sums = slices.Insert(r.sums, i+1, r.sums[i])
+		for j := i + 1; j < len(r.sums); j++ {
+			r.sums[j] = r.sums[j].add(h)
+		}
+	}
+	return nil
+}
+
+// Delete removes the key from the local set. It returns false if the key was
+// not present.
+func (r *RangeReconcile) Delete(key []byte) bool {
+	i, found := slices.BinarySearchFunc(r.Keyset, key, bytes.Compare)
+	if !found {
+		return false
+	}
+	if r.sums != nil {
+		h := r.hash(key)
+		r.sums = slices.Delete(r.sums, i+1, i+2)
+		for j := i + 1; j < len(r.sums); j++ {
+			r.sums[j] = r.sums[j].sub(h)
+		}
+	}
+	r.Keyset = slices.Delete(r.Keyset, i, i+1)
+	return true
+}
+
+// Initiate returns the first message of the exchange, which covers every key
+// with fingerprints, or with a list of keys if there are few.
+func (r *RangeReconcile) Initiate() ([]byte, error) {
+	entries := r.split(rangeBound{infinite: true}, 0, len(r.Keyset))
+	return r.encode(entries), nil
+}
+
+// Reconcile processes a message from the remote party. It returns the reply
+// to send, which is nil once the sets are reconciled, and the keys found to be
+// only present locally and only present remotely in the ranges reconciled by
+// this message.
+func (r *RangeReconcile) Reconcile(message []byte) (reply []byte, a [][]byte, b [][]byte, err error) {
+	entries, err := r.decode(message)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	replies := []rangeEntry{}
+	lower := 0
+	for _, entry := range entries {
+		upper := r.search(entry.upper)
+		local := r.Keyset[lower:upper]
+
+		switch entry.mode {
+		case rangeSkip:
+			replies = append(replies, rangeEntry{upper: entry.upper, mode: rangeSkip})
+
+		case rangeFingerprint:
+			if bytes.Equal(r.fingerprint(lower, upper), entry.fingerprint) {
+				replies = append(replies, rangeEntry{upper: entry.upper, mode: rangeSkip})
+			} else {
+				replies = append(replies, r.split(entry.upper, lower, upper)...)
+			}
+
+		case rangeIDList:
+			missing, lacking := compareSorted(local, entry.keys)
+			a = append(a, missing...)
+			b = append(b, lacking...)
+			replies = append(replies, rangeEntry{upper: entry.upper, mode: rangeIDListReply,
+				keys: missing, lacking: lacking})
+
+		case rangeIDListReply:
+			// The replier's missing keys are only present remotely, and the
+			// keys it lacks only locally
+			b = append(b, entry.keys...)
+			a = append(a, entry.lacking...)
+			replies = append(replies, rangeEntry{upper: entry.upper, mode: rangeSkip})
+		}
+		lower = upper
+	}
+	return r.encode(replies), a, b, nil
+}
+
+// RangeDifference runs the exchange as the initiator, passing each message to
+// `remote` and receiving the reply, until the sets are reconciled. The remote
+// side produces its replies with Reconcile, and the exchange ends when it
+// returns nil.
+//
+// The first result holds the keys only present locally, and the second holds
+// the keys only present remotely.
+func (r *RangeReconcile) RangeDifference(remote func(message []byte) ([]byte, error)) (a [][]byte, b [][]byte, err error) {
+	message, err := r.Initiate()
+	if err != nil {
+		return nil, nil, err
+	}
+	for message != nil {
+		reply, err := remote(message)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reply == nil {
+			break
+		}
+
+		var la, lb [][]byte
+		if message, la, lb, err = r.Reconcile(reply); err != nil {
+			return nil, nil, err
+		}
+		a = append(a, la...)
+		b = append(b, lb...)
+	}
+	return a, b, nil
+}
+
+// split returns the entries reconciling the local keys from `lower` to `upper`
+// in a range: a list of the keys if there are few, or else fingerprints of
+// ranges holding equal shares of the keys. A single key is always listed, since
+// a range of one key cannot be split further.
+func (r *RangeReconcile) split(bound rangeBound, lower, upper int) []rangeEntry {
+	count := upper - lower
+	if count <= max(r.IDLimit, 1) {
+		return []rangeEntry{{upper: bound, mode: rangeIDList, keys: r.Keyset[lower:upper]}}
+	}
+
+	branches := min(max(r.Branches, 2), count)
+	entries := make([]rangeEntry, 0, branches)
+	start := lower
+	for i := 1; i <= branches; i++ {
+		end := lower + count*i/branches
+		upperbound := bound
+		if i < branches {
+			upperbound = rangeBound{key: separator(r.Keyset[end-1], r.Keyset[end])}
+		}
+		entries = append(entries, rangeEntry{upper: upperbound, mode: rangeFingerprint,
+			fingerprint: r.fingerprint(start, end)})
+		start = end
+	}
+	return entries
+}
+
+// separator returns the shortest prefix of `next` that is greater than
+// `previous`, so that it bounds the ranges between them.
+func separator(previous, next []byte) []byte {
+	common := 0
+	for common < len(previous) && common < len(next) && previous[common] == next[common] {
+		common++
+	}
+	return next[:min(common+1, len(next))]
+}
+
+// search returns the number of local keys below the bound.
+func (r *RangeReconcile) search(bound rangeBound) int {
+	if bound.infinite {
+		return len(r.Keyset)
+	}
+	return sort.Search(len(r.Keyset), func(i int) bool {
+		return bytes.Compare(r.Keyset[i], bound.key) >= 0
+	})
+}
+
+// fingerprint returns the fingerprint of the keys from `lower` to `upper`.
+func (r *RangeReconcile) fingerprint(lower, upper int) []byte {
+	if r.sums == nil {
+		r.sums = make([]rangeSum, len(r.Keyset)+1)
+		for i, key := range r.Keyset {
+			r.sums[i+1] = r.sums[i].add(r.hash(key))
+		}
+	}
+
+	sum := r.sums[upper].sub(r.sums[lower])
+	data := binary.LittleEndian.AppendUint64(nil, sum[0])
+	data = binary.LittleEndian.AppendUint64(data, sum[1])
+	data = binary.AppendUvarint(data, uint64(upper-lower))
+	h := defaultHasher(r.Hasher).Sum128(data, r.Seed)
+
+	fingerprint := make([]byte, 0, rangeFingerprintSize)
+	for _, word := range h {
+		fingerprint = binary.LittleEndian.AppendUint32(fingerprint, word)
+	}
+	return fingerprint
+}
+
+// hash returns the 128-bit hash of the key summed by the fingerprints.
+func (r *RangeReconcile) hash(key []byte) rangeSum {
+	h := defaultHasher(r.Hasher).Sum128(key, r.Seed)
+	return rangeSum{uint64(h[0])<<32 | uint64(h[1]), uint64(h[2])<<32 | uint64(h[3])}
+}
+
+// add returns the sum modulo 2^128.
+func (s rangeSum) add(t rangeSum) rangeSum {
+	low, carry := bits.Add64(s[0], t[0], 0)
+	high, _ := bits.Add64(s[1], t[1], carry)
+	return rangeSum{low, high}
+}
+
+// sub returns the difference modulo 2^128.
+func (s rangeSum) sub(t rangeSum) rangeSum {
+	low, borrow := bits.Sub64(s[0], t[0], 0)
+	high, _ := bits.Sub64(s[1], t[1], borrow)
+	return rangeSum{low, high}
+}
+
+// compareSorted returns the keys only in `local` and those only in `remote`,
+// which must both be sorted.
+func compareSorted(local, remote [][]byte) (a [][]byte, b [][]byte) {
+	a, b = [][]byte{}, [][]byte{}
+	i, j := 0, 0
+	for i < len(local) || j < len(remote) {
+		switch {
+		case j == len(remote) || (i < len(local) && bytes.Compare(local[i], remote[j]) < 0):
+			a = append(a, bytes.Clone(local[i]))
+			i++
+		case i == len(local) || bytes.Compare(local[i], remote[j]) > 0:
+			b = append(b, remote[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return a, b
+}
+
+// validKey returns true if the key is of the proper length.
+func (r *RangeReconcile) validKey(key []byte) bool {
+	return len(key) <= r.Keysize && (len(key) == r.Keysize || r.Variable)
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (r *RangeReconcile) flags() (flags byte) {
+	if r.Variable {
+		flags |= flagVariable
+	}
+	if r.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// encode returns the binary encoding of a message, or nil if every range is
+// skipped. Consecutive skipped ranges are merged, and trailing ones omitted.
+//
+// The header holds the magic bytes "RR", a version byte, the hash scheme, a
+// flags byte, the keysize as an unsigned varint, and the seed in 4
+// little-endian bytes if it is not zero. The number of ranges follows as an
+// unsigned varint. Each range holds its upper bound as an unsigned varint of
+// its length plus one, or zero if it is infinite, followed by the bound, and
+// then the mode byte. A fingerprint follows in 16 bytes, a list of keys as
+// each key prefixed by its length after their count, and a reply as two such
+// lists.
+func (r *RangeReconcile) encode(entries []rangeEntry) []byte {
+	merged := []rangeEntry{}
+	for _, entry := range entries {
+		last := len(merged) - 1
+		if entry.mode == rangeSkip && last >= 0 && merged[last].mode == rangeSkip {
+			merged[last] = entry
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	for len(merged) > 0 && merged[len(merged)-1].mode == rangeSkip {
+		merged = merged[:len(merged)-1]
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	data := append([]byte(rangeMagic), binaryVersion, byte(defaultHasher(r.Hasher).Scheme()), r.flags())
+	data = binary.AppendUvarint(data, uint64(r.Keysize))
+	if r.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, r.Seed)
+	}
+	data = binary.AppendUvarint(data, uint64(len(merged)))
+	for _, entry := range merged {
+		if entry.upper.infinite {
+			data = binary.AppendUvarint(data, 0)
+		} else {
+			data = binary.AppendUvarint(data, uint64(len(entry.upper.key))+1)
+			data = append(data, entry.upper.key...)
+		}
+		data = append(data, byte(entry.mode))
+
+		switch entry.mode {
+		case rangeFingerprint:
+			data = append(data, entry.fingerprint...)
+		case rangeIDList:
+			data = appendKeys(data, entry.keys)
+		case rangeIDListReply:
+			data = appendKeys(appendKeys(data, entry.keys), entry.lacking)
+		}
+	}
+	return data
+}
+
+// decode reads the ranges of a message, checking that the bounds ascend and
+// that its parameters match the local ones.
+func (r *RangeReconcile) decode(message []byte) ([]rangeEntry, error) {
+	d := &decoder{data: message}
+	d.header(rangeMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^(flagVariable|flagSeeded) != 0 {
+		d.fail(ErrMalformed)
+	}
+	keysize := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	count := d.length()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if hasher.Scheme() != defaultHasher(r.Hasher).Scheme() {
+		return nil, ErrHasherMismatch
+	}
+	if seed != r.Seed {
+		return nil, ErrSeedMismatch
+	}
+	if keysize != r.Keysize || (flags&flagVariable != 0) != r.Variable {
+		return nil, ErrKeysize
+	}
+	if count > len(d.data) {
+		return nil, ErrTruncated
+	}
+
+	entries := make([]rangeEntry, 0, count)
+	var previous *rangeBound
+	for i := 0; i < count && d.err == nil; i++ {
+		entry := rangeEntry{}
+		if length := d.length(); length == 0 {
+			entry.upper.infinite = true
+		} else {
+			entry.upper.key = d.bytes(length - 1)
+		}
+
+		// Each bound must be above the last, and only the last infinite
+		if previous != nil && (previous.infinite ||
+			(!entry.upper.infinite && bytes.Compare(entry.upper.key, previous.key) <= 0)) {
+			d.fail(ErrMalformed)
+		}
+		previous = &entry.upper
+
+		entry.mode = rangeMode(d.byte())
+		switch entry.mode {
+		case rangeSkip:
+		case rangeFingerprint:
+			entry.fingerprint = d.bytes(rangeFingerprintSize)
+		case rangeIDList:
+			entry.keys = readKeys(d)
+			if !slices.IsSortedFunc(entry.keys, bytes.Compare) ||
+				len(slices.CompactFunc(slices.Clone(entry.keys), bytes.Equal)) != len(entry.keys) {
+				d.fail(ErrMalformed)
+			}
+		case rangeIDListReply:
+			entry.keys = readKeys(d)
+			entry.lacking = readKeys(d)
+		default:
+			d.fail(ErrMalformed)
+		}
+		for _, key := range append(slices.Clip(entry.keys), entry.lacking...) {
+			if !r.validKey(key) {
+				d.fail(ErrKeysize)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,196 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// rangeExchange returns the function passing messages to the remote range
+// reconciler, and collecting the difference it finds.
+func rangeExchange(remote *RangeReconcile, a, b *[][]byte, messages *int) func([]byte) ([]byte, error) {
+	return func(message []byte) ([]byte, error) {
+		*messages++
+		reply, la, lb, err := remote.Reconcile(message)
+		*a = append(*a, la...)
+		*b = append(*b, lb...)
+		return reply, err
+	}
+}
+
+func TestRangeReconcile(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 1000, 0, 0},
+		{"Small difference", 1000, 3, 2},
+		{"Large difference", 1000, 400, 300},
+		{"Empty local set", 0, 0, 100},
+		{"Both sets empty", 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		local := NewVariableRangeReconcile(localset, keysize, WithSeed(11))
+		remote := NewVariableRangeReconcile(remoteset, keysize, WithSeed(11))
+
+		var remoteA, remoteB [][]byte
+		messages := 0
+		a, b, err := local.RangeDifference(rangeExchange(remote, &remoteA, &remoteB, &messages))
+		if err != nil {
+			t.Errorf("For %s test got %v", test.title, err)
+			continue
+		}
+		if !sameElements(a, localset[test.match:]) || !sameElements(b, remoteset[test.match:]) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remoteA, remoteset[test.match:]) || !sameElements(remoteB, localset[test.match:]) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+		t.Logf("%s: %d messages", test.title, messages)
+	}
+}
+
+func TestRangeReconcileOrdered(t *testing.T) {
+	// Time ordered keys that differ in their most recent entries
+	keys := make([][]byte, 5000)
+	for i := range keys {
+		keys[i] = binary.BigEndian.AppendUint64(nil, uint64(i))
+	}
+	local := NewRangeReconcile(keys[:4990])
+	remote := NewRangeReconcile(keys[5:])
+
+	var remoteA, remoteB [][]byte
+	messages := 0
+	a, b, err := local.RangeDifference(rangeExchange(remote, &remoteA, &remoteB, &messages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, keys[:5]) || !sameElements(b, keys[4990:]) {
+		t.Error("The difference is incorrect")
+	}
+
+	// Inserting the missing keys reconciles the sets
+	for _, key := range keys[4990:] {
+		if err := local.Insert(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys[:5] {
+		if !local.Delete(key) {
+			t.Fatal("Could not delete a key in the set")
+		}
+	}
+	if local.Delete(keys[0]) {
+		t.Error("Deleted a key that is no longer in the set")
+	}
+	if local.sums == nil {
+		t.Error("The sums were discarded rather than updated")
+	}
+	message, err := local.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, a, b, err := remote.Reconcile(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil || len(a) != 0 || len(b) != 0 {
+		t.Error("The sets differ after inserting the missing keys")
+	}
+	if err := local.Insert(make([]byte, 9)); err != ErrKeysize {
+		t.Errorf("Expected %v, got %v", ErrKeysize, err)
+	}
+}
+
+func TestRangeReconcileIDLimit(t *testing.T) {
+	// Multiples of 2 and of 3, which share only the multiples of 6
+	var evens, triples, evensOnly, triplesOnly [][]byte
+	for i := 0; i < 300; i++ {
+		key := binary.BigEndian.AppendUint16(nil, uint16(i))
+		if i%2 == 0 {
+			evens = append(evens, key)
+		}
+		if i%3 == 0 {
+			triples = append(triples, key)
+		}
+		if i%2 == 0 && i%3 != 0 {
+			evensOnly = append(evensOnly, key)
+		}
+		if i%3 == 0 && i%2 != 0 {
+			triplesOnly = append(triplesOnly, key)
+		}
+	}
+
+	tests := []struct {
+		title                                string
+		local, remote, localOnly, remoteOnly [][]byte
+	}{
+		{"Single keys", [][]byte{{1, 2}}, [][]byte{{3, 4}}, [][]byte{{1, 2}}, [][]byte{{3, 4}}},
+		{"Many keys", evens, triples, evensOnly, triplesOnly},
+	}
+
+	for _, test := range tests {
+		// With no keys listed in place of fingerprints, single keys still are
+		local := NewRangeReconcile(test.local)
+		remote := NewRangeReconcile(test.remote)
+		local.IDLimit = 0
+		remote.IDLimit = 0
+
+		var remoteA, remoteB [][]byte
+		messages := 0
+		exchange := rangeExchange(remote, &remoteA, &remoteB, &messages)
+		a, b, err := local.RangeDifference(func(message []byte) ([]byte, error) {
+			if messages > 1000 {
+				return nil, ErrProtocol
+			}
+			return exchange(message)
+		})
+		if err != nil {
+			t.Errorf("For %s test got %v after %d messages", test.title, err, messages)
+			continue
+		}
+		if !sameElements(a, test.localOnly) || !sameElements(b, test.remoteOnly) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remoteA, test.remoteOnly) || !sameElements(remoteB, test.localOnly) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+	}
+}
+
+func TestRangeReconcileMismatch(t *testing.T) {
+	localset, remoteset := NewTestSets(16, 100, 5, 5)
+	message, err := NewRangeReconcile(localset, WithSeed(1)).Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := NewRangeReconcile(remoteset, WithSeed(2)).Reconcile(message); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+	if _, _, _, err := NewRangeReconcile(makeRandomElements(10, 8), WithSeed(1)).Reconcile(message); err != ErrKeysize {
+		t.Errorf("Expected %v, got %v", ErrKeysize, err)
+	}
+	if _, _, _, err := NewRangeReconcile(remoteset, WithSeed(1)).Reconcile(message[:len(message)-1]); err == nil {
+		t.Error("Accepted a truncated message")
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	tests := []struct {
+		previous, next, separator []byte
+	}{
+		{[]byte{1, 2, 3}, []byte{1, 3, 0}, []byte{1, 3}},
+		{[]byte{1, 2}, []byte{1, 2, 0}, []byte{1, 2, 0}},
+		{[]byte{}, []byte{5}, []byte{5}},
+		{[]byte{0, 9, 9}, []byte{1, 0, 0}, []byte{1}},
+	}
+	for _, test := range tests {
+		got := separator(test.previous, test.next)
+		if !bytes.Equal(got, test.separator) {
+			t.Errorf("Separator of %v and %v is %v, expected %v", test.previous, test.next, got, test.separator)
+		}
+	}
+}
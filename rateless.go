@@ -0,0 +1,284 @@
+package reconcile
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrRatelessStarted occurs when a key is added to a RatelessEncoder after it
+// has produced coded symbols, which would no longer account for the key.
+var ErrRatelessStarted = errors.New("Adding a key after coded symbols were produced")
+
+// maxRatelessIndex bounds the index of a coded symbol. A key whose next index
+// would exceed it is not stored in any further symbol.
+const maxRatelessIndex = math.MaxInt32
+
+// ratelessMapping generates the increasing indices of the coded symbols a key
+// is stored in, as described by Yang et al. in "Practical Rateless Set
+// Reconciliation". Every key is stored in the first symbol, and the gaps grow
+// so that the i-th symbol holds each key with probability about 1/(1+i/2).
+type ratelessMapping struct {
+	prng  uint64
+	index int
+}
+
+// newRatelessMapping starts the mapping of a key from its hash values, as
+// returned by IBF.Hashes.
+func newRatelessMapping(hashes []uint32) ratelessMapping {
+	return ratelessMapping{uint64(hashes[1])<<32 | uint64(hashes[2]), 0}
+}
+
+// next advances the mapping to the following index.
+func (m *ratelessMapping) next() {
+	m.prng *= 0xda942042e4dd58b5
+	step := math.Ceil((float64(m.index) + 1.5) * ((1<<32)/math.Sqrt(float64(m.prng)+1) - 1))
+	if step < 1 {
+		step = 1
+	}
+	if step >= float64(maxRatelessIndex-m.index) {
+		m.index = maxRatelessIndex
+		return
+	}
+	m.index += int(step)
+}
+
+// ratelessSymbol is a key along with its position in the stream of coded
+// symbols.
+type ratelessSymbol struct {
+	key     []byte
+	hash    uint32
+	mapping ratelessMapping
+	count   int // Count the key is stored with
+}
+
+// encodeSymbols stores the keys in the cells of `segment`, which holds the
+// coded symbols starting at index `start`, and advances their mappings past
+// the segment. The keys are added with their count times `sign`, so a sign of
+// -1 removes them.
+func encodeSymbols(segment *IBF, start int, symbols []ratelessSymbol, sign int) {
+	end := start + segment.Size
+	for i := range symbols {
+		symbol := &symbols[i]
+		for ; symbol.mapping.index < end; symbol.mapping.next() {
+			segment.Update(symbol.key, symbol.hash, []int{symbol.mapping.index - start}, sign*symbol.count)
+		}
+	}
+}
+
+// RatelessEncoder produces an unbounded stream of coded symbols for a key set,
+// which lets the difference be decoded without estimating its size first. The
+// symbols are the cells of an IBF, produced in consecutive segments, so the
+// stream can be cut wherever the receiver has decoded enough.
+//
+// About 1.35 to 1.7 times as many symbols as there are differing keys are
+// needed to decode the difference.
+type RatelessEncoder struct {
+	Keysize  int
+	Variable bool   // Whether keys may be shorter than Keysize
+	Hasher   Hasher // Hash function placing keys; Murmur3 if nil
+	Seed     uint32 // Seed of the hash function
+
+	symbols []ratelessSymbol
+	offset  int // Number of coded symbols produced
+}
+
+// NewRatelessEncoder creates an encoder for keys of `keysize` bytes. The hash
+// function and its seed may be selected with the WithHasher and WithSeed
+// options, and must match those of the remote peer.
+func NewRatelessEncoder(keysize int, opts ...Option) *RatelessEncoder {
+	o := applyOptions(opts)
+	return &RatelessEncoder{keysize, false, o.hasher, o.seed, nil, 0}
+}
+
+// NewVariableRatelessEncoder creates an encoder accepting keys of any length up
+// to `maxkeysize` bytes.
+func NewVariableRatelessEncoder(maxkeysize int, opts ...Option) *RatelessEncoder {
+	e := NewRatelessEncoder(maxkeysize, opts...)
+	e.Variable = true
+	return e
+}
+
+// Add inserts the key into the encoded set. It returns an error if the key is
+// not of the proper length, or ErrRatelessStarted if symbols were produced.
+func (e *RatelessEncoder) Add(key []byte) error {
+	if e.offset > 0 {
+		return ErrRatelessStarted
+	}
+	if len(key) > e.Keysize || (len(key) != e.Keysize && !e.Variable) {
+		return ErrKeysize
+	}
+
+	hashes := defaultHasher(e.Hasher).Sum128(key, e.Seed)
+	e.symbols = append(e.symbols, ratelessSymbol{key, hashes[0], newRatelessMapping(hashes[:]), 1})
+	return nil
+}
+
+// Next returns the following `size` coded symbols as the cells of an IBF. The
+// segment can be encoded like any IBF, but it can only be decoded by a
+// RatelessDecoder receiving the segments in order.
+func (e *RatelessEncoder) Next(size int) *IBF {
+	segment := e.newIBF(size)
+	encodeSymbols(segment, e.offset, e.symbols, 1)
+	e.offset += segment.Size
+	return segment
+}
+
+// newIBF creates an empty segment of the given size.
+func (e *RatelessEncoder) newIBF(size int) *IBF {
+	if e.Variable {
+		return NewVariableIBF(size, e.Keysize, WithHasher(e.Hasher), WithSeed(e.Seed))
+	}
+	return NewIBF(size, e.Keysize, WithHasher(e.Hasher), WithSeed(e.Seed))
+}
+
+// RatelessDecoder recovers the difference between a local key set and the
+// remote set whose coded symbols it receives.
+type RatelessDecoder struct {
+	local   *RatelessEncoder
+	cells   *IBF             // Local minus remote symbols received so far
+	decoded []ratelessSymbol // Keys recovered, advanced past the cells
+	a, b    [][]byte
+}
+
+// NewRatelessDecoder creates a decoder subtracting the symbols of the remote
+// set from those of `local`, which holds the local keys and must not be used
+// to produce symbols elsewhere.
+func NewRatelessDecoder(local *RatelessEncoder) *RatelessDecoder {
+	return &RatelessDecoder{local: local}
+}
+
+// Add subtracts the next segment of remote symbols and decodes as many keys as
+// it can. It returns an error if the segment was produced with a different
+// keysize, hash function or seed, after which the decoder cannot be used.
+func (d *RatelessDecoder) Add(remote *IBF) error {
+	if remote.Size < 1 {
+		return ErrMalformed
+	}
+	segment := d.local.Next(remote.Size)
+	if err := segment.Subtract(remote); err != nil {
+		return err
+	}
+
+	start := 0
+	if d.cells != nil {
+		start = d.cells.Size
+	}
+
+	// Remove the keys already recovered from the new symbols
+	encodeSymbols(segment, start, d.decoded, -1)
+
+	if d.cells == nil {
+		d.cells = segment
+	} else {
+		d.cells.Size += segment.Size
+		d.cells.Hashset = append(d.cells.Hashset, segment.Hashset...)
+		d.cells.Countset = append(d.cells.Countset, segment.Countset...)
+		d.cells.Bitset = append(d.cells.Bitset, segment.Bitset...)
+		if d.cells.Variable {
+			d.cells.Lengthset = append(d.cells.Lengthset, segment.Lengthset...)
+		}
+	}
+
+	pending := make([]int, 0, segment.Size)
+	for i := start; i < d.cells.Size; i++ {
+		pending = append(pending, i)
+	}
+	for len(pending) > 0 {
+		index := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		key, hashes, ok := d.pure(index)
+		if !ok {
+			continue
+		}
+
+		count := d.cells.Count(index)
+		if count > 0 {
+			d.a = append(d.a, key)
+		} else {
+			d.b = append(d.b, key)
+		}
+
+		// Remove the key from every symbol to uncover new pure cells
+		mapping := newRatelessMapping(hashes)
+		for ; mapping.index < d.cells.Size; mapping.next() {
+			d.cells.Update(key, hashes[0], []int{mapping.index}, -count)
+			pending = append(pending, mapping.index)
+		}
+		d.decoded = append(d.decoded, ratelessSymbol{key, hashes[0], mapping, count})
+	}
+	return nil
+}
+
+// pure returns the key stored in the cell at `index` and its hash values, and
+// whether the cell is pure. Besides the checks of IBF.IsPure, the key must map
+// to the cell.
+func (d *RatelessDecoder) pure(index int) ([]byte, []uint32, bool) {
+	key, ok := d.cells.pureKey(index)
+	if !ok {
+		return nil, nil, false
+	}
+
+	hashes := d.cells.Hashes(key)
+	mapping := newRatelessMapping(hashes)
+	for mapping.index < index {
+		mapping.next()
+	}
+	if mapping.index != index {
+		return nil, nil, false
+	}
+	return key, hashes, true
+}
+
+// Symbols returns the number of coded symbols received.
+func (d *RatelessDecoder) Symbols() int {
+	if d.cells == nil {
+		return 0
+	}
+	return d.cells.Size
+}
+
+// Done returns true once the whole difference has been decoded, which is when
+// the first symbol, holding every key of the difference, is empty.
+func (d *RatelessDecoder) Done() bool {
+	if d.cells == nil {
+		return false
+	}
+	if d.cells.HashSum(0) != 0 || d.cells.Count(0) != 0 {
+		return false
+	}
+	if d.cells.Variable && d.cells.Lengthset[0] != 0 {
+		return false
+	}
+	for _, v := range d.cells.Bitset[:d.cells.Keysize] {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Difference returns the keys decoded so far that are only present locally,
+// and those only present remotely. The difference is complete once Done
+// returns true.
+func (d *RatelessDecoder) Difference() (a [][]byte, b [][]byte) {
+	return d.a, d.b
+}
+
+// ratelessEncoder creates an encoder holding the local keys, copying those
+// read from a Source.
+func (r *Reconcile) ratelessEncoder() *RatelessEncoder {
+	e := NewRatelessEncoder(r.Keysize, WithHasher(r.Hasher), WithSeed(r.Seed))
+	e.Variable = r.Variable
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key := range r.keys() {
+		if r.Source != nil {
+			// A source may reuse the slice it yields
+			key = append([]byte{}, key...)
+		}
+		e.Add(key)
+	}
+	return e
+}
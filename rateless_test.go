@@ -0,0 +1,169 @@
+package reconcile
+
+import (
+	"testing"
+)
+
+// decodeRateless streams segments of `size` symbols from `remote` into a
+// decoder of `local` until it is done, and returns the decoder.
+func decodeRateless(t *testing.T, local, remote *RatelessEncoder, size, limit int) *RatelessDecoder {
+	decoder := NewRatelessDecoder(local)
+	for !decoder.Done() {
+		if decoder.Symbols() > limit {
+			t.Fatalf("Could not decode after %d symbols", decoder.Symbols())
+		}
+		if err := decoder.Add(remote.Next(size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return decoder
+}
+
+func TestRateless(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 100, 0, 0},
+		{"One difference", 100, 1, 0},
+		{"Small difference", 200, 5, 3},
+		{"Large difference", 100, 300, 200},
+		{"Empty local set", 0, 0, 30},
+		{"Empty sets", 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		local := NewRatelessEncoder(keysize, WithSeed(7))
+		remote := NewRatelessEncoder(keysize, WithSeed(7))
+		for _, key := range localset {
+			local.Add(key)
+		}
+		for _, key := range remoteset {
+			remote.Add(key)
+		}
+
+		// Most differences decode within twice their size, but a few keys can
+		// share their first symbols, so the limit only catches a stalled decoder
+		difference := test.uniquea + test.uniqueb
+		decoder := decodeRateless(t, local, remote, 4, 8*difference+64)
+		a, b := decoder.Difference()
+		if !sameElements(a, localset[test.match:]) || !sameElements(b, remoteset[test.match:]) {
+			t.Errorf("For %s test the decoded difference is incorrect", test.title)
+		}
+	}
+}
+
+func TestVariableRateless(t *testing.T) {
+	maxkeysize := 48
+	common := makeVariableElements(100, maxkeysize)
+	uniqueA := makeVariableElements(20, maxkeysize)
+	uniqueB := append(makeVariableElements(15, maxkeysize), []byte{})
+
+	local := NewVariableRatelessEncoder(maxkeysize)
+	remote := NewVariableRatelessEncoder(maxkeysize)
+	for _, key := range append(append([][]byte{}, common...), uniqueA...) {
+		if err := local.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range append(append([][]byte{}, common...), uniqueB...) {
+		if err := remote.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := local.Add(make([]byte, maxkeysize+1)); err != ErrKeysize {
+		t.Errorf("Expected %v for a long key, got %v", ErrKeysize, err)
+	}
+
+	// Segments survive the binary encoding
+	decoder := NewRatelessDecoder(local)
+	for !decoder.Done() {
+		data, err := remote.Next(10).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment := &IBF{}
+		if err := segment.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.Add(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := decoder.Difference()
+	if !sameElements(a, uniqueA) || !sameElements(b, uniqueB) {
+		t.Error("Decoded keys do not match the originals")
+	}
+
+	if err := remote.Add(uniqueA[0]); err != ErrRatelessStarted {
+		t.Errorf("Expected %v after producing symbols, got %v", ErrRatelessStarted, err)
+	}
+}
+
+func TestRatelessMismatch(t *testing.T) {
+	local := NewRatelessEncoder(16, WithSeed(1))
+	remote := NewRatelessEncoder(16, WithSeed(2))
+	if err := NewRatelessDecoder(local).Add(remote.Next(8)); err != ErrSeedMismatch {
+		t.Errorf("Expected %v, got %v", ErrSeedMismatch, err)
+	}
+}
+
+func TestRatelessSession(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 100, 0, 0},
+		{"Small difference", 200, 5, 3},
+		{"Large difference", 100, 150, 120},
+		{"Empty remote set", 0, 30, 0},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		initiator := NewSession(nil, Initiator, localset)
+		responder := NewSession(nil, Responder, remoteset)
+		initiator.Rateless = true
+		responder.Rateless = true
+
+		local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+		if localErr != nil || remoteErr != nil {
+			t.Errorf("For %s test got errors %v and %v", test.title, localErr, remoteErr)
+			continue
+		}
+		if !sameElements(local.Local, localset[test.match:]) ||
+			!sameElements(local.Remote, remoteset[test.match:]) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remote.Local, remoteset[test.match:]) ||
+			!sameElements(remote.Remote, localset[test.match:]) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+	}
+
+	// A limit on the symbols falls back to the full set
+	localset, remoteset := NewTestSets(keysize, 50, 100, 100)
+	initiator := NewSession(nil, Initiator, localset)
+	responder := NewSession(nil, Responder, remoteset)
+	initiator.Rateless = true
+	responder.Rateless = true
+	initiator.Retry.MaxSize = 64
+	local, _, localErr, remoteErr := runSessions(t, initiator, responder)
+	if localErr != nil || remoteErr != nil {
+		t.Fatalf("Got errors %v and %v", localErr, remoteErr)
+	}
+	if !sameElements(local.Local, localset[50:]) || !sameElements(local.Remote, remoteset[50:]) {
+		t.Error("The difference found by the fallback is incorrect")
+	}
+
+	// Both peers must agree to stream coded symbols
+	initiator = NewSession(nil, Initiator, localset)
+	initiator.Rateless = true
+	_, _, localErr, remoteErr = runSessions(t, initiator, NewSession(nil, Responder, remoteset))
+	if localErr != ErrSessionMismatch || remoteErr != ErrSessionMismatch {
+		t.Errorf("Expected %v, got %v and %v", ErrSessionMismatch, localErr, remoteErr)
+	}
+}
@@ -1,7 +1,10 @@
 package reconcile
 
 import (
+	"iter"
 	"math"
+	"slices"
+	"sync"
 )
 
 //Create reconciler with local keys knowing the remote set size
@@ -12,56 +15,224 @@ import (
 
 type Reconcile struct {
 	Keyset    [][]byte
+	Source    iter.Seq[[]byte] // Scanned for the local keys in place of Keyset if not nil
+	Keysize   int
 	Estimator *Strata
 	Depth     int
+	Format    Format           // Encoding of signatures; binary by default
+	Retry     RetryPolicy      // Used by Difference when decoding fails
+	Variable  bool             // Whether keys may be shorter than Keysize
+	Hasher    Hasher           // Hash function of the filters; Murmur3 if nil
+	Seed      uint32           // Seed of the hash function
+	Hybrid    *HybridEstimator // Used in place of Estimator if not nil
+	Sketch    bool             // Whether signatures are PinSketches in place of IBFs
+
+	mu     sync.RWMutex
+	index  map[string]int // Position of each key in Keyset, once maintained
+	cache  map[int]*IBF   // Filters of recently requested sizes
+	cached []int          // Sizes in the cache, oldest first
+	stale  bool           // Whether Hybrid must be rebuilt
 }
 
 //Creates a set reconciler and populates a size estimator with all local keys
-func NewReconcile(keys [][]byte, remotesetsize int) *Reconcile {
-	//Get the required depth
+//The hash function and its seed may be selected with the WithHasher and
+//WithSeed options, and the WithHybridEstimator option selects the
+//HybridEstimator in place of the Strata
+func NewReconcile(keys [][]byte, remotesetsize int, opts ...Option) *Reconcile {
+	return newReconcile(keys, len(keys[0]), remotesetsize, false, opts)
+}
+
+// NewVariableReconcile creates a set reconciler for keys of any length up to
+// `maxkeysize` bytes, such as URLs or composite identifiers. Both parties must
+// agree on `maxkeysize`. The differences decoded are the original keys. The
+// size of the difference is always estimated with a Strata, and the
+// WithHybridEstimator option is ignored.
+func NewVariableReconcile(keys [][]byte, maxkeysize, remotesetsize int, opts ...Option) *Reconcile {
+	return newReconcile(keys, maxkeysize, remotesetsize, true, opts)
+}
+
+// newReconcile creates a set reconciler for keys of the given size, which
+// allows the local set to be empty.
+func newReconcile(keys [][]byte, keysize, remotesetsize int, variable bool, opts []Option) *Reconcile {
+	r := newReconcileSource(slices.Values(keys), keysize, len(keys), remotesetsize, variable, opts)
+	r.Keyset = keys
+	r.Source = nil
+	return r
+}
+
+// newReconcileSource creates a set reconciler reading the `setsize` local keys
+// from `source`, which is scanned once to populate the estimator.
+func newReconcileSource(source iter.Seq[[]byte], keysize, setsize, remotesetsize int, variable bool, opts []Option) *Reconcile {
+	o := applyOptions(opts)
+
+	r := &Reconcile{
+		Source:   source,
+		Keysize:  keysize,
+		Depth:    estimatorDepth(setsize, remotesetsize),
+		Format:   FormatBinary,
+		Retry:    DefaultRetryPolicy,
+		Variable: variable,
+		Hasher:   o.hasher,
+		Seed:     o.seed,
+	}
+	if o.sketch {
+		r.Sketch = validSketch(1, keysize, variable)
+	}
+
+	//Create and populate and return the local estimator
+	if o.hybrid && !variable {
+		r.Hybrid = NewHybridEstimatorDepth(keysize, r.Depth, opts...)
+		r.Hybrid.BuildSignatureSource(source)
+		return r
+	}
+	newStrata := NewStrata
+	if variable {
+		newStrata = NewVariableStrata
+	}
+	r.Estimator = newStrata(80, keysize, r.Depth, opts...)
+	r.Estimator.PopulateSource(source)
+	return r
+}
+
+// estimatorDepth returns the depth of the estimator needed for the larger of
+// the local and remote sets.
+func estimatorDepth(setsize, remotesetsize int) int {
 	var depth int
-	if remotesetsize > len(keys) {
+	if remotesetsize > setsize {
 		depth = int(math.Ceil(math.Log2(float64(remotesetsize))))
 	} else {
-		depth = int(math.Ceil(math.Log2(float64(len(keys)))))
+		depth = int(math.Ceil(math.Log2(float64(setsize))))
 	}
-
-	//Create and populate and return the local IBF
-	estimator := NewStrata(80, len(keys[0]), depth)
-	estimator.Populate(keys)
-
-	return &Reconcile{keys, estimator, depth}
+	if depth < 1 {
+		depth = 1
+	}
+	return depth
 }
 
+// GetDifferenceSizeEstimator encodes the local strata or hybrid estimator in
+// the configured format.
 func (r *Reconcile) GetDifferenceSizeEstimator() ([]byte, error) {
-	json, err := r.Estimator.MarshalStrataJSON()
-	return json, err
+	r.refreshHybrid()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.Hybrid != nil && r.Format == FormatJSON {
+		return r.Hybrid.MarshalJSON()
+	}
+	if r.Hybrid != nil {
+		return r.Hybrid.MarshalBinary()
+	}
+	if r.Format == FormatJSON {
+		return r.Estimator.MarshalStrataJSON()
+	}
+	return r.Estimator.MarshalBinary()
 }
 
-//Takes JSON estimator data from remote and estimates size of difference
+//Takes estimator data from remote and estimates size of difference
 func (r *Reconcile) EstimateDifferenceSize(data []byte) (int, error) {
-	remote := NewStrata(80, len(r.Keyset[0]), r.Depth)
-	err := remote.UnmarshalStrataJSON(data)
-	return r.Estimator.Estimate(remote), err
+	if r.Hybrid != nil {
+		return r.estimateHybrid(data)
+	}
+
+	remote := &Strata{}
+	var err error
+	if r.Format == FormatJSON {
+		err = remote.UnmarshalStrataJSON(data)
+	} else {
+		err = remote.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.Estimator.Compatible(remote); err != nil {
+		return 0, err
+	}
+	return r.Estimator.Estimate(remote), nil
+}
+
+// estimateHybrid takes the remote hybrid estimator and estimates the size of
+// the difference.
+func (r *Reconcile) estimateHybrid(data []byte) (int, error) {
+	remote := &HybridEstimator{}
+	var err error
+	if r.Format == FormatJSON {
+		err = remote.UnmarshalJSON(data)
+	} else {
+		err = remote.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	r.refreshHybrid()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.Hybrid.Compatible(remote); err != nil {
+		return 0, err
+	}
+	return r.Hybrid.EstimateSizeDifference(remote), nil
 }
 
 //Generates signature of ibf dataset
 //Must be called after estimating difference size
+//If Sketch is set, it is instead a PinSketch with a capacity of 'size' keys
 func (r *Reconcile) GetIBFSignature(size int) ([]byte, error) {
-	ibf := NewIBF(size, len(r.Keyset[0]))
-	for _, key := range r.Keyset {
-		ibf.Add(key)
+	if r.Sketch {
+		return r.getSketchSignature(size)
 	}
-	return ibf.MarshalJSON()
+	return r.marshalIBF(r.localIBF(size))
 }
 
 func (r *Reconcile) GetDifference(size int, remotesignature []byte) (a [][]byte, b [][]byte, ok bool) {
-	ibf := NewIBF(size, len(r.Keyset[0]))
-	for _, key := range r.Keyset {
-		ibf.Add(key)
-	}
-	remoteibf := NewIBF(size, len(r.Keyset[0]))
-	remoteibf.UnmarshalJSON(remotesignature)
-	ibf.Subtract(remoteibf)
-	return ibf.Decode()
+	a, b, err := r.difference(size, remotesignature)
+	return a, b, err == nil
+}
+
+// difference decodes the remote signature like GetDifference. It returns
+// ErrDecodeFailed if the difference does not decode, or else the error that
+// prevented comparing the signatures, such as ErrSeedMismatch.
+func (r *Reconcile) difference(size int, remotesignature []byte) (a [][]byte, b [][]byte, err error) {
+	if r.Sketch {
+		return r.sketchDifference(size, remotesignature)
+	}
+	ibf := r.localIBF(size)
+	remoteibf := r.newIBF(size)
+	if err := r.unmarshalIBF(remoteibf, remotesignature); err != nil {
+		return nil, nil, err
+	}
+	if err := ibf.Subtract(remoteibf); err != nil {
+		return nil, nil, err
+	}
+	a, b, ok := ibf.Decode()
+	if !ok {
+		return nil, nil, ErrDecodeFailed
+	}
+	return a, b, nil
+}
+
+// newIBF creates an empty filter suitable for the local keys.
+func (r *Reconcile) newIBF(size int) *IBF {
+	if r.Variable {
+		return NewVariableIBF(size, r.Keysize, WithHasher(r.Hasher), WithSeed(r.Seed))
+	}
+	return NewIBF(size, r.Keysize, WithHasher(r.Hasher), WithSeed(r.Seed))
+}
+
+// marshalIBF encodes the filter in the configured format.
+func (r *Reconcile) marshalIBF(ibf *IBF) ([]byte, error) {
+	if r.Format == FormatJSON {
+		return ibf.MarshalJSON()
+	}
+	return ibf.MarshalBinary()
+}
+
+// unmarshalIBF decodes the filter from the configured format.
+func (r *Reconcile) unmarshalIBF(ibf *IBF, data []byte) error {
+	if r.Format == FormatJSON {
+		return ibf.UnmarshalJSON(data)
+	}
+	return ibf.UnmarshalBinary(data)
 }
@@ -81,3 +81,32 @@ func TestReconcile(t *testing.T) {
 	fmt.Println(rema)
 	fmt.Println(remb)
 }
+
+func TestVariableReconcile(t *testing.T) {
+	maxkeysize := 48
+	common := makeVariableElements(300, maxkeysize)
+	uniquea := makeVariableElements(12, maxkeysize)
+	uniqueb := makeVariableElements(7, maxkeysize)
+	localset := append(append([][]byte{}, common...), uniquea...)
+	remoteset := append(append([][]byte{}, common...), uniqueb...)
+
+	local := NewVariableReconcile(localset, maxkeysize, len(remoteset))
+	remote := NewVariableReconcile(remoteset, maxkeysize, len(localset))
+
+	estimator, err := remote.GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate, err := local.EstimateDifferenceSize(estimator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, err := local.Difference(estimate, remote.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, uniquea) || !sameElements(b, uniqueb) {
+		t.Error("Difference does not hold the original keys")
+	}
+}
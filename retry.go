@@ -0,0 +1,114 @@
+package reconcile
+
+import "errors"
+
+// ErrDecodeFailed occurs when the difference could not be decoded and the
+// retry policy has been exhausted.
+var ErrDecodeFailed = errors.New("Could not decode set difference")
+
+// FullSet is passed as the size to a SignatureFunc when the retry policy falls
+// back to transferring the entire set instead of an IBF.
+const FullSet = -1
+
+// SignatureFunc obtains the remote signature for an IBF of the given size, or
+// the remote keyset signature when the size is FullSet. The remote side
+// produces it with Reconcile.Signature.
+type SignatureFunc func(size int) ([]byte, error)
+
+// RetryPolicy determines how a Reconcile recovers when an IBF fails to decode
+// because the estimated difference size was too small.
+type RetryPolicy struct {
+	Growth      int  // Factor the IBF size is multiplied by on each retry
+	MaxSize     int  // Largest IBF size to try, or zero for no limit
+	MaxAttempts int  // Number of IBFs to try, including the first
+	Fallback    bool // Whether to transfer the full set when exhausted
+}
+
+// DefaultRetryPolicy doubles the IBF size up to three times before falling
+// back to transferring the full set.
+var DefaultRetryPolicy = RetryPolicy{
+	Growth:      2,
+	MaxSize:     1 << 20,
+	MaxAttempts: 4,
+	Fallback:    true,
+}
+
+// Next returns the IBF size to try after `attempts` IBFs have failed to
+// decode, the last of which had `size` cells. It returns false when the policy
+// has been exhausted.
+func (p RetryPolicy) Next(size, attempts int) (int, bool) {
+	if attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	growth := p.Growth
+	if growth < 2 {
+		growth = 2
+	}
+
+	next := size * growth
+	if p.MaxSize > 0 && next > p.MaxSize {
+		if size >= p.MaxSize {
+			return 0, false
+		}
+		next = p.MaxSize
+	}
+	return next, true
+}
+
+// Signature returns the local signature requested by a remote Difference call:
+// the IBF signature of the given size, or the keyset signature if the size is
+// FullSet.
+func (r *Reconcile) Signature(size int) ([]byte, error) {
+	if size == FullSet {
+		return r.GetKeysetSignature()
+	}
+	return r.GetIBFSignature(size)
+}
+
+// Difference computes the set difference starting with an IBF of the given
+// size, which is usually the result of EstimateDifferenceSize. The remote
+// signatures are obtained from `remote`, and whenever one fails to decode the
+// retry policy chooses a larger size, or falls back to the full set.
+//
+// The first result holds the keys only present locally, and the second holds
+// the keys only present remotely.
+func (r *Reconcile) Difference(size int, remote SignatureFunc) (a [][]byte, b [][]byte, err error) {
+	if size < 1 {
+		size = 1
+	}
+
+	for attempts := 1; ; attempts++ {
+		signature, err := remote(size)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		a, b, err := r.difference(size, signature)
+		if err == nil {
+			return a, b, nil
+		}
+		if err != ErrDecodeFailed {
+			return nil, nil, err
+		}
+
+		next, ok := r.Retry.Next(size, attempts)
+		if !ok {
+			break
+		}
+		size = next
+	}
+
+	if !r.Retry.Fallback {
+		return nil, nil, ErrDecodeFailed
+	}
+
+	signature, err := remote(FullSet)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.GetKeysetDifference(signature)
+}
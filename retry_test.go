@@ -0,0 +1,103 @@
+package reconcile
+
+import (
+	"errors"
+	"testing"
+)
+
+func sameElements(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, element := range a {
+		if !containsElement(b, element) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	policy := RetryPolicy{Growth: 2, MaxSize: 100, MaxAttempts: 4}
+	tests := []struct {
+		size, attempts int
+		next           int
+		ok             bool
+	}{
+		{0, 1, 2, true},
+		{10, 1, 20, true},
+		{40, 2, 80, true},
+		{80, 3, 100, true},
+		{100, 3, 0, false},
+		{10, 4, 0, false},
+	}
+
+	for _, test := range tests {
+		next, ok := policy.Next(test.size, test.attempts)
+		if next != test.next || ok != test.ok {
+			t.Error(
+				"For size", test.size, "after", test.attempts, "attempts",
+				"expected", test.next, test.ok,
+				"got", next, ok)
+		}
+	}
+}
+
+func TestReconcileRetry(t *testing.T) {
+	keysize := 32
+	localset, remoteset := NewTestSets(keysize, 50, 40, 30)
+
+	policies := []struct {
+		title  string
+		policy RetryPolicy
+		err    error
+	}{
+		// Keys whose cells coincide in a filter also coincide in one twice
+		// as large, so the last size is not a power of two
+		{"growth", RetryPolicy{Growth: 2, MaxSize: 1000, MaxAttempts: 10}, nil},
+		{"fallback", RetryPolicy{Fallback: true}, nil},
+		{"exhausted", RetryPolicy{}, ErrDecodeFailed},
+	}
+
+	for _, test := range policies {
+		for _, format := range []Format{FormatBinary, FormatJSON} {
+			local := NewReconcile(localset, len(remoteset))
+			remote := NewReconcile(remoteset, len(localset))
+			local.Retry = test.policy
+			local.Format = format
+			remote.Format = format
+
+			// Start far too small so that the first IBF cannot decode
+			a, b, err := local.Difference(2, remote.Signature)
+			if err != test.err {
+				t.Errorf("For %s test expected %v, got %v", test.title, test.err, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			if !sameElements(a, localset[50:]) || !sameElements(b, remoteset[50:]) {
+				t.Errorf("For %s test the difference is incorrect", test.title)
+			}
+		}
+	}
+}
+
+func TestReconcileRetryMismatch(t *testing.T) {
+	keysize := 32
+	localset, remoteset := NewTestSets(keysize, 50, 4, 3)
+
+	// Signatures that cannot be compared must not be retried or fall back to
+	// the full set
+	local := NewReconcile(localset, len(remoteset), WithSeed(1))
+	remote := NewReconcile(remoteset, len(localset), WithSeed(2))
+	local.Retry = RetryPolicy{Growth: 2, MaxAttempts: 10, Fallback: true}
+	requests := 0
+	_, _, err := local.Difference(20, func(size int) ([]byte, error) {
+		requests++
+		return remote.Signature(size)
+	})
+	if !errors.Is(err, ErrSeedMismatch) || requests != 1 {
+		t.Errorf("Expected %v after one request, got %v after %d", ErrSeedMismatch, err, requests)
+	}
+}
@@ -0,0 +1,651 @@
+package reconcile
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Role determines which side of the protocol a Session plays. One peer must be
+// the initiator and the other the responder.
+type Role int
+
+const (
+	// Initiator opens the exchange, decodes the difference and informs the
+	// responder of the result.
+	Initiator Role = iota
+
+	// Responder answers the initiator's requests.
+	Responder
+)
+
+// ErrProtocol occurs when the peer sends a message that is not expected at
+// the current step of the protocol.
+var ErrProtocol = errors.New("Unexpected reconciliation message")
+
+// ErrSessionMismatch occurs when the peers' sessions are configured
+// incompatibly, such as when only one uses variable-length keys.
+var ErrSessionMismatch = errors.New("Mismatched session parameters")
+
+// ErrSeedCommitment occurs when the seed revealed by the peer does not match
+// the commitment in its hello.
+var ErrSeedCommitment = errors.New("Revealed seed does not match its commitment")
+
+// RemoteError is returned by a Session when the peer aborted the exchange.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "Remote peer failed: " + e.Message
+}
+
+// messageType identifies the contents of a framed message.
+type messageType byte
+
+const (
+	msgHello      messageType = iota + 1 // Version, flags, hash scheme, seed commitment, keysize and set size
+	msgEstimator                         // Strata estimator in binary format
+	msgRequest                           // Requested signature size as a varint, then buckets if partitioned
+	msgSignature                         // Signature from Reconcile.Signature
+	msgResult                            // Decoded difference from the initiator
+	msgError                             // Reason the sender aborted
+	msgCPIRequest                        // Requested number of CPISync evaluations as a uvarint
+	msgCPIResult                         // Initiator's local keys and the polynomial of the remote keys
+	msgPayload                           // Batch of keys and their values, alternating
+	msgPayloadEnd                        // Sender has sent the values of all its keys
+	msgReveal                            // Seed committed to in the sender's hello
+	msgPayloadAck                        // Initiator has stored the values of the responder
+)
+
+// sessionVersion is the version of the protocol spoken by Session.
+const sessionVersion = 2
+
+// seedSize is the size of the random seed each peer contributes to the hash
+// seed of a session.
+const seedSize = 16
+
+// flagRateless is set in the flags of the hello when the session streams
+// rateless coded symbols.
+const flagRateless = 1 << 2
+
+// flagPartitioned is set in the flags of the hello when the session reconciles
+// buckets of the key space partitioned by hash.
+const flagPartitioned = 1 << 3
+
+// flagPayload is set in the flags of the hello when the session exchanges the
+// values of the keys in the difference.
+const flagPayload = 1 << 4
+
+// cpiMaxEstimate is the largest estimated difference for which a session
+// reconciles with CPISync before trying IBFs.
+const cpiMaxEstimate = 16
+
+// ratelessSegment is the size of the first segment of coded symbols requested
+// by a rateless session.
+const ratelessSegment = 16
+
+// maxMessageLength bounds the length of a message read from the peer.
+const maxMessageLength = 1 << 28
+
+// Result holds the set difference found by a Session.
+type Result struct {
+	Local  [][]byte // Keys only present in the local set
+	Remote [][]byte // Keys only present in the remote set
+}
+
+// Session drives the full reconciliation protocol over a connection:
+//
+// 1. Both parties exchange their set sizes and commitments to random seeds,
+// then reveal the seeds.
+// 2. The responder sends its strata estimator.
+// 3. The initiator estimates the size of the difference.
+// 4. The initiator requests IBF signatures, growing them per the retry policy
+// until one decodes.
+// 5. The initiator sends the decoded difference to the responder.
+//
+// If the estimate is at most 16, in step 4 the initiator first requests a
+// CPISync signature, and if it decodes, sends its local keys and the
+// polynomial of the remote keys in step 5. The responder finds its keys among
+// the roots and sends them back. IBFs are used if the CPISync signature does
+// not decode.
+//
+// If Rateless is set on both peers, steps 2 and 3 are skipped, and in step 4
+// the initiator requests consecutive segments of rateless coded symbols,
+// doubling their size, until the difference decodes.
+//
+// If Partitioned is set on both peers, in step 4 the initiator instead requests
+// signatures of buckets of the key space, splitting those that fail to decode,
+// as PartitionDifference does. Rateless takes precedence over Partitioned.
+//
+// If both peers have a Store, the session continues once the difference is
+// known: the initiator sends the values of the keys only it holds in batches,
+// and the responder then does the same, each peer putting the values it
+// receives in its Store. The initiator finally acknowledges the responder's
+// values, or reports why it could not store them.
+//
+// The hash seed used for the exchange is a hash of the seeds revealed by both
+// parties. Each party sends the SHA-256 hash of its seed in its hello and only
+// reveals the seed once it has received the peer's, so that neither can choose
+// the hash seed after learning the other's and keys that always collide cannot
+// be precomputed.
+//
+// Messages are framed as a type byte followed by a 4-byte big-endian length and
+// the payload. A Session does not close its connection.
+type Session struct {
+	Role     Role
+	Keyset   [][]byte
+	Keysize  int    // Size of the keys, required if the keyset is empty
+	Variable bool   // Whether keys may be shorter than Keysize
+	Hasher   Hasher // Hash function of the filters; Murmur3 if nil
+	Retry    RetryPolicy
+	Rateless bool // Whether to stream rateless coded symbols instead of estimating
+
+	// Whether to reconcile hash buckets that are split until they decode
+	Partitioned bool
+
+	Store     Store // Exchanges the values of the difference if not nil
+	BatchSize int   // Largest size of a batch of values; 64 KiB if zero
+
+	conn io.ReadWriter
+}
+
+// NewSession creates a session playing `role` over `conn` to reconcile the
+// given keys.
+func NewSession(conn io.ReadWriter, role Role, keys [][]byte) *Session {
+	keysize := 0
+	if len(keys) > 0 {
+		keysize = len(keys[0])
+	}
+	return &Session{role, keys, keysize, false, nil, DefaultRetryPolicy, false, false, nil, 0, conn}
+}
+
+// Run performs the exchange and returns the difference between the local and
+// remote sets. Both peers receive the same difference, from their own point of
+// view. With a Store, the values of the difference have been exchanged when it
+// returns.
+func (s *Session) Run() (*Result, error) {
+	r, err := s.hello()
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		// Both sets are empty
+		return &Result{}, nil
+	}
+
+	var result *Result
+	switch {
+	case s.Role == Initiator && s.Rateless:
+		result, err = s.initiateRateless(r)
+	case s.Role == Initiator:
+		result, err = s.initiate(r)
+	default:
+		result, err = s.respond(r)
+	}
+	if err != nil || s.Store == nil {
+		return result, err
+	}
+	if err := s.transfer(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// hello exchanges set sizes and creates the reconciler. It returns nil if
+// there is nothing to reconcile.
+//
+// With variable-length keys, the peers use the larger of their maximum key
+// sizes.
+func (s *Session) hello() (*Reconcile, error) {
+	seed := make([]byte, seedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	commitment := sha256.Sum256(seed)
+
+	var flags byte
+	if s.Variable {
+		flags |= flagVariable
+		for _, key := range s.Keyset {
+			if len(key) > s.Keysize {
+				s.Keysize = len(key)
+			}
+		}
+	}
+	if s.Rateless {
+		flags |= flagRateless
+	}
+	if s.Partitioned {
+		flags |= flagPartitioned
+	}
+	if s.Store != nil {
+		flags |= flagPayload
+	}
+
+	hasher := defaultHasher(s.Hasher)
+	hello := []byte{sessionVersion, flags, byte(hasher.Scheme())}
+	hello = append(hello, commitment[:]...)
+	hello = binary.AppendUvarint(hello, uint64(s.Keysize))
+	hello = binary.AppendUvarint(hello, uint64(len(s.Keyset)))
+
+	data, err := s.exchange(msgHello, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{data: data}
+	if d.byte() != sessionVersion && d.err == nil {
+		d.fail(ErrVersion)
+	}
+	if d.byte() != flags && d.err == nil {
+		d.fail(ErrSessionMismatch)
+	}
+	if HashScheme(d.byte()) != hasher.Scheme() && d.err == nil {
+		d.fail(ErrSessionMismatch)
+	}
+	remoteCommitment := d.bytes(sha256.Size)
+	keysize := d.length()
+	count := d.length()
+
+	// Both peers check the hello, so neither sends an error message
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if count == 0 && len(s.Keyset) == 0 {
+		return nil, nil
+	}
+	if s.Keysize == 0 || (s.Variable && keysize > s.Keysize) {
+		s.Keysize = keysize
+	}
+	if keysize != 0 && keysize != s.Keysize && !s.Variable {
+		return nil, ErrKeysize
+	}
+
+	sessionseed, err := s.reveal(seed, remoteCommitment)
+	if err != nil {
+		return nil, err
+	}
+	r := newReconcile(s.Keyset, s.Keysize, count, s.Variable,
+		[]Option{WithHasher(hasher), WithSeed(sessionseed)})
+	r.Retry = s.Retry
+	return r, nil
+}
+
+// reveal exchanges the seeds committed to in the hellos, and returns the hash
+// seed of the session. The peer's seed is checked against its commitment, and
+// if it does not match the session fails without informing the peer, which is
+// not following the protocol.
+func (s *Session) reveal(seed, remoteCommitment []byte) (uint32, error) {
+	remoteSeed, err := s.exchange(msgReveal, seed)
+	if err != nil {
+		return 0, err
+	}
+	if len(remoteSeed) != seedSize {
+		return 0, ErrMalformed
+	}
+	if commitment := sha256.Sum256(remoteSeed); string(commitment[:]) != string(remoteCommitment) {
+		return 0, ErrSeedCommitment
+	}
+
+	// The initiator's seed comes first
+	if s.Role == Responder {
+		seed, remoteSeed = remoteSeed, seed
+	}
+	return sessionSeed(seed, remoteSeed), nil
+}
+
+// sessionSeed derives the hash seed of a session from the seeds of the
+// initiator and the responder.
+func sessionSeed(initiatorSeed, responderSeed []byte) uint32 {
+	sum := sha256.Sum256(append(append([]byte{}, initiatorSeed...), responderSeed...))
+	return binary.LittleEndian.Uint32(sum[:])
+}
+
+// exchange sends a message to the peer and receives the peer's message of the
+// same type. The initiator sends first and the responder receives first.
+func (s *Session) exchange(kind messageType, data []byte) ([]byte, error) {
+	if s.Role == Initiator {
+		if err := s.send(kind, data); err != nil {
+			return nil, err
+		}
+		return s.expect(kind)
+	}
+	received, err := s.expect(kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.send(kind, data); err != nil {
+		return nil, err
+	}
+	return received, nil
+}
+
+// initiate runs the initiator's side of the protocol after the hello.
+func (s *Session) initiate(r *Reconcile) (*Result, error) {
+	estimator, err := s.expect(msgEstimator)
+	if err != nil {
+		return nil, err
+	}
+	estimate, err := r.EstimateDifferenceSize(estimator)
+	if err != nil {
+		return nil, s.abort(err)
+	}
+	if estimate <= cpiMaxEstimate {
+		result, err := s.initiateCPI(r, estimate)
+		if err != ErrDecodeFailed {
+			return result, err
+		}
+	}
+
+	var local, remote [][]byte
+	if s.Partitioned {
+		local, remote, err = r.PartitionDifference(estimate, s.requestPartition)
+	} else {
+		local, remote, err = r.Difference(cellsForEstimate(estimate), s.request)
+	}
+	if err != nil {
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			return nil, err
+		}
+		return nil, s.abort(err)
+	}
+
+	if err := s.send(msgResult, appendKeys(appendKeys(nil, local), remote)); err != nil {
+		return nil, err
+	}
+	return &Result{local, remote}, nil
+}
+
+// initiateCPI reconciles with CPISync for a small estimated difference. It
+// returns ErrDecodeFailed without informing the responder if the signature
+// does not decode, so that IBFs may be tried instead.
+func (s *Session) initiateCPI(r *Reconcile, estimate int) (*Result, error) {
+	points := binary.AppendUvarint(nil, uint64(cpiPointsForEstimate(estimate)))
+	if err := s.send(msgCPIRequest, points); err != nil {
+		return nil, err
+	}
+	data, err := s.expect(msgSignature)
+	if err != nil {
+		return nil, err
+	}
+	local, polynomial, err := r.GetCPIDifference(data)
+	if err == ErrDecodeFailed {
+		return nil, err
+	}
+	if err != nil {
+		return nil, s.abort(err)
+	}
+
+	if err := s.send(msgCPIResult, appendPolynomial(appendKeys(nil, local), polynomial)); err != nil {
+		return nil, err
+	}
+	data, err = s.expect(msgResult)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{data: data}
+	remote := readKeys(d)
+	if err := d.finish(); err != nil {
+		return nil, s.abort(err)
+	}
+	if len(remote) != polynomial.Degree() {
+		return nil, s.abort(ErrMalformed)
+	}
+	return &Result{local, remote}, nil
+}
+
+// initiateRateless runs the initiator's side of the protocol after the hello
+// when streaming rateless coded symbols. The segments requested double in size
+// until the difference decodes, or until the retry policy's maximum size is
+// reached, when the full set is requested instead if the policy allows it.
+func (s *Session) initiateRateless(r *Reconcile) (*Result, error) {
+	decoder := NewRatelessDecoder(r.ratelessEncoder())
+	for size := ratelessSegment; !decoder.Done(); size = decoder.Symbols() {
+		if r.Retry.MaxSize > 0 && decoder.Symbols()+size > r.Retry.MaxSize {
+			break
+		}
+		data, err := s.request(size)
+		if err != nil {
+			return nil, err
+		}
+		segment := &IBF{}
+		if err := segment.UnmarshalBinary(data); err != nil {
+			return nil, s.abort(err)
+		}
+		if err := decoder.Add(segment); err != nil {
+			return nil, s.abort(err)
+		}
+	}
+
+	local, remote := decoder.Difference()
+	if !decoder.Done() {
+		if !r.Retry.Fallback {
+			return nil, s.abort(ErrDecodeFailed)
+		}
+		data, err := s.request(FullSet)
+		if err != nil {
+			return nil, err
+		}
+		if local, remote, err = r.GetKeysetDifference(data); err != nil {
+			return nil, s.abort(err)
+		}
+	}
+
+	if err := s.send(msgResult, appendKeys(appendKeys(nil, local), remote)); err != nil {
+		return nil, err
+	}
+	return &Result{local, remote}, nil
+}
+
+// request asks the responder for the signature of the given size, and is the
+// SignatureFunc of the initiator.
+func (s *Session) request(size int) ([]byte, error) {
+	if err := s.send(msgRequest, binary.AppendVarint(nil, int64(size))); err != nil {
+		return nil, err
+	}
+	return s.expect(msgSignature)
+}
+
+// requestPartition asks the responder for the partition signature of the
+// buckets, and is the PartitionFunc of the initiator.
+func (s *Session) requestPartition(buckets []Bucket, size int) ([]byte, error) {
+	payload := binary.AppendVarint(nil, int64(size))
+	if err := s.send(msgRequest, appendBuckets(payload, buckets)); err != nil {
+		return nil, err
+	}
+	return s.expect(msgSignature)
+}
+
+// respond runs the responder's side of the protocol after the hello. A rateless
+// responder answers requests other than FullSet with the next segment of coded
+// symbols, and a partitioned responder reads the requested buckets.
+func (s *Session) respond(r *Reconcile) (*Result, error) {
+	var encoder *RatelessEncoder
+	if s.Rateless {
+		encoder = r.ratelessEncoder()
+	} else {
+		estimator, err := r.GetDifferenceSizeEstimator()
+		if err != nil {
+			return nil, s.abort(err)
+		}
+		if err := s.send(msgEstimator, estimator); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		kind, data, err := s.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case msgRequest:
+			d := &decoder{data: data}
+			size := int(d.varint())
+			var buckets []Bucket
+			if s.Partitioned && encoder == nil {
+				buckets = readBuckets(d)
+			}
+			if err := d.finish(); err != nil {
+				return nil, s.abort(err)
+			}
+			// The size is bounded like a decoded signature's, so that the
+			// initiator cannot make us allocate more than it could send
+			if (size < 1 && size != FullSet) || size > maxBinaryLength/(r.Keysize+1) {
+				return nil, s.abort(ErrMalformed)
+			}
+			var signature []byte
+			if s.Partitioned && encoder == nil {
+				signature, err = r.PartitionSignature(buckets, size)
+			} else if encoder != nil && size != FullSet {
+				signature, err = encoder.Next(size).MarshalBinary()
+			} else {
+				signature, err = r.Signature(size)
+			}
+			if err != nil {
+				return nil, s.abort(err)
+			}
+			if err := s.send(msgSignature, signature); err != nil {
+				return nil, err
+			}
+
+		case msgCPIRequest:
+			d := &decoder{data: data}
+			points := d.length()
+			if err := d.finish(); err != nil {
+				return nil, s.abort(err)
+			}
+			if points < 1 || points > cpiMaxPoints {
+				return nil, s.abort(ErrMalformed)
+			}
+			signature, err := r.GetCPISignature(points)
+			if err != nil {
+				return nil, s.abort(err)
+			}
+			if err := s.send(msgSignature, signature); err != nil {
+				return nil, err
+			}
+
+		case msgCPIResult:
+			// Our local keys are the roots of the polynomial
+			d := &decoder{data: data}
+			remote := readKeys(d)
+			polynomial := readPolynomial(d)
+			if err := d.finish(); err != nil {
+				return nil, s.abort(err)
+			}
+			local, err := r.CPIRoots(polynomial)
+			if err != nil {
+				return nil, s.abort(err)
+			}
+			if err := s.send(msgResult, appendKeys(nil, local)); err != nil {
+				return nil, err
+			}
+			return &Result{local, remote}, nil
+
+		case msgResult:
+			// The initiator's local keys are our remote keys
+			d := &decoder{data: data}
+			remote := readKeys(d)
+			local := readKeys(d)
+			if err := d.finish(); err != nil {
+				return nil, err
+			}
+			return &Result{local, remote}, nil
+
+		case msgError:
+			return nil, &RemoteError{string(data)}
+
+		default:
+			return nil, s.abort(ErrProtocol)
+		}
+	}
+}
+
+// cellsForEstimate returns the IBF size to use for an estimated difference.
+// Eppstein et al. find that twice the difference decodes with high
+// probability for small differences.
+func cellsForEstimate(estimate int) int {
+	return 2*estimate + 4
+}
+
+// send writes a framed message to the connection.
+func (s *Session) send(kind messageType, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = byte(kind)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := s.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// receive reads a framed message from the connection.
+func (s *Session) receive() (messageType, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxMessageLength {
+		return 0, nil, ErrMalformed
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return messageType(header[0]), payload, nil
+}
+
+// expect reads a message of the given type. An error message from the peer is
+// returned as a RemoteError, and any other message aborts the session.
+func (s *Session) expect(kind messageType) ([]byte, error) {
+	received, payload, err := s.receive()
+	if err != nil {
+		return nil, err
+	}
+	if received == msgError {
+		return nil, &RemoteError{string(payload)}
+	}
+	if received != kind {
+		return nil, s.abort(fmt.Errorf("%w: got type %d, expected %d", ErrProtocol, received, kind))
+	}
+	return payload, nil
+}
+
+// abort informs the peer of the error and returns it.
+func (s *Session) abort(err error) error {
+	s.send(msgError, []byte(err.Error()))
+	return err
+}
+
+// appendKeys appends a list of keys, each prefixed by its length, to `data`.
+func appendKeys(data []byte, keys [][]byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(keys)))
+	for _, key := range keys {
+		data = binary.AppendUvarint(data, uint64(len(key)))
+		data = append(data, key...)
+	}
+	return data
+}
+
+// readKeys reads a list of keys encoded by appendKeys.
+func readKeys(d *decoder) [][]byte {
+	count := d.length()
+	if count > len(d.data) {
+		d.fail(ErrTruncated)
+		return nil
+	}
+	keys := make([][]byte, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		keys = append(keys, d.bytes(d.length()))
+	}
+	return keys
+}
@@ -0,0 +1,205 @@
+package reconcile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// runSessions reconciles the two sets over a net.Pipe and returns the results
+// of the initiator and responder.
+func runSessions(t *testing.T, initiator, responder *Session) (*Result, *Result, error, error) {
+	localConn, remoteConn := net.Pipe()
+	defer localConn.Close()
+	defer remoteConn.Close()
+	initiator.conn = localConn
+	responder.conn = remoteConn
+
+	type outcome struct {
+		result *Result
+		err    error
+	}
+	done := make(chan outcome)
+	go func() {
+		result, err := responder.Run()
+		done <- outcome{result, err}
+	}()
+
+	local, localErr := initiator.Run()
+	if localErr != nil {
+		// Unblock the responder if it is still waiting
+		localConn.Close()
+	}
+	remote := <-done
+	return local, remote.result, localErr, remote.err
+}
+
+func TestSession(t *testing.T) {
+	keysize := 32
+	tests := []struct {
+		title                   string
+		match, uniquea, uniqueb int
+	}{
+		{"Identical sets", 100, 0, 0},
+		{"Small difference", 200, 5, 3},
+		{"Large difference", 100, 150, 120},
+		{"Empty local set", 0, 0, 30},
+		{"Empty remote set", 0, 30, 0},
+		{"Empty sets", 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		localset, remoteset := NewTestSets(keysize, test.match, test.uniquea, test.uniqueb)
+		initiator := NewSession(nil, Initiator, localset)
+		responder := NewSession(nil, Responder, remoteset)
+		initiator.Keysize = keysize
+		responder.Keysize = keysize
+
+		local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+		if localErr != nil || remoteErr != nil {
+			t.Errorf("For %s test got errors %v and %v", test.title, localErr, remoteErr)
+			continue
+		}
+
+		if !sameElements(local.Local, localset[test.match:]) ||
+			!sameElements(local.Remote, remoteset[test.match:]) {
+			t.Errorf("For %s test the initiator's difference is incorrect", test.title)
+		}
+		if !sameElements(remote.Local, remoteset[test.match:]) ||
+			!sameElements(remote.Remote, localset[test.match:]) {
+			t.Errorf("For %s test the responder's difference is incorrect", test.title)
+		}
+	}
+}
+
+func TestSessionKeysizeMismatch(t *testing.T) {
+	localset, _ := NewTestSets(32, 10, 0, 0)
+	remoteset, _ := NewTestSets(16, 10, 0, 0)
+
+	_, _, localErr, remoteErr := runSessions(t,
+		NewSession(nil, Initiator, localset),
+		NewSession(nil, Responder, remoteset))
+	if localErr != ErrKeysize || remoteErr != ErrKeysize {
+		t.Errorf("Expected %v, got %v and %v", ErrKeysize, localErr, remoteErr)
+	}
+}
+
+func TestVariableSession(t *testing.T) {
+	common := makeVariableElements(100, 40)
+	localset := append(makeVariableElements(5, 40), common...)
+	remoteset := append(makeVariableElements(8, 60), common...)
+
+	initiator := NewSession(nil, Initiator, localset)
+	responder := NewSession(nil, Responder, remoteset)
+	initiator.Variable = true
+	responder.Variable = true
+
+	local, remote, localErr, remoteErr := runSessions(t, initiator, responder)
+	if localErr != nil || remoteErr != nil {
+		t.Fatalf("Got errors %v and %v", localErr, remoteErr)
+	}
+	if !sameElements(local.Local, localset[:5]) || !sameElements(local.Remote, remoteset[:8]) {
+		t.Error("The initiator's difference is incorrect")
+	}
+	if !sameElements(remote.Local, remoteset[:8]) || !sameElements(remote.Remote, localset[:5]) {
+		t.Error("The responder's difference is incorrect")
+	}
+
+	// Both peers must agree to use variable-length keys
+	initiator = NewSession(nil, Initiator, localset)
+	initiator.Variable = true
+	_, _, localErr, remoteErr = runSessions(t, initiator, NewSession(nil, Responder, remoteset))
+	if localErr != ErrSessionMismatch || remoteErr != ErrSessionMismatch {
+		t.Errorf("Expected %v, got %v and %v", ErrSessionMismatch, localErr, remoteErr)
+	}
+}
+
+func TestSessionHasherMismatch(t *testing.T) {
+	localset, remoteset := NewTestSets(32, 10, 1, 1)
+	initiator := NewSession(nil, Initiator, localset)
+	initiator.Hasher = fnvHasher{}
+
+	_, _, localErr, remoteErr := runSessions(t, initiator, NewSession(nil, Responder, remoteset))
+	if localErr != ErrSessionMismatch || remoteErr != ErrSessionMismatch {
+		t.Errorf("Expected %v, got %v and %v", ErrSessionMismatch, localErr, remoteErr)
+	}
+}
+
+func TestSessionSeedCommitment(t *testing.T) {
+	localset, _ := NewTestSets(32, 10, 1, 0)
+	localConn, remoteConn := net.Pipe()
+	defer localConn.Close()
+	defer remoteConn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewSession(localConn, Initiator, localset).Run()
+		localConn.Close()
+		done <- err
+	}()
+
+	// The responder knows the initiator's hello before it commits to its seed
+	responder := NewSession(remoteConn, Responder, nil)
+	hello, err := responder.expect(msgHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := make([]byte, seedSize)
+	commitment := sha256.Sum256(seed)
+	reply := append(append([]byte{}, hello[:3]...), commitment[:]...)
+	reply = binary.AppendUvarint(reply, 32)
+	reply = binary.AppendUvarint(reply, 0)
+	if err := responder.send(msgHello, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the initiator reveals its seed, the responder looks for a seed of
+	// its own giving the session seed it wants, which it has not committed to
+	initiatorSeed, err := responder.expect(msgReveal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := make([]byte, seedSize)
+	forged[seedSize-1] = 1
+	for i := uint32(0); sessionSeed(initiatorSeed, forged)&0xff != 0; i++ {
+		binary.LittleEndian.PutUint32(forged, i)
+	}
+	if err := responder.send(msgReveal, forged); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrSeedCommitment {
+		t.Errorf("Expected %v, got %v", ErrSeedCommitment, err)
+	}
+}
+
+func TestSessionRequestSize(t *testing.T) {
+	localset, remoteset := NewTestSets(32, 10, 1, 1)
+	for _, size := range []int64{0, -2, maxBinaryLength} {
+		localConn, remoteConn := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			_, err := NewSession(remoteConn, Responder, remoteset).Run()
+			done <- err
+		}()
+
+		initiator := NewSession(localConn, Initiator, localset)
+		if _, err := initiator.hello(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := initiator.expect(msgEstimator); err != nil {
+			t.Fatal(err)
+		}
+		if err := initiator.send(msgRequest, binary.AppendVarint(nil, size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := initiator.expect(msgSignature); err == nil {
+			t.Errorf("For size %d the responder sent a signature", size)
+		}
+		if err := <-done; err != ErrMalformed {
+			t.Errorf("For size %d expected %v, got %v", size, ErrMalformed, err)
+		}
+		localConn.Close()
+		remoteConn.Close()
+	}
+}
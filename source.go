@@ -0,0 +1,58 @@
+package reconcile
+
+import (
+	"errors"
+	"iter"
+	"slices"
+)
+
+// ErrSource occurs when changing the keys of a reconciler that reads them from
+// a source.
+var ErrSource = errors.New("Keys read from a source cannot be changed")
+
+// NewReconcileSource creates a set reconciler whose `setsize` local keys are
+// yielded by `source`, for sets too large to hold in memory. The source is
+// scanned once to populate the estimator, and again whenever a signature is
+// built, so it must yield the same keys each time, or Rescan must be called
+// when they change. It may reuse the slice it yields. Memory is bounded by the
+// size of the sketches rather than the set, except when the full set is
+// transferred and in rateless sessions, whose encoder holds a copy of every
+// key.
+//
+// The set size determines the depth of the estimator, and need only be
+// approximate. The options are those of NewReconcile.
+func NewReconcileSource(source iter.Seq[[]byte], keysize, setsize, remotesetsize int, opts ...Option) *Reconcile {
+	return newReconcileSource(source, keysize, setsize, remotesetsize, false, opts)
+}
+
+// NewVariableReconcileSource creates a set reconciler like NewReconcileSource,
+// for keys of any length up to `maxkeysize` bytes.
+func NewVariableReconcileSource(source iter.Seq[[]byte], maxkeysize, setsize, remotesetsize int, opts ...Option) *Reconcile {
+	return newReconcileSource(source, maxkeysize, setsize, remotesetsize, true, opts)
+}
+
+// keys returns the local keys, scanned from the Source if there is one.
+func (r *Reconcile) keys() iter.Seq[[]byte] {
+	if r.Source != nil {
+		return r.Source
+	}
+	return slices.Values(r.Keyset)
+}
+
+// Rescan rebuilds the estimator from the local keys and discards the cached
+// filters, so that later signatures reflect changes to the keys made outside
+// of Insert and Delete, such as to the store behind a Source.
+func (r *Reconcile) Rescan() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Estimator != nil {
+		r.Estimator.PopulateSource(r.keys())
+	}
+	if r.Hybrid != nil {
+		r.Hybrid.BuildSignatureSource(r.keys())
+		r.stale = false
+	}
+	r.cache = nil
+	r.cached = nil
+}
@@ -0,0 +1,133 @@
+package reconcile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"iter"
+	"testing"
+)
+
+// countingSource yields the SHA-256 hashes of the integers in [start, end),
+// reusing a single buffer, and counts how often it is scanned.
+func countingSource(start, end int, scans *int) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		*scans++
+		buffer := make([]byte, sha256.Size)
+		for i := start; i < end; i++ {
+			sum := sha256.Sum256(binary.LittleEndian.AppendUint64(nil, uint64(i)))
+			copy(buffer, sum[:])
+			if !yield(buffer) {
+				return
+			}
+		}
+	}
+}
+
+func collect(source iter.Seq[[]byte]) [][]byte {
+	keys := [][]byte{}
+	for key := range source {
+		keys = append(keys, bytes.Clone(key))
+	}
+	return keys
+}
+
+func TestReconcileSourceDepth(t *testing.T) {
+	// A large set size gives an estimator deeper than the key bytes examined
+	scans := 0
+	r := NewReconcileSource(countingSource(0, 1000, &scans), sha256.Size, 50_000_000, 0)
+	if r.Depth <= 25 {
+		t.Errorf("Expected a depth above 25, got %d", r.Depth)
+	}
+	if err := r.Estimator.Add(make([]byte, sha256.Size)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcileSource(t *testing.T) {
+	keysize := sha256.Size
+	scans := 0
+	local := NewReconcileSource(countingSource(0, 1000, &scans), keysize, 1000, 1010)
+	if scans != 1 {
+		t.Errorf("Expected the source to be scanned once, got %d", scans)
+	}
+
+	// The signatures match those built from the same keys in memory
+	var unused int
+	inmemory := NewReconcile(collect(countingSource(0, 1000, &unused)), 1010)
+	for _, size := range []int{20, 40} {
+		got, err := local.GetIBFSignature(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := inmemory.GetIBFSignature(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Signature of size %d does not match the in-memory reconciler", size)
+		}
+	}
+	got, err := local.GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := inmemory.GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Estimator does not match the in-memory reconciler")
+	}
+	if scans != 3 {
+		t.Errorf("Expected the source to be rescanned for each new size, got %d scans", scans)
+	}
+
+	// Reconcile against a shifted range of keys
+	remote := NewReconcileSource(countingSource(10, 1010, &unused), keysize, 1000, 1000)
+	estimator, err := remote.GetDifferenceSizeEstimator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate, err := local.EstimateDifferenceSize(estimator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, err := local.Difference(cellsForEstimate(estimate), remote.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, collect(countingSource(0, 10, &unused))) ||
+		!sameElements(b, collect(countingSource(1000, 1010, &unused))) {
+		t.Error("The difference is incorrect")
+	}
+
+	// The full set is compared without holding the local keys
+	signature, err := remote.GetKeysetSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, err = local.GetKeysetDifference(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, collect(countingSource(0, 10, &unused))) ||
+		!sameElements(b, collect(countingSource(1000, 1010, &unused))) {
+		t.Error("The keyset difference is incorrect")
+	}
+
+	// Changes to the source are seen after a rescan
+	local.Source = countingSource(0, 1010, &unused)
+	local.Rescan()
+	a, b, err = local.Difference(10, remote.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameElements(a, collect(countingSource(0, 10, &unused))) || len(b) != 0 {
+		t.Error("The difference after a rescan is incorrect")
+	}
+
+	if err := local.Insert(make([]byte, keysize)); err != ErrSource {
+		t.Errorf("Expected %v, got %v", ErrSource, err)
+	}
+}
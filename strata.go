@@ -1,57 +1,167 @@
 package reconcile
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
+	"math/bits"
+	"slices"
 )
 
+// ErrStrataMismatch occurs when an estimator's levels disagree with its
+// parameters, or when two estimators with differing parameters are compared.
+var ErrStrataMismatch = errors.New("Mismatched strata estimator parameters")
+
 // Strata estimates the size of the difference between two sets
 type Strata struct {
 	Cellsize int // IBF size for each strata
 	Keysize  int // Bytes
 	Depth    int // Number of levels
 	IBFset   []*IBF
+	Variable bool   // Whether keys may be shorter than Keysize
+	Hasher   Hasher // Hash function of every level; Murmur3 if nil
+	Seed     uint32 // Seed of the hash function
 }
 
 //This is used for the JSON data transfer of the difference estimators
 //For type Strata
 type DifferenceSerialization []IBFSerialization
 
-func NewStrata(cellsize, keysize, depth int) *Strata {
-	IBFset := make([]*IBF, depth)
-	return &Strata{cellsize, keysize, depth, IBFset}
+// StrataSerialization is the self-describing JSON encoding of a Strata. Unlike
+// DifferenceSerialization, it carries the estimator parameters so that the
+// receiver does not have to know them beforehand.
+type StrataSerialization struct {
+	Cellsize int                `json:"cellsize"`
+	Keysize  int                `json:"keysize"`
+	Depth    int                `json:"depth"`
+	Hash     HashScheme         `json:"hash"`
+	Levels   []IBFSerialization `json:"levels"`
+	Variable bool               `json:"variable,omitempty"`
+	Seed     uint32             `json:"seed,omitempty"`
+}
+
+// strataMagic begins the binary encoding of a Strata.
+const strataMagic = "ST"
+
+// NewStrata creates an estimator with `depth` levels, each an IBF of
+// `cellsize` cells holding keys of `keysize` bytes.
+//
+// The hash function and its seed may be selected with the WithHasher and
+// WithSeed options. Keys are assigned to levels by the trailing zeroes of their
+// leading bytes, unless a seed is given, in which case their hash is used so
+// that the assignment cannot be predicted.
+func NewStrata(cellsize, keysize, depth int, opts ...Option) *Strata {
+	o := applyOptions(opts)
+	s := &Strata{cellsize, keysize, depth, make([]*IBF, depth), false, o.hasher, o.seed}
+	s.reset()
+	return s
+}
+
+// NewVariableStrata creates an estimator whose levels are variable filters
+// accepting keys of up to `maxkeysize` bytes. Since such keys need not be
+// uniformly distributed, they are assigned to levels by their hash rather than
+// by their leading bytes.
+func NewVariableStrata(cellsize, maxkeysize, depth int, opts ...Option) *Strata {
+	o := applyOptions(opts)
+	s := &Strata{cellsize, maxkeysize, depth, make([]*IBF, depth), true, o.hasher, o.seed}
+	s.reset()
+	return s
+}
+
+// reset replaces every level with an empty filter.
+func (s *Strata) reset() {
+	for d := range s.IBFset {
+		if s.Variable {
+			s.IBFset[d] = NewVariableIBF(s.Cellsize, s.Keysize, s.options()...)
+		} else {
+			s.IBFset[d] = NewIBF(s.Cellsize, s.Keysize, s.options()...)
+		}
+	}
+}
+
+// options returns the options the levels are created with.
+func (s *Strata) options() []Option {
+	return []Option{WithHasher(s.Hasher), WithSeed(s.Seed)}
+}
+
+// level returns the level that the key is assigned to.
+func (s *Strata) level(key []byte) uint {
+	return strataLevel(key, s.Depth, s.Hasher, s.Seed, s.Variable || s.Seed != 0)
+}
+
+// strataLevel returns the level out of `depth` that the key is assigned to, by
+// the trailing zeroes of its hash if `hashed` is true, or else of its leading 3
+// bytes, which only reach the first 25 levels.
+func strataLevel(key []byte, depth int, hasher Hasher, seed uint32, hashed bool) uint {
+	if hashed {
+		hash := defaultHasher(hasher).Sum128(key, seed)[0]
+		zeroes := uint(bits.TrailingZeros32(hash))
+		if zeroes > uint(depth-1) {
+			zeroes = uint(depth - 1)
+		}
+		return zeroes
+	}
+	return TrailingZeroes(key[:min(len(key), 3)], uint(depth-1))
 }
 
 //Populate an estimator in one
 func (s *Strata) Populate(keys [][]byte) {
+	s.PopulateSource(slices.Values(keys))
+}
+
+// PopulateSource populates the estimator with the keys yielded by `keys`,
+// which are not retained.
+func (s *Strata) PopulateSource(keys iter.Seq[[]byte]) {
 	//Create strata ibfs
-	for d := 0; d < s.Depth; d++ {
-		s.IBFset[d] = NewIBF(s.Cellsize, s.Keysize)
-	}
+	s.reset()
 
 	//assign elements by trailing zeroes
-	for _, key := range keys {
-		s.IBFset[TrailingZeroes(key[:3], uint(s.Depth-1))].Add(key)
+	for key := range keys {
+		s.IBFset[s.level(key)].Add(key)
 	}
 }
 
-//Unmarshal JSON into DifferenceSerialization struct
+// Add inserts the key into the level it is assigned to. If the key is not of
+// the proper length, this function returns an error.
+func (s *Strata) Add(key []byte) error {
+	return s.IBFset[s.level(key)].Add(key)
+}
+
+// Remove removes the key from the level it is assigned to. If the key is not
+// of the proper length, this function returns an error.
+func (s *Strata) Remove(key []byte) error {
+	return s.IBFset[s.level(key)].Remove(key)
+}
+
+// UnmarshalStrataJSON decodes the estimator from either the
+// DifferenceSerialization or StrataSerialization JSON formats. The levels are
+// allocated here, and the parameters are taken from the encoding.
 func (s *Strata) UnmarshalStrataJSON(data []byte) error {
-	serialization := make([]IBFSerialization, s.Depth)
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return s.UnmarshalJSON(data)
+	}
+
+	serialization := DifferenceSerialization{}
 	if err := json.Unmarshal(data, &serialization); err != nil {
 		return err
 	}
-	fmt.Printf("Levels: %v, %v\n", s.Depth, len(s.IBFset))
-	//Process all JSON from remote strata estimator
-	for level, _ := range serialization {
-		fmt.Println(level) //Debug
-		s.IBFset[level].SetIBF(serialization[level])
+	if len(serialization) == 0 {
+		return ErrStrataMismatch
 	}
-	return nil
+	hasher, err := LookupHasher(serialization[0].Hash)
+	if err != nil {
+		return err
+	}
+	return s.setLevels(serialization[0].Size, serialization[0].Keysize, hasher, serialization[0].Seed, serialization)
 }
 
+// MarshalStrataJSON encodes the estimator in the DifferenceSerialization
+// format used by ts-reconcile.
 func (s *Strata) MarshalStrataJSON() ([]byte, error) {
-	signature := make([]IBFSerialization, s.Depth)
+	signature := make(DifferenceSerialization, s.Depth)
 
 	//Process all JSON from remote strata estimator
 	for level, _ := range signature {
@@ -60,6 +170,177 @@ func (s *Strata) MarshalStrataJSON() ([]byte, error) {
 	return json.Marshal(&signature)
 }
 
+// MarshalJSON encodes the estimator in the self-describing format documented
+// by the StrataSerialization type.
+func (s *Strata) MarshalJSON() ([]byte, error) {
+	levels := make([]IBFSerialization, s.Depth)
+	for level := range levels {
+		levels[level] = s.IBFset[level].GetIBF()
+	}
+	return json.Marshal(&StrataSerialization{
+		s.Cellsize,
+		s.Keysize,
+		s.Depth,
+		s.scheme(),
+		levels,
+		s.Variable,
+		s.Seed,
+	})
+}
+
+// UnmarshalJSON decodes the estimator from the self-describing format
+// documented by the StrataSerialization type.
+func (s *Strata) UnmarshalJSON(data []byte) error {
+	serialization := &StrataSerialization{}
+	if err := json.Unmarshal(data, serialization); err != nil {
+		return err
+	}
+	hasher, err := LookupHasher(serialization.Hash)
+	if err != nil {
+		return err
+	}
+	if serialization.Depth != len(serialization.Levels) {
+		return ErrStrataMismatch
+	}
+	return s.setLevels(serialization.Cellsize, serialization.Keysize, hasher, serialization.Seed, serialization.Levels)
+}
+
+// setLevels replaces the estimator with the decoded levels, checking that every
+// level agrees with the cellsize, keysize, hash function and seed.
+func (s *Strata) setLevels(cellsize, keysize int, hasher Hasher, seed uint32, levels []IBFSerialization) error {
+	IBFset := make([]*IBF, len(levels))
+	for level, serialization := range levels {
+		ibf := &IBF{}
+		if err := ibf.SetIBF(serialization); err != nil {
+			return err
+		}
+		if ibf.Size != cellsize || ibf.Keysize != keysize {
+			return fmt.Errorf("%w: level %d has size %d and keysize %d, expected %d and %d",
+				ErrStrataMismatch, level, ibf.Size, ibf.Keysize, cellsize, keysize)
+		}
+		IBFset[level] = ibf
+		if ibf.Variable != IBFset[0].Variable {
+			return fmt.Errorf("%w: level %d differs in variable keys", ErrStrataMismatch, level)
+		}
+		if ibf.scheme() != hasher.Scheme() || ibf.Seed != seed {
+			return fmt.Errorf("%w: level %d differs in hash function", ErrStrataMismatch, level)
+		}
+	}
+
+	variable := len(levels) > 0 && IBFset[0].Variable
+	*s = Strata{cellsize, keysize, len(levels), IBFset, variable, hasher, seed}
+	return nil
+}
+
+// MarshalBinary encodes the estimator in a compact binary format. The header
+// holds the magic bytes "ST", a version byte, the hash scheme, a flags byte,
+// the hash count, cellsize, keysize and depth as unsigned varints, and the seed
+// in 4 little-endian bytes if it is not zero. The cells of each level follow in
+// order, encoded as by IBF.MarshalBinary.
+func (s *Strata) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 16+s.Depth*s.Cellsize*(4+2+s.Keysize))
+	data = append(data, strataMagic...)
+	data = append(data, binaryVersion, byte(s.scheme()), s.flags())
+	data = binary.AppendUvarint(data, ibfHashCount)
+	data = binary.AppendUvarint(data, uint64(s.Cellsize))
+	data = binary.AppendUvarint(data, uint64(s.Keysize))
+	data = binary.AppendUvarint(data, uint64(s.Depth))
+	if s.Seed != 0 {
+		data = binary.LittleEndian.AppendUint32(data, s.Seed)
+	}
+	for _, ibf := range s.IBFset {
+		data = ibf.appendCells(data)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes the estimator from the format produced by
+// MarshalBinary, allocating its levels.
+func (s *Strata) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	d.header(strataMagic)
+	hasher := d.hasher()
+	flags := d.byte()
+	if flags&^(flagVariable|flagSeeded) != 0 {
+		d.fail(ErrMalformed)
+	}
+	if d.err == nil && d.uvarint() != ibfHashCount {
+		d.fail(ErrHashCount)
+	}
+	cellsize := d.length()
+	keysize := d.length()
+	depth := d.length()
+	var seed uint32
+	if flags&flagSeeded != 0 {
+		seed = d.uint32()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if cellsize < 1 || keysize < 1 || depth < 1 || depth > 64 {
+		return ErrMalformed
+	}
+	if !d.remaining(depth*cellsize, minCellLength+keysize) {
+		return d.err
+	}
+
+	newStrata := NewStrata
+	if flags&flagVariable != 0 {
+		newStrata = NewVariableStrata
+	}
+	decoded := newStrata(cellsize, keysize, depth, WithHasher(hasher), WithSeed(seed))
+	for _, ibf := range decoded.IBFset {
+		ibf.readCells(d)
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*s = *decoded
+	return nil
+}
+
+// scheme returns the identifier of the hash function of the estimator.
+func (s *Strata) scheme() HashScheme {
+	return defaultHasher(s.Hasher).Scheme()
+}
+
+// flags returns the flags byte of the binary encoding header.
+func (s *Strata) flags() (flags byte) {
+	if s.Variable {
+		flags |= flagVariable
+	}
+	if s.Seed != 0 {
+		flags |= flagSeeded
+	}
+	return flags
+}
+
+// Compatible returns ErrStrataMismatch if the remote estimator was built with
+// different parameters, or ErrHasherMismatch or ErrSeedMismatch if it was built
+// with a different hash function or seed, in which case the two cannot be
+// compared.
+func (s *Strata) Compatible(remote *Strata) error {
+	if s.scheme() != remote.scheme() {
+		return ErrHasherMismatch
+	}
+	if s.Seed != remote.Seed {
+		return ErrSeedMismatch
+	}
+	if s.Cellsize != remote.Cellsize || s.Keysize != remote.Keysize ||
+		s.Depth != remote.Depth || len(remote.IBFset) != s.Depth ||
+		s.Variable != remote.Variable {
+		return ErrStrataMismatch
+	}
+	return nil
+}
+
+// Estimate returns the estimated size of the difference with the remote set.
+// The levels are decoded from the highest down, and if one fails the count so
+// far is scaled up. Neither estimator is changed, so the local one may be
+// compared with many remotes, concurrently too.
+//
+// The estimators must be compatible, as checked by Compatible.
 func (s *Strata) Estimate(remote *Strata) int {
 	count := 0
 	for level := len(s.IBFset) - 1; level >= -1; level-- {
@@ -67,9 +348,10 @@ func (s *Strata) Estimate(remote *Strata) int {
 			return count
 		}
 
-		ibf := s.IBFset[level]
-		remotelevel := remote.IBFset[level]
-		ibf.Subtract(remotelevel)
+		ibf, err := Difference(s.IBFset[level], remote.IBFset[level])
+		if err != nil {
+			return 0
+		}
 		a, b, ok := ibf.Decode()
 
 		if !ok {
@@ -81,8 +363,11 @@ func (s *Strata) Estimate(remote *Strata) int {
 	return 0
 }
 
-//count trailing zeroes per bit up to limit
+//count trailing zeroes per bit up to limit, or up to the bits of the key
 func TrailingZeroes(key []byte, limit uint) uint {
+	if limit > uint(8*len(key)) {
+		limit = uint(8 * len(key))
+	}
 	var count uint = 0
 	var pattern uint8 = 1
 
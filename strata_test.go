@@ -1,9 +1,12 @@
 package reconcile
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -65,3 +68,134 @@ func TestStrata(t *testing.T) {
 	//fmt.Printf("Error: %v%%\n", 100*math.Abs(1.0-float64(diffloc)/float64(numDifferences)))
 
 }
+
+func TestStrataLevels(t *testing.T) {
+	// Keys are assigned to levels by their leading 3 bytes, which only reach
+	// the first 25 levels of a deeper estimator
+	strata := NewStrata(80, 32, 32)
+	if level := strata.level(make([]byte, 32)); level != 24 {
+		t.Errorf("Expected the zero key at level 24, got %d", level)
+	}
+
+	// Keys shorter than 3 bytes reach as many levels as they have bits
+	strata = NewStrata(80, 1, 20)
+	if level := strata.level([]byte{0}); level != 8 {
+		t.Errorf("Expected a zero byte at level 8, got %d", level)
+	}
+	if level := strata.level([]byte{4}); level != 2 {
+		t.Errorf("Expected the byte 4 at level 2, got %d", level)
+	}
+}
+
+func TestStrataSerialization(t *testing.T) {
+	keysize := 32
+	keys := makeRandomElements(100, keysize)
+	for _, strata := range []*Strata{
+		NewStrata(20, keysize, 6),
+		NewStrata(20, keysize, 6, WithSeed(42)),
+		NewVariableStrata(20, keysize, 6),
+	} {
+		strata.Populate(keys)
+		testStrataSerialization(t, strata)
+	}
+
+	// A header declaring 64 levels of 1<<27 cells must be rejected before they
+	// are allocated
+	header := append([]byte(strataMagic), binaryVersion, byte(HashMurmur3), 0, ibfHashCount, 0x80, 0x80, 0x80, 0x40, 1, 64)
+	if err := (&Strata{}).UnmarshalBinary(header); err != ErrTruncated {
+		t.Errorf("Expected %v for a huge header, got %v", ErrTruncated, err)
+	}
+}
+
+func testStrataSerialization(t *testing.T, strata *Strata) {
+	encodings := []struct {
+		title     string
+		marshal   func(*Strata) ([]byte, error)
+		unmarshal func(*Strata, []byte) error
+	}{
+		{"binary", (*Strata).MarshalBinary, (*Strata).UnmarshalBinary},
+		{"JSON", (*Strata).MarshalJSON, (*Strata).UnmarshalJSON},
+		{"strata JSON", (*Strata).MarshalStrataJSON, (*Strata).UnmarshalStrataJSON},
+	}
+
+	for _, encoding := range encodings {
+		data, err := encoding.marshal(strata)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The receiver does not need to know the parameters in advance
+		decoded := &Strata{}
+		if err := encoding.unmarshal(decoded, data); err != nil {
+			t.Errorf("For %s encoding got %v", encoding.title, err)
+			continue
+		}
+		if !reflect.DeepEqual(strata, decoded) {
+			t.Errorf("For %s encoding the decoded estimator does not match", encoding.title)
+		}
+
+		for i := 0; i < len(data); i += 7 {
+			if err := encoding.unmarshal(&Strata{}, data[:i]); err == nil {
+				t.Errorf("For %s encoding truncation to %d bytes was accepted", encoding.title, i)
+				break
+			}
+		}
+	}
+}
+
+func TestStrataMismatch(t *testing.T) {
+	keysize := 32
+	levels := DifferenceSerialization{
+		NewIBF(20, keysize).GetIBF(),
+		NewIBF(21, keysize).GetIBF(),
+	}
+	data, err := json.Marshal(levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Strata{}).UnmarshalStrataJSON(data); !errors.Is(err, ErrStrataMismatch) {
+		t.Errorf("Expected %v, got %v", ErrStrataMismatch, err)
+	}
+
+	local := NewStrata(20, keysize, 6)
+	remote := NewStrata(20, keysize, 5)
+	if err := local.Compatible(remote); err != ErrStrataMismatch {
+		t.Errorf("Expected %v, got %v", ErrStrataMismatch, err)
+	}
+}
+
+func TestStrataEstimateReuse(t *testing.T) {
+	keysize := 32
+	depth := 10
+	localset, remoteset := NewTestSets(keysize, 500, 10, 10)
+	_, otherset := NewTestSets(keysize, 0, 0, 500)
+
+	local := NewStrata(80, keysize, depth)
+	remote := NewStrata(80, keysize, depth)
+	other := NewStrata(80, keysize, depth)
+	local.Populate(localset)
+	remote.Populate(remoteset)
+	other.Populate(otherset)
+
+	// The estimate is exact unless a level fails to decode, which may rarely
+	// happen, but it must be the same each time
+	want := local.Estimate(remote)
+	if want == 0 {
+		t.Error("Expected an estimate of about 20, got 0")
+	}
+
+	// Estimating against another remote, concurrently, must not disturb the
+	// local estimator
+	done := make(chan int)
+	for i := 0; i < 4; i++ {
+		go func() {
+			local.Estimate(other)
+			done <- local.Estimate(remote)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if got := <-done; got != want {
+			t.Errorf("Repeated estimate was %d, expected %d", got, want)
+		}
+	}
+}
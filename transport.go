@@ -0,0 +1,96 @@
+package reconcile
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrPeerUnreachable occurs when a transport cannot connect to a peer.
+var ErrPeerUnreachable = errors.New("Peer is unreachable")
+
+// Transport opens connections to the peers of an AntiEntropy engine. The
+// engine initiates a session on each connection and closes it when done. The
+// transport is also responsible for accepting the peers' connections and
+// passing them to the engine's Serve.
+type Transport interface {
+	// Dial opens a connection to the peer.
+	Dial(peer string) (io.ReadWriteCloser, error)
+}
+
+// MemoryNetwork connects AntiEntropy engines in the same process, for tests
+// and simulations. Each connection is served synchronously: closing it waits
+// for the remote engine to finish serving, so that a step of an engine is
+// complete on both sides when it returns.
+type MemoryNetwork struct {
+	mu      sync.Mutex
+	engines map[string]*AntiEntropy
+	down    map[string]bool
+}
+
+// NewMemoryNetwork creates a network with no engines.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{engines: map[string]*AntiEntropy{}, down: map[string]bool{}}
+}
+
+// Register makes the engine reachable as the peer named `name`.
+func (n *MemoryNetwork) Register(name string, e *AntiEntropy) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.engines[name] = e
+}
+
+// SetDown makes the peer unreachable if `down` is set, and reachable again
+// otherwise. A peer that is down cannot dial other peers either.
+func (n *MemoryNetwork) SetDown(name string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[name] = down
+}
+
+// Transport returns the transport used by the peer named `name` to connect to
+// the other peers of the network.
+func (n *MemoryNetwork) Transport(name string) Transport {
+	return &memoryTransport{n, name}
+}
+
+// memoryTransport dials the peers of a MemoryNetwork on behalf of one peer.
+type memoryTransport struct {
+	network *MemoryNetwork
+	local   string
+}
+
+// Dial connects to the peer over a net.Pipe, served by the peer's engine.
+func (t *memoryTransport) Dial(peer string) (io.ReadWriteCloser, error) {
+	t.network.mu.Lock()
+	e, ok := t.network.engines[peer]
+	down := t.network.down[peer] || t.network.down[t.local]
+	t.network.mu.Unlock()
+	if !ok || down {
+		return nil, ErrPeerUnreachable
+	}
+
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer remote.Close()
+		e.Serve(t.local, remote)
+	}()
+	return &memoryConn{local, done}, nil
+}
+
+// memoryConn is the dialing end of a MemoryNetwork connection.
+type memoryConn struct {
+	net.Conn
+	done chan struct{}
+}
+
+// Close closes the connection and waits for the remote engine to finish
+// serving it.
+func (c *memoryConn) Close() error {
+	err := c.Conn.Close()
+	<-c.done
+	return err
+}